@@ -0,0 +1,402 @@
+package kinesis
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+)
+
+// AggregatedRecordMagic prefixes the data of records in the aggregated format of the
+// Kinesis Producer Library (KPL). It is followed by a protobuf AggregatedRecord message and
+// the MD5 digest of that message.
+var AggregatedRecordMagic = []byte{0xf3, 0x89, 0x9a, 0xc2}
+
+const (
+	// Field numbers and wire types of the AggregatedRecord protobuf messages:
+	//
+	//	message AggregatedRecord {
+	//		repeated string partition_key_table = 1;
+	//		repeated string explicit_hash_key_table = 2;
+	//		repeated Record records = 3;
+	//	}
+	//	message Record {
+	//		required uint64 partition_key_index = 1;
+	//		optional uint64 explicit_hash_key_index = 2;
+	//		required bytes data = 3;
+	//		repeated Tag tags = 4;
+	//	}
+	pbVarint          = 0
+	pbFixed64         = 1
+	pbLengthDelimited = 2
+	pbFixed32         = 5
+
+	aggPartitionKeyTable    = 1
+	aggExplicitHashKeyTable = 2
+	aggRecords              = 3
+
+	recPartitionKeyIndex    = 1
+	recExplicitHashKeyIndex = 2
+	recData                 = 3
+	recTags                 = 4
+
+	aggDigestSize = md5.Size
+)
+
+// RecordAggregator packs user records into a single Kinesis record in the KPL aggregated
+// format, which the Kinesis Client Library and Deaggregate unpack again. The zero value is
+// an empty aggregator.
+type RecordAggregator struct {
+	partitionKeys    []string
+	partitionKeyIdx  map[string]uint64
+	explicitHashKeys []string
+	hashKeyIdx       map[string]uint64
+	records          []byte
+	count            int
+
+	// first is the first record added, which is sent as is if it is the only one
+	first Record
+	// size is the size of the aggregated data
+	size int
+}
+
+// Len returns the number of user records added.
+func (a *RecordAggregator) Len() int {
+	return a.count
+}
+
+// Size returns the size Kinesis counts against its limits for the record Record would
+// return: its data and partition key.
+func (a *RecordAggregator) Size() int {
+	switch a.count {
+	case 0:
+		return 0
+	case 1:
+		return len(a.first.Data) + len(a.first.PartitionKey)
+	}
+	return a.size + len(a.first.PartitionKey)
+}
+
+// SizeWith returns what Size would return after adding a record.
+func (a *RecordAggregator) SizeWith(partitionKey, explicitHashKey string, data []byte) int {
+	if a.count == 0 {
+		return len(data) + len(partitionKey)
+	}
+	size := a.size
+	if a.count == 1 {
+		size = a.aggregatedSize()
+	}
+	size += a.growth(partitionKey, explicitHashKey, data)
+	return size + len(a.first.PartitionKey)
+}
+
+// aggregatedSize is the size of the aggregated data while there is a single record.
+func (a *RecordAggregator) aggregatedSize() int {
+	return len(AggregatedRecordMagic) + a.size + aggDigestSize
+}
+
+// growth returns how much the aggregated data grows by adding a record.
+func (a *RecordAggregator) growth(partitionKey, explicitHashKey string, data []byte) int {
+	n := 0
+	pkIndex, ok := a.partitionKeyIdx[partitionKey]
+	if !ok {
+		pkIndex = uint64(len(a.partitionKeys))
+		n += pbFieldSize(len(partitionKey))
+	}
+	record := pbVarintFieldSize(pkIndex) + pbFieldSize(len(data))
+	if explicitHashKey != "" {
+		ehkIndex, ok := a.hashKeyIdx[explicitHashKey]
+		if !ok {
+			ehkIndex = uint64(len(a.explicitHashKeys))
+			n += pbFieldSize(len(explicitHashKey))
+		}
+		record += pbVarintFieldSize(ehkIndex)
+	}
+	return n + pbFieldSize(record)
+}
+
+// Add adds a user record. explicitHashKey may be empty.
+func (a *RecordAggregator) Add(partitionKey, explicitHashKey string, data []byte) {
+	if a.count == 0 {
+		a.first = Record{Data: data, PartitionKey: partitionKey, ExplicitHashKey: explicitHashKey}
+		a.partitionKeyIdx = make(map[string]uint64)
+		a.hashKeyIdx = make(map[string]uint64)
+	}
+	growth := a.growth(partitionKey, explicitHashKey, data)
+
+	pkIndex, ok := a.partitionKeyIdx[partitionKey]
+	if !ok {
+		pkIndex = uint64(len(a.partitionKeys))
+		a.partitionKeyIdx[partitionKey] = pkIndex
+		a.partitionKeys = append(a.partitionKeys, partitionKey)
+	}
+	var record []byte
+	record = pbAppendVarintField(record, recPartitionKeyIndex, pkIndex)
+	if explicitHashKey != "" {
+		ehkIndex, ok := a.hashKeyIdx[explicitHashKey]
+		if !ok {
+			ehkIndex = uint64(len(a.explicitHashKeys))
+			a.hashKeyIdx[explicitHashKey] = ehkIndex
+			a.explicitHashKeys = append(a.explicitHashKeys, explicitHashKey)
+		}
+		record = pbAppendVarintField(record, recExplicitHashKeyIndex, ehkIndex)
+	}
+	record = pbAppendBytesField(record, recData, data)
+	a.records = pbAppendBytesField(a.records, aggRecords, record)
+
+	if a.count == 0 {
+		a.size = growth
+	} else if a.count == 1 {
+		a.size = a.aggregatedSize() + growth
+	} else {
+		a.size += growth
+	}
+	a.count++
+}
+
+// Record returns the Kinesis record holding the user records added so far. A single user
+// record is returned as it is, as the KPL does. Otherwise the record takes the partition
+// key of the first user record, and an explicit hash key that places it on the same shard
+// as the first user record.
+func (a *RecordAggregator) Record() Record {
+	if a.count <= 1 {
+		return a.first
+	}
+
+	data := make([]byte, 0, a.size)
+	data = append(data, AggregatedRecordMagic...)
+	for _, pk := range a.partitionKeys {
+		data = pbAppendBytesField(data, aggPartitionKeyTable, []byte(pk))
+	}
+	for _, ehk := range a.explicitHashKeys {
+		data = pbAppendBytesField(data, aggExplicitHashKeyTable, []byte(ehk))
+	}
+	data = append(data, a.records...)
+	digest := md5.Sum(data[len(AggregatedRecordMagic):])
+	data = append(data, digest[:]...)
+
+	ehk := a.first.ExplicitHashKey
+	if ehk == "" {
+		hashKey, _ := RecordHashKey(a.first.PartitionKey, "")
+		ehk = hashKey.String()
+	}
+	return Record{Data: data, PartitionKey: a.first.PartitionKey, ExplicitHashKey: ehk}
+}
+
+// Reset empties the aggregator so that it can be reused.
+func (a *RecordAggregator) Reset() {
+	*a = RecordAggregator{
+		partitionKeys:    a.partitionKeys[:0],
+		explicitHashKeys: a.explicitHashKeys[:0],
+		records:          a.records[:0],
+	}
+}
+
+// ErrInvalidAggregatedRecord is returned by Deaggregate for a record with the aggregated
+// format's prefix and a valid digest whose message can't be decoded.
+var ErrInvalidAggregatedRecord = errors.New("kinesis: invalid aggregated record")
+
+// UserRecord is a record as it was written by a producer, unpacked from a Kinesis record
+// by Deaggregate. The embedded GetRecordsRecords holds the user record's data and
+// partition key, and the sequence number and arrival time of the Kinesis record it was
+// read from.
+type UserRecord struct {
+	GetRecordsRecords
+	// ExplicitHashKey is the explicit hash key the producer gave the user record, if any.
+	ExplicitHashKey string
+	// SubSequenceNumber is the position of the user record in the Kinesis record. Together
+	// with SequenceNumber, it orders user records within a shard.
+	SubSequenceNumber int
+	// Aggregated is true if the user record was unpacked from an aggregated record.
+	Aggregated bool
+}
+
+// Deaggregate unpacks the user records in records that were written in the aggregated
+// format of the Kinesis Producer Library, and returns the other records as they are.
+// Like the Kinesis Client Library, it treats a record whose data starts with the format's
+// prefix but doesn't end with the digest of its message as an ordinary record. The data of
+// the user records refers to the data of records, so it is overwritten when records are
+// reused, e.g. by GetRecordsInto.
+func Deaggregate(records []GetRecordsRecords) ([]UserRecord, error) {
+	userRecords := make([]UserRecord, 0, len(records))
+	for _, record := range records {
+		var err error
+		userRecords, err = appendUserRecords(userRecords, record)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return userRecords, nil
+}
+
+// IsAggregated reports whether data is a record in the aggregated format of the Kinesis
+// Producer Library: it starts with AggregatedRecordMagic and ends with the digest of the
+// message in between.
+func IsAggregated(data []byte) bool {
+	if len(data) < len(AggregatedRecordMagic)+aggDigestSize || !bytes.HasPrefix(data, AggregatedRecordMagic) {
+		return false
+	}
+	message := data[len(AggregatedRecordMagic) : len(data)-aggDigestSize]
+	digest := md5.Sum(message)
+	return bytes.Equal(digest[:], data[len(data)-aggDigestSize:])
+}
+
+func appendUserRecords(userRecords []UserRecord, record GetRecordsRecords) ([]UserRecord, error) {
+	if !IsAggregated(record.Data) {
+		return append(userRecords, UserRecord{GetRecordsRecords: record}), nil
+	}
+
+	var partitionKeys, explicitHashKeys []string
+	var messages [][]byte
+	message := record.Data[len(AggregatedRecordMagic) : len(record.Data)-aggDigestSize]
+	err := pbFields(message, func(field, wireType int, v uint64, b []byte) error {
+		if wireType != pbLengthDelimited {
+			return nil
+		}
+		switch field {
+		case aggPartitionKeyTable:
+			partitionKeys = append(partitionKeys, string(b))
+		case aggExplicitHashKeyTable:
+			explicitHashKeys = append(explicitHashKeys, string(b))
+		case aggRecords:
+			messages = append(messages, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, m := range messages {
+		userRecord := UserRecord{GetRecordsRecords: record, SubSequenceNumber: i, Aggregated: true}
+		userRecord.Data = nil
+		var hasPartitionKey, hasData bool
+		err := pbFields(m, func(field, wireType int, v uint64, b []byte) error {
+			switch {
+			case field == recPartitionKeyIndex && wireType == pbVarint:
+				if v >= uint64(len(partitionKeys)) {
+					return ErrInvalidAggregatedRecord
+				}
+				userRecord.PartitionKey = partitionKeys[v]
+				hasPartitionKey = true
+			case field == recExplicitHashKeyIndex && wireType == pbVarint:
+				if v >= uint64(len(explicitHashKeys)) {
+					return ErrInvalidAggregatedRecord
+				}
+				userRecord.ExplicitHashKey = explicitHashKeys[v]
+			case field == recData && wireType == pbLengthDelimited:
+				userRecord.Data = b
+				hasData = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !hasPartitionKey || !hasData {
+			return nil, ErrInvalidAggregatedRecord
+		}
+		userRecords = append(userRecords, userRecord)
+	}
+	return userRecords, nil
+}
+
+// pbFields calls fn with each field of a protobuf message: its number, its wire type, and
+// its value, as v for varints and fixed size values or as b for length delimited values.
+func pbFields(message []byte, fn func(field, wireType int, v uint64, b []byte) error) error {
+	for len(message) > 0 {
+		key, n := pbVarintValue(message)
+		if n == 0 {
+			return ErrInvalidAggregatedRecord
+		}
+		message = message[n:]
+		field, wireType := int(key>>3), int(key&7)
+
+		var v uint64
+		var b []byte
+		switch wireType {
+		case pbVarint:
+			v, n = pbVarintValue(message)
+			if n == 0 {
+				return ErrInvalidAggregatedRecord
+			}
+		case pbFixed64, pbFixed32:
+			n = 8
+			if wireType == pbFixed32 {
+				n = 4
+			}
+			if len(message) < n {
+				return ErrInvalidAggregatedRecord
+			}
+			for i := n - 1; i >= 0; i-- {
+				v = v<<8 | uint64(message[i])
+			}
+		case pbLengthDelimited:
+			length, m := pbVarintValue(message)
+			if m == 0 || length > uint64(len(message)-m) {
+				return ErrInvalidAggregatedRecord
+			}
+			b = message[m : m+int(length) : m+int(length)]
+			n = m + int(length)
+		default:
+			return ErrInvalidAggregatedRecord
+		}
+		message = message[n:]
+
+		if err := fn(field, wireType, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pbVarintValue decodes the varint at the start of b, returning its value and size, or a
+// size of 0 if b doesn't start with a valid varint.
+func pbVarintValue(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+func pbAppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func pbVarintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+func pbAppendVarintField(b []byte, field int, v uint64) []byte {
+	b = pbAppendVarint(b, uint64(field<<3|pbVarint))
+	return pbAppendVarint(b, v)
+}
+
+func pbAppendBytesField(b []byte, field int, v []byte) []byte {
+	b = pbAppendVarint(b, uint64(field<<3|pbLengthDelimited))
+	b = pbAppendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// pbVarintFieldSize is the encoded size of a varint field with a one byte key.
+func pbVarintFieldSize(v uint64) int {
+	return 1 + pbVarintSize(v)
+}
+
+// pbFieldSize is the encoded size of a length delimited field of n bytes with a one
+// byte key.
+func pbFieldSize(n int) int {
+	return 1 + pbVarintSize(uint64(n)) + n
+}
@@ -0,0 +1,210 @@
+package kinesis
+
+import (
+	"bytes"
+	"crypto/md5"
+	"testing"
+)
+
+func TestRecordAggregator(t *testing.T) {
+	var agg RecordAggregator
+	agg.Add("a", "", []byte("x"))
+	agg.Add("b", "", []byte("yz"))
+	agg.Add("a", "", []byte{})
+
+	message := []byte{
+		0x0a, 0x01, 'a',
+		0x0a, 0x01, 'b',
+		0x1a, 0x05, 0x08, 0x00, 0x1a, 0x01, 'x',
+		0x1a, 0x06, 0x08, 0x01, 0x1a, 0x02, 'y', 'z',
+		0x1a, 0x04, 0x08, 0x00, 0x1a, 0x00,
+	}
+	digest := md5.Sum(message)
+	want := append(append(append([]byte{}, AggregatedRecordMagic...), message...), digest[:]...)
+
+	record := agg.Record()
+	if !bytes.Equal(record.Data, want) {
+		t.Errorf("%x != %x", record.Data, want)
+	}
+	if record.PartitionKey != "a" {
+		t.Errorf("%v != a", record.PartitionKey)
+	}
+	hashKey, _ := RecordHashKey("a", "")
+	if record.ExplicitHashKey != hashKey.String() {
+		t.Errorf("%v != %v", record.ExplicitHashKey, hashKey)
+	}
+	if agg.Len() != 3 {
+		t.Errorf("%v != 3", agg.Len())
+	}
+	if agg.Size() != len(want)+1 {
+		t.Errorf("%v != %v", agg.Size(), len(want)+1)
+	}
+}
+
+func TestRecordAggregatorExplicitHashKeys(t *testing.T) {
+	var agg RecordAggregator
+	agg.Add("a", "1", []byte("x"))
+	agg.Add("a", "2", []byte("y"))
+
+	message := []byte{
+		0x0a, 0x01, 'a',
+		0x12, 0x01, '1',
+		0x12, 0x01, '2',
+		0x1a, 0x07, 0x08, 0x00, 0x10, 0x00, 0x1a, 0x01, 'x',
+		0x1a, 0x07, 0x08, 0x00, 0x10, 0x01, 0x1a, 0x01, 'y',
+	}
+	record := agg.Record()
+	if !bytes.Equal(record.Data[4:len(record.Data)-md5.Size], message) {
+		t.Errorf("%x != %x", record.Data[4:len(record.Data)-md5.Size], message)
+	}
+	if record.ExplicitHashKey != "1" {
+		t.Errorf("%v != 1", record.ExplicitHashKey)
+	}
+}
+
+func TestRecordAggregatorSingleRecord(t *testing.T) {
+	var agg RecordAggregator
+	agg.Add("key", "", []byte("data"))
+
+	record := agg.Record()
+	if string(record.Data) != "data" || record.PartitionKey != "key" || record.ExplicitHashKey != "" {
+		t.Errorf("unexpected record %+v", record)
+	}
+	if agg.Size() != 7 {
+		t.Errorf("%v != 7", agg.Size())
+	}
+}
+
+func TestRecordAggregatorSize(t *testing.T) {
+	var agg RecordAggregator
+	data := bytes.Repeat([]byte{'d'}, 200)
+	keys := []string{"k1", "k2", "k1", "a much longer partition key", "k2"}
+	for i, key := range keys {
+		ehk := ""
+		if i == 3 {
+			ehk = "12345"
+		}
+		want := agg.SizeWith(key, ehk, data[:i*50])
+		agg.Add(key, ehk, data[:i*50])
+		if agg.Size() != want {
+			t.Errorf("%v: SizeWith %v != Size %v", i, want, agg.Size())
+		}
+		record := agg.Record()
+		if size := len(record.Data) + len(record.PartitionKey); size != want {
+			t.Errorf("%v: %v != %v", i, size, want)
+		}
+	}
+
+	agg.Reset()
+	if agg.Len() != 0 || agg.Size() != 0 {
+		t.Errorf("not empty after Reset: %v records, %v bytes", agg.Len(), agg.Size())
+	}
+	agg.Add("x", "", []byte("y"))
+	agg.Add("z", "", []byte("w"))
+	if len(agg.Record().Data) != 4+20+16 {
+		t.Errorf("%v != 40", len(agg.Record().Data))
+	}
+}
+
+// aggregated returns data in the aggregated format holding message.
+func aggregated(message []byte) []byte {
+	digest := md5.Sum(message)
+	return append(append(append([]byte{}, AggregatedRecordMagic...), message...), digest[:]...)
+}
+
+func TestDeaggregate(t *testing.T) {
+	var agg RecordAggregator
+	agg.Add("a", "", []byte("x"))
+	agg.Add("b", "123", []byte("yz"))
+	agg.Add("a", "", []byte{})
+	record := agg.Record()
+
+	records := []GetRecordsRecords{
+		{Data: []byte("plain"), PartitionKey: "p", SequenceNumber: "1"},
+		{Data: record.Data, PartitionKey: record.PartitionKey, SequenceNumber: "2", ApproximateArrivalTimestamp: 1.5},
+	}
+	userRecords, err := Deaggregate(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []UserRecord{
+		{GetRecordsRecords: GetRecordsRecords{Data: []byte("plain"), PartitionKey: "p", SequenceNumber: "1"}},
+		{GetRecordsRecords: GetRecordsRecords{Data: []byte("x"), PartitionKey: "a", SequenceNumber: "2", ApproximateArrivalTimestamp: 1.5}, Aggregated: true},
+		{GetRecordsRecords: GetRecordsRecords{Data: []byte("yz"), PartitionKey: "b", SequenceNumber: "2", ApproximateArrivalTimestamp: 1.5}, ExplicitHashKey: "123", SubSequenceNumber: 1, Aggregated: true},
+		{GetRecordsRecords: GetRecordsRecords{Data: []byte{}, PartitionKey: "a", SequenceNumber: "2", ApproximateArrivalTimestamp: 1.5}, SubSequenceNumber: 2, Aggregated: true},
+	}
+	if len(userRecords) != len(want) {
+		t.Fatalf("%v != %v", len(userRecords), len(want))
+	}
+	for i, r := range userRecords {
+		w := want[i]
+		if !bytes.Equal(r.Data, w.Data) || r.PartitionKey != w.PartitionKey || r.SequenceNumber != w.SequenceNumber ||
+			r.ApproximateArrivalTimestamp != w.ApproximateArrivalTimestamp || r.ExplicitHashKey != w.ExplicitHashKey ||
+			r.SubSequenceNumber != w.SubSequenceNumber || r.Aggregated != w.Aggregated {
+			t.Errorf("%v: %+v != %+v", i, r, w)
+		}
+	}
+}
+
+func TestDeaggregateSkipsUnknownFields(t *testing.T) {
+	message := []byte{
+		0x0a, 0x01, 'a',
+		// a record with a tag, a fixed32 field 6 and a fixed64 field 7
+		0x1a, 0x19, 0x08, 0x00, 0x1a, 0x01, 'x',
+		0x22, 0x04, 0x0a, 0x02, 'k', 'v',
+		0x35, 0x01, 0x02, 0x03, 0x04,
+		0x39, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		// an unknown varint field 9 of the aggregated record
+		0x48, 0x96, 0x01,
+	}
+	userRecords, err := Deaggregate([]GetRecordsRecords{{Data: aggregated(message)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userRecords) != 1 || string(userRecords[0].Data) != "x" || userRecords[0].PartitionKey != "a" {
+		t.Errorf("unexpected records %+v", userRecords)
+	}
+}
+
+func TestDeaggregatePassthrough(t *testing.T) {
+	badDigest := aggregated([]byte{0x0a, 0x01, 'a', 0x1a, 0x05, 0x08, 0x00, 0x1a, 0x01, 'x'})
+	badDigest[len(badDigest)-1] ^= 0xff
+
+	for _, data := range [][]byte{
+		nil,
+		[]byte("plain"),
+		AggregatedRecordMagic,
+		badDigest,
+	} {
+		userRecords, err := Deaggregate([]GetRecordsRecords{{Data: data, PartitionKey: "p"}})
+		if err != nil {
+			t.Errorf("%x: %v", data, err)
+			continue
+		}
+		if len(userRecords) != 1 || !bytes.Equal(userRecords[0].Data, data) || userRecords[0].PartitionKey != "p" || userRecords[0].Aggregated {
+			t.Errorf("%x: unexpected records %+v", data, userRecords)
+		}
+	}
+}
+
+func TestDeaggregateInvalid(t *testing.T) {
+	for _, message := range [][]byte{
+		// truncated partition key
+		{0x0a, 0x05, 'a'},
+		// partition key index out of range
+		{0x0a, 0x01, 'a', 0x1a, 0x05, 0x08, 0x01, 0x1a, 0x01, 'x'},
+		// explicit hash key index out of range
+		{0x0a, 0x01, 'a', 0x1a, 0x07, 0x08, 0x00, 0x10, 0x00, 0x1a, 0x01, 'x'},
+		// no data
+		{0x0a, 0x01, 'a', 0x1a, 0x02, 0x08, 0x00},
+		// unterminated varint
+		{0x0a, 0x01, 'a', 0x1a, 0x02, 0x08, 0x80},
+		// unsupported wire type
+		{0x0b},
+	} {
+		if _, err := Deaggregate([]GetRecordsRecords{{Data: aggregated(message)}}); err != ErrInvalidAggregatedRecord {
+			t.Errorf("%x: %v != %v", message, err, ErrInvalidAggregatedRecord)
+		}
+	}
+}
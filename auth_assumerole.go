@@ -5,21 +5,76 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"time"
 )
 
+const (
+	stsURL     = "https://sts.%s.amazonaws.com"
+	stsVersion = "2011-06-15"
+)
+
+// AssumeRoleOptions holds the optional parameters sent with an STS AssumeRole call.
+// The zero value sends only the role ARN and session name.
+type AssumeRoleOptions struct {
+	// ExternalId is required by roles whose trust policy has an sts:ExternalId condition,
+	// which is common for cross-account access.
+	ExternalId string
+
+	// Duration of the role session. If zero, STS uses its default (1 hour). It is sent
+	// in whole seconds.
+	Duration time.Duration
+
+	// SerialNumber is the identification number of the MFA device, and TokenCode is called
+	// on every refresh to obtain the current code from that device. Both must be set for
+	// roles that require MFA.
+	SerialNumber string
+	TokenCode    func() (string, error)
+
+	// Policy is an inline JSON session policy, and PolicyArns are managed policies; both
+	// further restrict the permissions of the role session.
+	Policy     string
+	PolicyArns []string
+
+	// Tags are passed as session tags. TransitiveTagKeys names the tags that persist
+	// through role chaining.
+	Tags              map[string]string
+	TransitiveTagKeys []string
+
+	// Endpoint overrides the STS endpoint, which defaults to https://sts.{region}.amazonaws.com.
+	Endpoint string
+
+	// HTTPClient is used to make the STS requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Refresh controls when the role credentials are renewed.
+	Refresh RefreshOptions
+}
+
 // NewAuthWithAssumedRole will call STS in a given region to assume a role
 // stsAuth object is used to authenticate to STS to fetch temporary credentials
 // for the desired role.
 func NewAuthWithAssumedRole(roleArn, sessionName, region string, stsAuth Auth) (Auth, error) {
+	return NewAuthWithAssumedRoleOptions(roleArn, sessionName, region, stsAuth, nil)
+}
+
+// NewAuthWithAssumedRoleOptions is like NewAuthWithAssumedRole, but sends the
+// additional AssumeRole parameters in opts. opts may be nil.
+func NewAuthWithAssumedRoleOptions(roleArn, sessionName, region string, stsAuth Auth, opts *AssumeRoleOptions) (Auth, error) {
+	if opts == nil {
+		opts = &AssumeRoleOptions{}
+	}
 	return newCachedMutexedWarmedUpAuth(&stsCreds{
 		RoleARN:     roleArn,
 		SessionName: sessionName,
 		Region:      region,
 		STSAuth:     stsAuth,
-	})
+		Options:     *opts,
+	}, opts.Refresh)
 }
 
 type stsCreds struct {
@@ -27,15 +82,79 @@ type stsCreds struct {
 	SessionName string
 	Region      string
 	STSAuth     Auth
+	Options     AssumeRoleOptions
 }
 
-func (sts *stsCreds) ExpiringKeyForSigning(now time.Time) (*SigningKey, time.Time, error) {
-	r, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://sts.%s.amazonaws.com/?%s", sts.Region, (url.Values{
-		"Version":         []string{"2011-06-15"},
+func (sts *stsCreds) endpoint() string {
+	if sts.Options.Endpoint != "" {
+		return sts.Options.Endpoint
+	}
+	return fmt.Sprintf(stsURL, sts.Region)
+}
+
+func (sts *stsCreds) httpClient() *http.Client {
+	if sts.Options.HTTPClient != nil {
+		return sts.Options.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// params builds the AssumeRole query parameters from the role and options.
+func (sts *stsCreds) params() (url.Values, error) {
+	opts := sts.Options
+	v := url.Values{
+		"Version":         []string{stsVersion},
 		"Action":          []string{"AssumeRole"},
 		"RoleSessionName": []string{sts.SessionName},
 		"RoleArn":         []string{sts.RoleARN},
-	}).Encode()), bytes.NewReader([]byte{}))
+	}
+	if opts.ExternalId != "" {
+		v.Set("ExternalId", opts.ExternalId)
+	}
+	if opts.Duration > 0 {
+		v.Set("DurationSeconds", strconv.Itoa(int(opts.Duration/time.Second)))
+	}
+	if opts.SerialNumber != "" {
+		if opts.TokenCode == nil {
+			return nil, errors.New("AssumeRoleOptions.SerialNumber requires TokenCode to be set")
+		}
+		code, err := opts.TokenCode()
+		if err != nil {
+			return nil, err
+		}
+		v.Set("SerialNumber", opts.SerialNumber)
+		v.Set("TokenCode", code)
+	}
+	if opts.Policy != "" {
+		v.Set("Policy", opts.Policy)
+	}
+	for i, arn := range opts.PolicyArns {
+		v.Set(fmt.Sprintf("PolicyArns.member.%d.arn", i+1), arn)
+	}
+
+	// sort the tag keys so that requests are deterministic
+	keys := make([]string, 0, len(opts.Tags))
+	for k := range opts.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		v.Set(fmt.Sprintf("Tags.member.%d.Key", i+1), k)
+		v.Set(fmt.Sprintf("Tags.member.%d.Value", i+1), opts.Tags[k])
+	}
+	for i, k := range opts.TransitiveTagKeys {
+		v.Set(fmt.Sprintf("TransitiveTagKeys.member.%d", i+1), k)
+	}
+	return v, nil
+}
+
+func (sts *stsCreds) ExpiringKeyForSigning(now time.Time) (*SigningKey, time.Time, error) {
+	params, err := sts.params()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	r, err := http.NewRequest(http.MethodPost, sts.endpoint()+"/?"+params.Encode(), bytes.NewReader([]byte{}))
 	if err != nil {
 		return nil, time.Time{}, err
 	}
@@ -48,14 +167,14 @@ func (sts *stsCreds) ExpiringKeyForSigning(now time.Time) (*SigningKey, time.Tim
 		return nil, time.Time{}, err
 	}
 
-	resp, err := http.DefaultClient.Do(r)
+	resp, err := sts.httpClient().Do(r)
 	if err != nil {
 		return nil, time.Time{}, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, time.Time{}, errors.New("bad status code")
+		return nil, time.Time{}, buildSTSError(resp)
 	}
 
 	var wrapper struct {
@@ -84,3 +203,34 @@ func (sts *stsCreds) ExpiringKeyForSigning(now time.Time) (*SigningKey, time.Tim
 		SessionToken:    wrapper.AssumeRoleResult.Credentials.SessionToken,
 	}, wrapper.AssumeRoleResult.Credentials.Expiration, nil
 }
+
+type stsErrorResponse struct {
+	Error struct {
+		Code    string
+		Message string
+	}
+	RequestId string
+}
+
+// buildSTSError converts an STS XML error body into an *Error, falling back
+// to the raw body when it cannot be parsed.
+func buildSTSError(r *http.Response) error {
+	body, ioerr := ioutil.ReadAll(r.Body)
+	if ioerr != nil {
+		return fmt.Errorf("Could not read response body: %s", ioerr)
+	}
+
+	var errResp stsErrorResponse
+	xml.Unmarshal(body, &errResp)
+
+	err := &Error{
+		StatusCode: r.StatusCode,
+		Code:       errResp.Error.Code,
+		Message:    errResp.Error.Message,
+		RequestId:  errResp.RequestId,
+	}
+	if err.Message == "" {
+		err.Message = fmt.Sprintf("%s: %s", r.Status, body)
+	}
+	return err
+}
@@ -1,23 +1,66 @@
 package kinesis
 
 import (
+	"math/rand"
 	"sync"
 	"time"
 )
 
+const (
+	// DefaultRefreshWindow is how long before expiry cached temporary credentials
+	// are refreshed when RefreshOptions.Window is not set.
+	DefaultRefreshWindow = 5 * time.Minute
+
+	// refreshRetryInterval is how long to wait before trying again after a failed
+	// refresh while the current credentials are still valid.
+	refreshRetryInterval = 10 * time.Second
+
+	// minRefreshDelay keeps the background refresher from spinning if the
+	// credential source returns credentials that are already inside the window.
+	minRefreshDelay = 1 * time.Second
+)
+
+// RefreshOptions controls when cached temporary credentials are renewed.
+type RefreshOptions struct {
+	// Window is how long before the expiration time the credentials are refreshed,
+	// so that requests signed just before expiry don't fail in flight. If zero,
+	// DefaultRefreshWindow is used. The window is capped at half the lifetime of the
+	// credentials.
+	Window time.Duration
+
+	// Background starts a goroutine that refreshes the credentials ahead of the
+	// window, so that signing never waits on the credential source. The returned
+	// Auth then implements io.Closer, and Close stops the goroutine.
+	Background bool
+
+	// Jitter is the maximum random amount by which each background refresh is
+	// brought forward, so that many clients don't refresh at the same moment.
+	Jitter time.Duration
+}
+
 // newCachedMutexedWarmedUpAuth wraps another auth object
 // with a cache that is thread-safe, and will always attempt
 // to fetch credentials when initialised.
-// The underlying Auth object will only be called if the time is
-// past the last returned expiration time.
-func newCachedMutexedWarmedUpAuth(underlying temporaryCredentialGenerator) (Auth, error) {
+// The underlying Auth object will only be called once the time is
+// within the refresh window of the last returned expiration time.
+// If a refresh fails while the current credentials have not yet
+// expired, the current credentials continue to be served.
+func newCachedMutexedWarmedUpAuth(underlying temporaryCredentialGenerator, opts RefreshOptions) (Auth, error) {
+	if opts.Window == 0 {
+		opts.Window = DefaultRefreshWindow
+	}
 	rv := &cachedMutexedAuth{
 		underlying: underlying,
+		opts:       opts,
 	}
 	_, err := rv.KeyForSigning(time.Now())
 	if err != nil {
 		return nil, err
 	}
+	if opts.Background {
+		rv.done = make(chan struct{})
+		go rv.refreshLoop()
+	}
 	return rv, nil
 }
 
@@ -30,24 +73,125 @@ type temporaryCredentialGenerator interface {
 }
 
 type cachedMutexedAuth struct {
-	mu         sync.Mutex
-	current    *SigningKey
-	expiration time.Time
+	// mu guards the fields below it; refreshMu serialises calls to underlying so
+	// that requests can keep reading the current key while a refresh is running.
+	mu          sync.Mutex
+	current     *SigningKey
+	expiration  time.Time
+	refreshAt   time.Time
+	nextAttempt time.Time
+
+	refreshMu  sync.Mutex
 	underlying temporaryCredentialGenerator
+	opts       RefreshOptions
+
+	closeOnce sync.Once
+	done      chan struct{}
 }
 
 func (cmuxa *cachedMutexedAuth) KeyForSigning(now time.Time) (*SigningKey, error) {
+	cmuxa.mu.Lock()
+	current, expiration := cmuxa.current, cmuxa.expiration
+	valid := current != nil && expiration.After(now)
+	fresh := current != nil && now.Before(cmuxa.refreshAt)
+	retryable := !now.Before(cmuxa.nextAttempt)
+	cmuxa.mu.Unlock()
+
+	if fresh {
+		return current, nil
+	}
+	// the background goroutine is responsible for refreshing valid credentials,
+	// and after a failed refresh we don't try again on every request
+	if valid && (cmuxa.opts.Background || !retryable) {
+		return current, nil
+	}
+
+	key, err := cmuxa.refresh(now, false)
+	if err != nil {
+		if valid {
+			return current, nil
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// refresh fetches new credentials from the underlying generator unless, when not
+// forced, another caller has already refreshed them while we waited for refreshMu.
+func (cmuxa *cachedMutexedAuth) refresh(now time.Time, force bool) (*SigningKey, error) {
+	cmuxa.refreshMu.Lock()
+	defer cmuxa.refreshMu.Unlock()
+
+	cmuxa.mu.Lock()
+	if !force && cmuxa.current != nil && now.Before(cmuxa.refreshAt) {
+		defer cmuxa.mu.Unlock()
+		return cmuxa.current, nil
+	}
+	cmuxa.mu.Unlock()
+
+	newCurrent, newExpiration, err := cmuxa.underlying.ExpiringKeyForSigning(now)
+
 	cmuxa.mu.Lock()
 	defer cmuxa.mu.Unlock()
+	if err != nil {
+		cmuxa.nextAttempt = now.Add(refreshRetryInterval)
+		return nil, err
+	}
+	cmuxa.current = newCurrent
+	cmuxa.expiration = newExpiration
+	cmuxa.nextAttempt = time.Time{}
+
+	window := cmuxa.opts.Window
+	half := newExpiration.Sub(now) / 2
+	if half < 0 {
+		half = 0
+	}
+	if window > half {
+		window = half
+	}
+	cmuxa.refreshAt = newExpiration.Add(-window)
 
-	if cmuxa.current == nil || !cmuxa.expiration.After(now) {
-		newCurrent, newExpiration, err := cmuxa.underlying.ExpiringKeyForSigning(now)
-		if err != nil {
-			return nil, err
+	return newCurrent, nil
+}
+
+// refreshLoop refreshes the credentials shortly before they enter the refresh
+// window until Close is called.
+func (cmuxa *cachedMutexedAuth) refreshLoop() {
+	for {
+		cmuxa.mu.Lock()
+		next := cmuxa.refreshAt
+		if cmuxa.nextAttempt.After(next) {
+			next = cmuxa.nextAttempt
+		}
+		cmuxa.mu.Unlock()
+
+		if cmuxa.opts.Jitter > 0 {
+			next = next.Add(-time.Duration(rand.Int63n(int64(cmuxa.opts.Jitter))))
+		}
+
+		delay := time.Until(next)
+		if delay < minRefreshDelay {
+			delay = minRefreshDelay
 		}
-		cmuxa.current = newCurrent
-		cmuxa.expiration = newExpiration
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-cmuxa.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		// failures are recorded in nextAttempt and the current credentials keep
+		// being served until they expire
+		cmuxa.refresh(time.Now(), true)
 	}
+}
 
-	return cmuxa.current, nil
+// Close stops the background refresher, if there is one.
+func (cmuxa *cachedMutexedAuth) Close() error {
+	if cmuxa.done != nil {
+		cmuxa.closeOnce.Do(func() { close(cmuxa.done) })
+	}
+	return nil
 }
@@ -23,7 +23,13 @@ const (
 // TODO: specify custom network (connect, read) timeouts, else this will block
 // for the default timeout durations.
 func NewAuthFromMetadata() (Auth, error) {
-	return newCachedMutexedWarmedUpAuth(&metadataCreds{})
+	return NewAuthFromMetadataWithRefresh(RefreshOptions{})
+}
+
+// NewAuthFromMetadataWithRefresh is like NewAuthFromMetadata, but controls when
+// the instance credentials are refreshed.
+func NewAuthFromMetadataWithRefresh(opts RefreshOptions) (Auth, error) {
+	return newCachedMutexedWarmedUpAuth(&metadataCreds{}, opts)
 }
 
 type metadataCreds struct{}
@@ -0,0 +1,189 @@
+package kinesis
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// credentialProcessVersion is the only output version of the credential_process
+// convention that is understood.
+const credentialProcessVersion = 1
+
+const (
+	// defaultCredentialProcessTimeout is how long a credential_process command may run
+	// if CredentialProcessOptions.Timeout is zero.
+	defaultCredentialProcessTimeout = 1 * time.Minute
+
+	// credentialProcessWaitDelay is how long to wait for the output of a credential_process
+	// command to be closed after it exits or is killed, since a child it started may still
+	// hold it open.
+	credentialProcessWaitDelay = 1 * time.Second
+)
+
+// CredentialProcessOptions holds the optional parameters of a credential_process provider.
+// The zero value uses the default timeout and refresh behaviour.
+type CredentialProcessOptions struct {
+	// Timeout is how long the command may run before it is killed and the refresh fails.
+	// If zero, it is one minute.
+	Timeout time.Duration
+
+	// Refresh controls when the credentials are refreshed.
+	Refresh RefreshOptions
+}
+
+// NewAuthFromCredentialProcess retrieves auth credentials by running command, following
+// the credential_process convention used by the AWS CLI and SDKs: the command prints a
+// JSON object with Version, AccessKeyId, SecretAccessKey, and optionally SessionToken and
+// Expiration. The command is split into arguments on whitespace, honouring single and
+// double quotes, and is not run through a shell. It is run again whenever the
+// credentials are about to expire, and is killed if it runs for longer than a minute.
+func NewAuthFromCredentialProcess(command string) (Auth, error) {
+	return NewAuthFromCredentialProcessOptions(command, nil)
+}
+
+// NewAuthFromCredentialProcessWithRefresh is like NewAuthFromCredentialProcess, but
+// controls when the credentials are refreshed.
+func NewAuthFromCredentialProcessWithRefresh(command string, opts RefreshOptions) (Auth, error) {
+	return NewAuthFromCredentialProcessOptions(command, &CredentialProcessOptions{Refresh: opts})
+}
+
+// NewAuthFromCredentialProcessOptions is like NewAuthFromCredentialProcess, but with the
+// timeout and refresh behaviour in opts. opts may be nil.
+func NewAuthFromCredentialProcessOptions(command string, opts *CredentialProcessOptions) (Auth, error) {
+	if opts == nil {
+		opts = &CredentialProcessOptions{}
+	}
+	args, err := splitCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("credential_process command is empty")
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = defaultCredentialProcessTimeout
+	}
+	return newCachedMutexedWarmedUpAuth(&processCreds{args: args, timeout: timeout}, opts.Refresh)
+}
+
+type processCreds struct {
+	args    []string
+	timeout time.Duration
+}
+
+type credentialProcessOutput struct {
+	Version         int
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      string
+}
+
+func (pc *processCreds) ExpiringKeyForSigning(now time.Time) (*SigningKey, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pc.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, pc.args[0], pc.args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// the context kills only the command itself, not a child holding its output open
+	cmd.WaitDelay = credentialProcessWaitDelay
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, time.Time{}, fmt.Errorf("credential_process %s timed out after %v", pc.args[0], pc.timeout)
+	}
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("credential_process %s failed: %s: %s", pc.args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	var out credentialProcessOutput
+	err = json.Unmarshal(stdout.Bytes(), &out)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("credential_process %s returned invalid JSON: %s", pc.args[0], err)
+	}
+	if out.Version != credentialProcessVersion {
+		return nil, time.Time{}, fmt.Errorf("credential_process %s returned unsupported Version %d", pc.args[0], out.Version)
+	}
+	if out.AccessKeyId == "" || out.SecretAccessKey == "" {
+		return nil, time.Time{}, fmt.Errorf("credential_process %s did not return AccessKeyId and SecretAccessKey", pc.args[0])
+	}
+
+	// credentials without an expiration never need refreshing
+	expiry := now.AddDate(100, 0, 0)
+	if out.Expiration != "" {
+		expiry, err = time.Parse(time.RFC3339, out.Expiration)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+
+	return &SigningKey{
+		AccessKeyId:     out.AccessKeyId,
+		SecretAccessKey: out.SecretAccessKey,
+		SessionToken:    out.SessionToken,
+	}, expiry, nil
+}
+
+// splitCommand splits a command line into arguments on unquoted whitespace.
+// Single quotes preserve everything up to the closing quote; inside double
+// quotes a backslash escapes the next character.
+func splitCommand(command string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, c := range command {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' {
+				escaped = true
+			} else {
+				current.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == '\\':
+			escaped = true
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("credential_process command has unterminated quote or escape: %s", command)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
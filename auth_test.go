@@ -1,7 +1,15 @@
 package kinesis
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -113,3 +121,226 @@ func TestNewAuthFromEnvWithFallbackVars(t *testing.T) {
 		t.Error("Expected SecretKey to be inferred as \"asdf2\"")
 	}
 }
+
+const testAssumeRoleResponse = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIAEXAMPLE</AccessKeyId>
+      <SecretAccessKey>assumed_secret</SecretAccessKey>
+      <SessionToken>assumed_token</SessionToken>
+      <Expiration>2100-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`
+
+func TestNewAuthWithAssumedRoleOptions(t *testing.T) {
+	var query map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte(testAssumeRoleResponse))
+	}))
+	defer server.Close()
+
+	auth, err := NewAuthWithAssumedRoleOptions("arn:aws:iam::123456789012:role/test", "session", USEast1,
+		NewAuth("BAD_ACCESS_KEY", "BAD_SECRET_KEY", ""), &AssumeRoleOptions{
+			ExternalId:   "external",
+			Duration:     15 * time.Minute,
+			SerialNumber: "arn:aws:iam::123456789012:mfa/user",
+			TokenCode:    func() (string, error) { return "123456", nil },
+			Tags:         map[string]string{"team": "data", "env": "test"},
+			Endpoint:     server.URL,
+			HTTPClient:   server.Client(),
+		})
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	sk, _ := auth.KeyForSigning(time.Now())
+	if sk.SecretAccessKey != "assumed_secret" || sk.SessionToken != "assumed_token" {
+		t.Errorf("unexpected signing key %+v", sk)
+	}
+
+	expected := map[string]string{
+		"ExternalId":          "external",
+		"DurationSeconds":     "900",
+		"SerialNumber":        "arn:aws:iam::123456789012:mfa/user",
+		"TokenCode":           "123456",
+		"Tags.member.1.Key":   "env",
+		"Tags.member.1.Value": "test",
+		"Tags.member.2.Key":   "team",
+		"Tags.member.2.Value": "data",
+		"RoleSessionName":     "session",
+	}
+	for k, v := range expected {
+		if len(query[k]) != 1 || query[k][0] != v {
+			t.Errorf("%s: %v != %v", k, query[k], v)
+		}
+	}
+}
+
+func TestNewAuthWithAssumedRoleError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<ErrorResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <Error>
+    <Type>Sender</Type>
+    <Code>AccessDenied</Code>
+    <Message>not authorized to perform sts:AssumeRole</Message>
+  </Error>
+  <RequestId>c6104cbe-af31-11e0-8154-cbc7ccf896c7</RequestId>
+</ErrorResponse>`))
+	}))
+	defer server.Close()
+
+	_, err := NewAuthWithAssumedRoleOptions("arn:aws:iam::123456789012:role/test", "session", USEast1,
+		NewAuth("BAD_ACCESS_KEY", "BAD_SECRET_KEY", ""), &AssumeRoleOptions{Endpoint: server.URL})
+	kerr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("%v is not an *Error", err)
+	}
+	if kerr.StatusCode != http.StatusForbidden || kerr.Code != "AccessDenied" || kerr.RequestId != "c6104cbe-af31-11e0-8154-cbc7ccf896c7" {
+		t.Errorf("unexpected error %+v", kerr)
+	}
+}
+
+type mockCredentialGenerator struct {
+	mu       sync.Mutex
+	calls    int
+	lifetime time.Duration
+	fail     bool
+}
+
+func (m *mockCredentialGenerator) ExpiringKeyForSigning(now time.Time) (*SigningKey, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	if m.fail {
+		return nil, time.Time{}, errors.New("Oh Noes!")
+	}
+	return &SigningKey{AccessKeyId: fmt.Sprintf("KEY%d", m.calls)}, now.Add(m.lifetime), nil
+}
+
+func (m *mockCredentialGenerator) callCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls
+}
+
+func TestCachedAuthRefreshWindow(t *testing.T) {
+	gen := &mockCredentialGenerator{lifetime: time.Hour}
+	auth, err := newCachedMutexedWarmedUpAuth(gen, RefreshOptions{Window: 10 * time.Minute})
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	now := time.Now()
+
+	sk, _ := auth.KeyForSigning(now.Add(49 * time.Minute))
+	if sk.AccessKeyId != "KEY1" || gen.callCount() != 1 {
+		t.Errorf("expected cached KEY1 before the window, got %v after %v calls", sk.AccessKeyId, gen.callCount())
+	}
+
+	sk, _ = auth.KeyForSigning(now.Add(51 * time.Minute))
+	if sk.AccessKeyId != "KEY2" || gen.callCount() != 2 {
+		t.Errorf("expected KEY2 inside the window, got %v after %v calls", sk.AccessKeyId, gen.callCount())
+	}
+}
+
+func TestCachedAuthServesStaleCredentialsOnFailure(t *testing.T) {
+	gen := &mockCredentialGenerator{lifetime: time.Hour}
+	auth, err := newCachedMutexedWarmedUpAuth(gen, RefreshOptions{})
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	now := time.Now()
+	gen.fail = true
+
+	sk, err := auth.KeyForSigning(now.Add(58 * time.Minute))
+	if err != nil || sk.AccessKeyId != "KEY1" {
+		t.Errorf("expected stale KEY1, got %v, %v", sk, err)
+	}
+
+	// a second request straight away should not hit the credential source again
+	auth.KeyForSigning(now.Add(58 * time.Minute))
+	if gen.callCount() != 2 {
+		t.Errorf("%v != 2", gen.callCount())
+	}
+
+	_, err = auth.KeyForSigning(now.Add(61 * time.Minute))
+	if err == nil {
+		t.Error("expected an error once the credentials have expired")
+	}
+}
+
+func TestCachedAuthBackgroundRefresh(t *testing.T) {
+	gen := &mockCredentialGenerator{lifetime: 2 * time.Second}
+	auth, err := newCachedMutexedWarmedUpAuth(gen, RefreshOptions{Background: true})
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	defer auth.(io.Closer).Close()
+
+	// the window is capped at half the lifetime, so a refresh happens after about 1s
+	time.Sleep(1500 * time.Millisecond)
+	if gen.callCount() != 2 {
+		t.Errorf("%v != 2", gen.callCount())
+	}
+
+	sk, _ := auth.KeyForSigning(time.Now())
+	if sk.AccessKeyId != "KEY2" {
+		t.Errorf("%v != KEY2", sk.AccessKeyId)
+	}
+}
+
+func TestNewAuthFromCredentialProcess(t *testing.T) {
+	auth, err := NewAuthFromCredentialProcess(`echo '{"Version": 1, "AccessKeyId": "process_key", "SecretAccessKey": "process_secret", "SessionToken": "process_token", "Expiration": "2100-01-01T00:00:00Z"}'`)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+
+	sk, _ := auth.KeyForSigning(time.Now())
+	if sk.AccessKeyId != "process_key" || sk.SecretAccessKey != "process_secret" || sk.SessionToken != "process_token" {
+		t.Errorf("unexpected signing key %+v", sk)
+	}
+}
+
+func TestNewAuthFromCredentialProcessWithBadVersion(t *testing.T) {
+	_, err := NewAuthFromCredentialProcess(`echo '{"Version": 2, "AccessKeyId": "process_key", "SecretAccessKey": "process_secret"}'`)
+	if err == nil || !strings.Contains(err.Error(), "unsupported Version 2") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCredentialProcessTimeout(t *testing.T) {
+	pc := &processCreds{args: []string{"sleep", "10"}, timeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, _, err := pc.ExpiringKeyForSigning(start)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v", elapsed)
+	}
+}
+
+func TestCredentialProcessTimeoutWithChild(t *testing.T) {
+	// the shell is killed, but the sleep it started still holds stdout open
+	start := time.Now()
+	auth, err := NewAuthFromCredentialProcessOptions(`sh -c "sleep 10; echo"`, &CredentialProcessOptions{Timeout: 50 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "timed out") || auth != nil {
+		t.Errorf("unexpected result %v, %v", auth, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v", elapsed)
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	args, err := splitCommand(`helper --profile "my profile" 'a "quoted" arg' a\ b`)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	expected := []string{"helper", "--profile", "my profile", `a "quoted" arg`, "a b"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("%q != %q", args, expected)
+	}
+}
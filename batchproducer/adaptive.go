@@ -0,0 +1,205 @@
+package batchproducer
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/sendgridlabs/go-kinesis"
+)
+
+// throttledErrorCode is the error code of records rejected because a shard's throughput limit
+// was exceeded.
+const throttledErrorCode = "ProvisionedThroughputExceededException"
+
+// AdaptiveRate configures additive-increase/multiplicative-decrease (AIMD) control of the rate
+// at which a Producer sends records to each shard. After each PutRecords response, the rate of
+// every shard written to is cut by Decrease if any of its records were rejected with
+// ProvisionedThroughputExceededException, and otherwise raised by Increase, so the rate settles
+// just below what the shard accepts even when other producers write to it too. Records are
+// assigned to shards with Config.ShardMap; without it, the whole stream shares one rate. With
+// Config.Aggregate, rates count Kinesis records rather than the records added. Zero fields take
+// their values from DefaultAdaptiveRate.
+type AdaptiveRate struct {
+	// InitialRate is the rate of a shard, in records per second, until it is adjusted.
+	InitialRate float64
+	// MinRate and MaxRate bound the rate of each shard.
+	MinRate float64
+	MaxRate float64
+	// Increase is added to a shard's rate after each response without throttling.
+	Increase float64
+	// Decrease, between 0 and 1, multiplies a shard's rate after a response with throttling.
+	Decrease float64
+}
+
+// DefaultAdaptiveRate starts each shard at the 1000 records per second Kinesis allows, halves
+// it on throttling and raises it by 50 records per second otherwise.
+var DefaultAdaptiveRate = AdaptiveRate{
+	InitialRate: 1000,
+	MinRate:     10,
+	MaxRate:     1000,
+	Increase:    50,
+	Decrease:    0.5,
+}
+
+// withDefaults returns the config with its zero fields set from DefaultAdaptiveRate.
+func (ar AdaptiveRate) withDefaults() AdaptiveRate {
+	if ar.InitialRate == 0 {
+		ar.InitialRate = DefaultAdaptiveRate.InitialRate
+	}
+	if ar.MinRate == 0 {
+		ar.MinRate = DefaultAdaptiveRate.MinRate
+	}
+	if ar.MaxRate == 0 {
+		ar.MaxRate = DefaultAdaptiveRate.MaxRate
+	}
+	if ar.Increase == 0 {
+		ar.Increase = DefaultAdaptiveRate.Increase
+	}
+	if ar.Decrease == 0 {
+		ar.Decrease = DefaultAdaptiveRate.Decrease
+	}
+	return ar
+}
+
+func (ar AdaptiveRate) validate() error {
+	if ar.MinRate < 0 || ar.MinRate > ar.MaxRate {
+		return errors.New("AdaptiveRate.MinRate must be between 0 and MaxRate")
+	}
+	if ar.InitialRate < ar.MinRate || ar.InitialRate > ar.MaxRate {
+		return errors.New("AdaptiveRate.InitialRate must be between MinRate and MaxRate")
+	}
+	if ar.Decrease <= 0 || ar.Decrease >= 1 {
+		return errors.New("AdaptiveRate.Decrease must be between 0 and 1 exclusive")
+	}
+	return nil
+}
+
+// rateController paces the records sent to each shard at a rate it adapts to throttling. It
+// is safe for concurrent use.
+type rateController struct {
+	config   AdaptiveRate
+	shardMap *kinesis.ShardMap
+
+	mu     sync.Mutex
+	shards map[string]*shardRate
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// shardRate is the rate of a shard and a token bucket holding up to one second of it.
+type shardRate struct {
+	rate    float64
+	tokens  float64
+	updated time.Time
+}
+
+func newRateController(config AdaptiveRate, shardMap *kinesis.ShardMap) *rateController {
+	return &rateController{
+		config:   config,
+		shardMap: shardMap,
+		shards:   make(map[string]*shardRate),
+		now:      time.Now,
+	}
+}
+
+// shardFor returns the shard a record is predicted to be written to, or "" if there is no
+// shard map.
+func (rc *rateController) shardFor(record kinesis.Record) string {
+	if rc.shardMap == nil {
+		return ""
+	}
+	shard, _ := rc.shardMap.ShardForRecord(record.PartitionKey, record.ExplicitHashKey)
+	return shard
+}
+
+func (rc *rateController) shard(id string) *shardRate {
+	s := rc.shards[id]
+	if s == nil {
+		s = &shardRate{rate: rc.config.InitialRate, tokens: rc.config.InitialRate}
+		rc.shards[id] = s
+	}
+	return s
+}
+
+// reserve takes capacity for sending records, and returns how long to wait before sending
+// them.
+func (rc *rateController) reserve(records []kinesis.Record) time.Duration {
+	counts := make(map[string]int)
+	for _, record := range records {
+		counts[rc.shardFor(record)]++
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	now := rc.now()
+	var wait time.Duration
+	for id, n := range counts {
+		s := rc.shard(id)
+		if !s.updated.IsZero() {
+			s.tokens = math.Min(s.rate, s.tokens+now.Sub(s.updated).Seconds()*s.rate)
+		}
+		s.updated = now
+		s.tokens -= float64(n)
+		if s.tokens < 0 {
+			wait = maxDuration(wait, time.Duration(-s.tokens/s.rate*float64(time.Second)))
+		}
+	}
+	return wait
+}
+
+// ready reports whether the shard of record has paid off the capacity reserved for earlier
+// records, so that more can be sent to it.
+func (rc *rateController) ready(record kinesis.Record) bool {
+	id := rc.shardFor(record)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	s := rc.shards[id]
+	return s == nil || s.updated.IsZero() || s.tokens+rc.now().Sub(s.updated).Seconds()*s.rate >= 0
+}
+
+// observe adjusts the rate of each shard written to by a PutRecords request. Records without
+// a result in res are ignored.
+func (rc *rateController) observe(records []kinesis.Record, res *kinesis.PutRecordsResp) {
+	throttled := make(map[string]bool)
+	for i, record := range records {
+		if i >= len(res.Records) {
+			break
+		}
+		id := rc.shardFor(record)
+		throttled[id] = throttled[id] || res.Records[i].ErrorCode == throttledErrorCode
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for id, t := range throttled {
+		s := rc.shard(id)
+		if t {
+			s.rate = math.Max(rc.config.MinRate, s.rate*rc.config.Decrease)
+			// the bucket can't hold more than a second at the new rate
+			s.tokens = math.Min(s.tokens, s.rate)
+		} else {
+			s.rate = math.Min(rc.config.MaxRate, s.rate+rc.config.Increase)
+		}
+	}
+}
+
+// rates returns the current rate of each shard that has been written to.
+func (rc *rateController) rates() map[string]float64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rates := make(map[string]float64, len(rc.shards))
+	for id, s := range rc.shards {
+		rates[id] = s.rate
+	}
+	return rates
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
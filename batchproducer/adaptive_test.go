@@ -0,0 +1,222 @@
+package batchproducer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sendgridlabs/go-kinesis"
+)
+
+func TestRateControllerAIMD(t *testing.T) {
+	rc := newRateController(AdaptiveRate{InitialRate: 100, MinRate: 10, MaxRate: 120, Increase: 10, Decrease: 0.5}, nil)
+	records := []kinesis.Record{{PartitionKey: "a"}, {PartitionKey: "b"}}
+	ok := &kinesis.PutRecordsResp{Records: make([]kinesis.PutRecordsRespRecord, 2)}
+	throttled := &kinesis.PutRecordsResp{Records: []kinesis.PutRecordsRespRecord{{}, {ErrorCode: throttledErrorCode}}}
+	failed := &kinesis.PutRecordsResp{Records: []kinesis.PutRecordsRespRecord{{ErrorCode: "InternalFailure"}, {}}}
+
+	for _, tt := range []struct {
+		res  *kinesis.PutRecordsResp
+		rate float64
+	}{
+		{ok, 110},
+		{ok, 120},
+		{ok, 120},
+		{throttled, 60},
+		{failed, 70},
+		{throttled, 35},
+		{throttled, 17.5},
+		{throttled, 10},
+		{ok, 20},
+	} {
+		rc.observe(records, tt.res)
+		if rate := rc.rates()[""]; rate != tt.rate {
+			t.Errorf("%v != %v", rate, tt.rate)
+		}
+	}
+}
+
+func TestRateControllerShards(t *testing.T) {
+	shards := make([]kinesis.DescribeStreamShards, 2)
+	shards[0].ShardId = "shardId-000000000000"
+	shards[0].HashKeyRange.StartingHashKey = "0"
+	shards[0].HashKeyRange.EndingHashKey = "170141183460469231731687303715884105727"
+	shards[1].ShardId = "shardId-000000000001"
+	shards[1].HashKeyRange.StartingHashKey = "170141183460469231731687303715884105728"
+	shards[1].HashKeyRange.EndingHashKey = "340282366920938463463374607431768211455"
+	shardMap, err := kinesis.NewShardMap(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := newRateController(DefaultAdaptiveRate, shardMap)
+
+	// md5("a") is in the first half of the hash key range, md5("b") in the second
+	records := []kinesis.Record{{PartitionKey: "a"}, {PartitionKey: "b"}}
+	rc.observe(records, &kinesis.PutRecordsResp{Records: []kinesis.PutRecordsRespRecord{{}, {ErrorCode: throttledErrorCode}}})
+
+	rates := rc.rates()
+	if rates["shardId-000000000000"] != 1000 || rates["shardId-000000000001"] != 500 {
+		t.Errorf("unexpected rates %v", rates)
+	}
+}
+
+func TestRateControllerReserve(t *testing.T) {
+	rc := newRateController(AdaptiveRate{InitialRate: 100, MinRate: 10, MaxRate: 100, Increase: 10, Decrease: 0.5}, nil)
+	now := time.Unix(0, 0)
+	rc.now = func() time.Time { return now }
+	records := make([]kinesis.Record, 50)
+
+	for _, tt := range []struct {
+		elapsed time.Duration
+		wait    time.Duration
+	}{
+		// the bucket starts with a second of capacity
+		{0, 0},
+		{0, 0},
+		{0, 500 * time.Millisecond},
+		{time.Second, 0},
+	} {
+		now = now.Add(tt.elapsed)
+		if wait := rc.reserve(records); wait != tt.wait {
+			t.Errorf("%v != %v", wait, tt.wait)
+		}
+	}
+
+	// throttling halves the rate, so the same records take twice as long
+	rc.observe(records[:1], &kinesis.PutRecordsResp{Records: []kinesis.PutRecordsRespRecord{{ErrorCode: throttledErrorCode}}})
+	if wait := rc.reserve(records); wait != time.Second {
+		t.Errorf("%v != 1s", wait)
+	}
+}
+
+// throttlingClient throttles the records of every other request.
+type throttlingClient struct {
+	calls int
+}
+
+func (c *throttlingClient) PutRecords(args *kinesis.RequestArgs) (*kinesis.PutRecordsResp, error) {
+	c.calls++
+	res := &kinesis.PutRecordsResp{Records: make([]kinesis.PutRecordsRespRecord, len(args.Records))}
+	if c.calls%2 == 1 {
+		for i := range res.Records {
+			res.Records[i].ErrorCode = throttledErrorCode
+		}
+		res.FailedRecordCount = len(res.Records)
+	}
+	return res, nil
+}
+
+func TestAdaptiveRateStats(t *testing.T) {
+	sr := &statReceiver{}
+	config := DefaultConfig
+	config.Logger = discardLogger
+	config.StatReceiver = sr
+	config.AdaptiveRate = &AdaptiveRate{}
+	p, err := New(&throttlingClient{}, "foo", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := p.(*batchProducer)
+	b.records.add(batchRecord{data: []byte("foo"), partitionKey: "bar"}, false)
+
+	// throttled, then sent
+	b.sendBatch(10)
+	b.sendBatch(10)
+	b.sendStats()
+
+	if rate := sr.stats[len(sr.stats)-1].ShardSendRates[""]; rate != 550 {
+		t.Errorf("%v != 550", rate)
+	}
+}
+
+func TestAdaptiveRateConfig(t *testing.T) {
+	for _, ar := range []AdaptiveRate{
+		{MinRate: 100, MaxRate: 10},
+		{InitialRate: 5000},
+		{Decrease: 1},
+	} {
+		config := DefaultConfig
+		config.AdaptiveRate = &ar
+		if _, err := New(&mockBatchingClient{}, "foo", config); err == nil {
+			t.Errorf("%+v: expected an error", ar)
+		}
+	}
+}
+
+func TestRateControllerShortResponse(t *testing.T) {
+	rc := newRateController(DefaultAdaptiveRate, nil)
+	records := []kinesis.Record{{PartitionKey: "a"}, {PartitionKey: "b"}}
+	res := &kinesis.PutRecordsResp{Records: []kinesis.PutRecordsRespRecord{{ErrorCode: throttledErrorCode}}}
+	rc.observe(records, res)
+	if rate := rc.rates()[""]; rate != 500 {
+		t.Errorf("%v != 500", rate)
+	}
+}
+
+func TestAdaptiveRateDoesNotBlock(t *testing.T) {
+	c := &mockBatchingClient{}
+	b := newProducer(c, 100, 0, 10)
+	b.rates = newRateController(AdaptiveRate{InitialRate: 1, MinRate: 1, MaxRate: 1, Increase: 1, Decrease: 0.5}, nil)
+	b.Start()
+	for i := 0; i < 10; i++ {
+		b.Add([]byte("foo"), "bar")
+	}
+	// at a record per second, the batch of 10 is held back for 9 seconds
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	_, remaining, _ := b.Flush(50*time.Millisecond, false)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Flush took %v", elapsed)
+	}
+	if remaining != 10 {
+		t.Errorf("%v != 10", remaining)
+	}
+	c.callsMu.Lock()
+	defer c.callsMu.Unlock()
+	if c.calls != 0 {
+		t.Errorf("%v != 0", c.calls)
+	}
+}
+
+func TestAdaptiveRateSendsOtherShards(t *testing.T) {
+	shards := make([]kinesis.DescribeStreamShards, 2)
+	shards[0].ShardId = "shardId-000000000000"
+	shards[0].HashKeyRange.StartingHashKey = "0"
+	shards[0].HashKeyRange.EndingHashKey = "170141183460469231731687303715884105727"
+	shards[1].ShardId = "shardId-000000000001"
+	shards[1].HashKeyRange.StartingHashKey = "170141183460469231731687303715884105728"
+	shards[1].HashKeyRange.EndingHashKey = "340282366920938463463374607431768211455"
+	shardMap, err := kinesis.NewShardMap(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &capturingClient{}
+	config := DefaultConfig
+	config.Logger = discardLogger
+	config.BatchSize = 5
+	config.AdaptiveRate = &AdaptiveRate{InitialRate: 2, MinRate: 1, MaxRate: 2}
+	config.ShardMap = shardMap
+	p, err := New(c, "foo", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := p.(*batchProducer)
+	// md5("a") is in the first shard, md5("b") in the second
+	for i := 0; i < 5; i++ {
+		b.records.add(batchRecord{data: []byte{byte(i)}, partitionKey: "a"}, false)
+	}
+	b.records.add(batchRecord{data: []byte("b"), partitionKey: "b"}, false)
+
+	// the first batch is deferred, as it is more than the first shard takes in a second, and
+	// the second shard's record is sent meanwhile
+	if sent := b.sendBatch(5); sent != 0 {
+		t.Errorf("%v != 0", sent)
+	}
+	if sent := b.sendBatch(5); sent != 1 || c.records[0].PartitionKey != "b" {
+		t.Errorf("%v sent: %v", sent, c.records)
+	}
+	if len(b.deferred) != 1 || b.records.Len() != 0 {
+		t.Errorf("%v deferred batches, %v records left", len(b.deferred), b.records.Len())
+	}
+}
@@ -0,0 +1,79 @@
+package batchproducer
+
+import (
+	"fmt"
+
+	"github.com/sendgridlabs/go-kinesis"
+)
+
+// takeAggregated takes records from the buffer and packs them into Kinesis records in the
+// KPL aggregated format, as they are taken, until the request would exceed batchSize Kinesis
+// records or MaxBatchBytes. Records are grouped by the shard they would be written to, if
+// Config.ShardMap is set, and otherwise by partition key, so that each user record is still
+// read from the shard its own partition key maps to. A record whose group can't have another
+// Kinesis record is left in the buffer, along with the later records for its group. It
+// returns the records included in args, in the order they were taken, with the index in
+// args.Records of the Kinesis record holding each one.
+func (b *batchProducer) takeAggregated(batchSize int) ([]batchRecord, []int, *kinesis.RequestArgs) {
+	var aggregators []*kinesis.RecordAggregator
+	open := make(map[string]int)
+	closed := make(map[string]bool)
+	var entries []int
+	bytes := 0
+	sendable := b.sendable()
+
+	records := b.records.takeFunc(func(record batchRecord) takeDecision {
+		if !sendable(record) {
+			return skipRecord
+		}
+		group := record.partitionKey
+		if b.config.ShardMap != nil {
+			if shard, ok := b.config.ShardMap.ShardForRecord(record.partitionKey, ""); ok {
+				group = shard
+			}
+		}
+		if closed[group] {
+			return skipRecord
+		}
+		// ok is false if the group needs another Kinesis record, as its last one is full
+		index, ok := open[group]
+		if ok && aggregators[index].SizeWith(record.partitionKey, "", record.data) > b.maxRecordBytes() {
+			ok = false
+		}
+		var agg *kinesis.RecordAggregator
+		var grown int
+		if ok {
+			agg = aggregators[index]
+			grown = agg.SizeWith(record.partitionKey, "", record.data) - agg.Size()
+		} else {
+			if len(aggregators) == batchSize {
+				closed[group] = true
+				return skipRecord
+			}
+			agg = new(kinesis.RecordAggregator)
+			grown = agg.SizeWith(record.partitionKey, "", record.data)
+		}
+		if bytes+grown > b.config.MaxBatchBytes {
+			return stopTaking
+		}
+		if !ok {
+			index = len(aggregators)
+			open[group] = index
+			aggregators = append(aggregators, agg)
+		}
+		agg.Add(record.partitionKey, "", record.data)
+		bytes += grown
+		entries = append(entries, index)
+		return takeRecord
+	})
+
+	args := kinesis.NewArgs()
+	args.Add("StreamName", b.streamName)
+	for _, agg := range aggregators {
+		args.Records = append(args.Records, agg.Record())
+	}
+	if len(records) > 0 {
+		b.log(kinesis.LogDebug, fmt.Sprintf("Aggregated %v records into %v Kinesis records", len(records), len(args.Records)))
+	}
+	return records, entries, args
+}
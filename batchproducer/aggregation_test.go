@@ -0,0 +1,196 @@
+package batchproducer
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/sendgridlabs/go-kinesis"
+)
+
+// capturingClient records the Kinesis records it is sent, and fails those with the
+// partition key "fail".
+type capturingClient struct {
+	mu      sync.Mutex
+	records []kinesis.Record
+}
+
+func (c *capturingClient) PutRecords(args *kinesis.RequestArgs) (*kinesis.PutRecordsResp, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := &kinesis.PutRecordsResp{Records: make([]kinesis.PutRecordsRespRecord, len(args.Records))}
+	for i, r := range args.Records {
+		if r.PartitionKey == "fail" {
+			res.FailedRecordCount++
+			res.Records[i].ErrorCode = "InternalFailure"
+			continue
+		}
+		c.records = append(c.records, r)
+	}
+	return res, nil
+}
+
+func newAggregatingProducer(c BatchingKinesisClient, batchSize int) *batchProducer {
+	config := DefaultConfig
+	config.Logger = discardLogger
+	config.BatchSize = batchSize
+	config.BufferSize = 1000
+	config.MaxAttemptsPerRecord = 2
+	config.Aggregate = true
+	p, err := New(c, "foo", config)
+	if err != nil {
+		panic(err)
+	}
+	return p.(*batchProducer)
+}
+
+func TestAggregate(t *testing.T) {
+	c := &capturingClient{}
+	b := newAggregatingProducer(c, 10)
+	for i := 0; i < 30; i++ {
+		b.records.add(batchRecord{data: []byte("data"), partitionKey: fmt.Sprintf("k%d", i%3)}, false)
+	}
+
+	if sent := b.sendBatch(10); sent != 30 {
+		t.Errorf("%v != 30", sent)
+	}
+	if len(c.records) != 3 {
+		t.Fatalf("%v != 3", len(c.records))
+	}
+	for i, r := range c.records {
+		if !bytes.HasPrefix(r.Data, kinesis.AggregatedRecordMagic) {
+			t.Errorf("%v: record is not aggregated", i)
+		}
+		if key := fmt.Sprintf("k%d", i); r.PartitionKey != key {
+			t.Errorf("%v != %v", r.PartitionKey, key)
+		}
+	}
+	if b.records.Len() != 0 {
+		t.Errorf("%v != 0", b.records.Len())
+	}
+}
+
+func TestAggregateByShard(t *testing.T) {
+	shards := make([]kinesis.DescribeStreamShards, 1)
+	shards[0].ShardId = "shardId-000000000000"
+	shards[0].HashKeyRange.StartingHashKey = "0"
+	shards[0].HashKeyRange.EndingHashKey = "340282366920938463463374607431768211455"
+	shardMap, err := kinesis.NewShardMap(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &capturingClient{}
+	b := newAggregatingProducer(c, 10)
+	b.config.ShardMap = shardMap
+	for i := 0; i < 30; i++ {
+		b.records.add(batchRecord{data: []byte("data"), partitionKey: fmt.Sprintf("k%d", i%3)}, false)
+	}
+
+	b.sendBatch(10)
+	if len(c.records) != 1 {
+		t.Errorf("%v != 1", len(c.records))
+	}
+}
+
+func TestAggregateRecordSize(t *testing.T) {
+	c := &capturingClient{}
+	b := newAggregatingProducer(c, 10)
+	b.config.MaxBatchBytes = 1000
+	for i := 0; i < 2; i++ {
+		b.records.add(batchRecord{data: make([]byte, 490), partitionKey: "key"}, false)
+	}
+
+	// the two records fit in a batch, but not in a Kinesis record of 1000 bytes once aggregated
+	if sent := b.sendBatch(10); sent != 2 {
+		t.Errorf("%v != 2", sent)
+	}
+	if len(c.records) != 2 {
+		t.Fatalf("%v != 2", len(c.records))
+	}
+	for i, r := range c.records {
+		if size := len(r.Data) + len(r.PartitionKey); size > 1000 {
+			t.Errorf("%v: %v > 1000", i, size)
+		}
+	}
+}
+
+func TestAggregateLeftover(t *testing.T) {
+	c := &capturingClient{}
+	b := newAggregatingProducer(c, 2)
+	for i := 0; i < 30; i++ {
+		b.records.add(batchRecord{data: []byte{byte(i)}, partitionKey: fmt.Sprintf("k%d", i%3)}, false)
+	}
+
+	if sent := b.sendBatch(2); sent != 20 {
+		t.Errorf("%v != 20", sent)
+	}
+	if b.records.Len() != 10 {
+		t.Fatalf("%v != 10", b.records.Len())
+	}
+	// the records left over stay at the front in their original order
+	next := b.records.take(10, MaxKinesisBatchBytes)
+	for i, r := range next {
+		if r.data[0] != byte(3*i+2) {
+			t.Errorf("%v: %v != %v", i, r.data[0], 3*i+2)
+		}
+		if r.sendAttempts != 0 {
+			t.Errorf("%v: %v != 0", i, r.sendAttempts)
+		}
+	}
+}
+
+func TestAggregateTakesOnlyWhatFits(t *testing.T) {
+	c := &capturingClient{}
+	b := newAggregatingProducer(c, 10)
+	b.config.MaxBatchBytes = 1000
+	for i := 0; i < 30; i++ {
+		b.records.add(batchRecord{data: make([]byte, 100), partitionKey: "key"}, false)
+	}
+
+	records, entries, args := b.takeAggregated(10)
+	if len(records) == 0 || len(records) >= 10 || len(entries) != len(records) {
+		t.Fatalf("took %v records with %v entries", len(records), len(entries))
+	}
+	if b.records.Len() != 30-len(records) {
+		t.Errorf("%v != %v", b.records.Len(), 30-len(records))
+	}
+	size := 0
+	for _, r := range args.Records {
+		size += len(r.Data) + len(r.PartitionKey)
+	}
+	if size > 1000 {
+		t.Errorf("%v > 1000", size)
+	}
+}
+
+func TestAggregateFailure(t *testing.T) {
+	c := &capturingClient{}
+	b := newAggregatingProducer(c, 10)
+	for i := 0; i < 10; i++ {
+		key := "ok"
+		if i%2 == 0 {
+			key = "fail"
+		}
+		b.records.add(batchRecord{data: []byte{byte(i)}, partitionKey: key}, false)
+	}
+
+	if sent := b.sendBatch(10); sent != 5 {
+		t.Errorf("%v != 5", sent)
+	}
+	if b.currentStat.RecordsSentSuccessfullySinceLastStat != 5 {
+		t.Errorf("%v != 5", b.currentStat.RecordsSentSuccessfullySinceLastStat)
+	}
+
+	// every record in the failed Kinesis record is retried
+	retried := b.records.take(10, MaxKinesisBatchBytes)
+	if len(retried) != 5 {
+		t.Fatalf("%v != 5", len(retried))
+	}
+	for _, r := range retried {
+		if r.partitionKey != "fail" || r.sendAttempts != 1 {
+			t.Errorf("unexpected record %+v", r)
+		}
+	}
+}
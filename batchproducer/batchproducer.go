@@ -2,16 +2,27 @@ package batchproducer
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sendgridlabs/go-kinesis"
 )
 
-// MaxKinesisBatchSize is the maximum number of records that Kinesis accepts in a request
-const MaxKinesisBatchSize = 500
+const (
+	// MaxKinesisBatchSize is the maximum number of records that Kinesis accepts in a request
+	MaxKinesisBatchSize = 500
+
+	// MaxKinesisBatchBytes is the maximum total size of the records that Kinesis accepts in a
+	// request, counting the data and partition key of each record
+	MaxKinesisBatchBytes = 5 * 1024 * 1024
+
+	// MaxKinesisRecordBytes is the maximum size of a single record's data and partition key
+	MaxKinesisRecordBytes = 1024 * 1024
+)
 
 // Producer collects records individually and then sends them to Kinesis in
 // batches in the background using PutRecords, with retries.
@@ -31,9 +42,14 @@ type Producer interface {
 	// died in the background due to a panic (or something).
 	Add(data []byte, partitionKey string) error
 
+	// AddWithResult is like Add, but also returns a Result that is resolved once the record has
+	// been written to Kinesis, with its shard ID and sequence number, or has been dropped.
+	AddWithResult(data []byte, partitionKey string) (*Result, error)
+
 	// Flush stops the Producer using Stop and attempts to send all buffered records to Kinesis as
-	// fast as possible with batches of size 500 (the maximum). It blocks until either all records
-	// are sent or the timeout expires. It returns the number of records still remaining in the
+	// fast as possible with batches of size 500 (the maximum), up to MaxConcurrentRequests at a
+	// time. It blocks until either all records are sent or the timeout expires, and then until
+	// any batches in flight have finished. It returns the number of records still remaining in the
 	// buffer or (possibly) an error. (It doesn’t currently return errors but that is in the
 	// signature for future-proofing.) A timeout value of 0 means no timeout.
 	// If Flush finishes sending all records without timing out, and sendStats is true, it will
@@ -54,6 +70,13 @@ type StatReceiver interface {
 type StatsBatch struct {
 	// Moment-in-time stats
 	BufferSize int
+	// SpoolSize is the number of records in the spool waiting to be moved to the buffer, if
+	// Config.SpoolDir is set.
+	SpoolSize int
+	// ShardSendRates is the rate, in records per second, at which records are currently sent to
+	// each shard, if Config.AdaptiveRate is set. Without Config.ShardMap, the rate of the whole
+	// stream is under the key "".
+	ShardSendRates map[string]float64
 
 	// Cumulative stats
 	KinesisErrorsSinceLastStat           int
@@ -66,6 +89,8 @@ type BatchingKinesisClient interface {
 	PutRecords(args *kinesis.RequestArgs) (resp *kinesis.PutRecordsResp, err error)
 }
 
+// BatchProducerLogger is a Printf-style logger such as *log.Logger. Messages written to it
+// are prefixed with their level and followed by their fields; see kinesis.NewPrintfLogger.
 type BatchProducerLogger interface {
 	Printf(format string, args ...interface{})
 }
@@ -83,6 +108,12 @@ type Config struct {
 	// whether FlushInterval has a value or not.
 	BatchSize int
 
+	// MaxBatchBytes controls the maximum total size of the records in a batch, counting the data
+	// and partition key of each record. A batch is sent when the buffer holds this many bytes,
+	// even if it holds fewer than BatchSize records. It must be no more than
+	// MaxKinesisBatchBytes; zero means MaxKinesisBatchBytes.
+	MaxBatchBytes int
+
 	// BufferSize is the size of the buffer that stores records before they are sent to the Kinesis
 	// stream. If when Add is called the number of records in the buffer is >= bufferSize then
 	// Add will either block or return an error, depending on the value of AddBlocksWhenBufferFull.
@@ -94,9 +125,13 @@ type Config struct {
 	// will be no larger than BatchSize.
 	FlushInterval time.Duration
 
-	// The logger used by the Producer.
+	// The logger used by the Producer. Ignored if StructuredLogger is set.
 	Logger BatchProducerLogger
 
+	// StructuredLogger, if set, receives leveled log messages with the stream name, and where
+	// relevant the shard and error code, as fields.
+	StructuredLogger kinesis.Logger
+
 	// MaxAttemptsPerRecord defines how many attempts should be made for each record before it is
 	// dropped. You probably want this higher than the init default of 0.
 	MaxAttemptsPerRecord int
@@ -108,6 +143,74 @@ type Config struct {
 
 	// StatReceiver will have its Receive method called approximately every StatInterval.
 	StatReceiver StatReceiver
+
+	// PreservePartitionKeyOrder ensures that the records for each partition key are written in
+	// the order they were added, even when some have to be retried, by sending at most one
+	// record per partition key at a time: later records for a key are held back until the
+	// earlier one has been sent successfully or dropped. This lowers throughput for keys with
+	// many records. Without it, records that are retried are still sent before any records
+	// added after them, but may end up after later records for their key that were sent
+	// successfully in the same batch.
+	PreservePartitionKeyOrder bool
+
+	// RateLimiter, if set, delays each batch until the shards it writes to have capacity for
+	// it, meanwhile sending the records for other shards. It may be shared with other producers and clients writing to the same stream, but
+	// should not also be set on the client passed to New, or batches would be counted twice.
+	RateLimiter *kinesis.RateLimiter
+
+	// Aggregate packs many records into each Kinesis record, using the aggregated record format
+	// of the Kinesis Producer Library, so that small records use less of the stream's capacity.
+	// Consumers must deaggregate them, as the Kinesis Client Library does. BatchSize and
+	// MaxBatchBytes then limit the Kinesis records in a batch rather than the records added, and
+	// no Kinesis record is larger than MaxKinesisRecordBytes.
+	Aggregate bool
+
+	// ShardMap, if set, predicts the shard each record is written to, so that Aggregate can pack
+	// together all the records for a shard. Without it, only records with the same partition key
+	// are packed together. After the stream is resharded, the map must be replaced by creating a
+	// new Producer, or consumers may discard records that no longer belong to the shard they
+	// were written to.
+	ShardMap *kinesis.ShardMap
+
+	// MaxConcurrentRequests is the maximum number of PutRecords requests in flight at a time,
+	// both while running and during Flush. Zero means one. With more than one, records added
+	// later may be written before records added earlier, unless PreservePartitionKeyOrder is
+	// set, which still sends at most one record per partition key at a time across all
+	// requests.
+	MaxConcurrentRequests int
+
+	// RetryPolicy decides how long to wait after a failed request, which records rejected by
+	// Kinesis to retry, and when to drop the records of failed requests. Nil means a copy of
+	// DefaultRetryPolicy.
+	RetryPolicy RetryPolicy
+
+	// SpoolDir, if set, is a directory where records are written when they are added, so that
+	// they are not lost if the process exits before they are sent, or dropped because the buffer
+	// is full. Records are moved from the spool to the buffer when it has room, and are deleted
+	// from the spool, a segment file at a time, once they have been sent or dropped after
+	// MaxAttemptsPerRecord attempts. When a Producer is created, the records left in the spool
+	// by a previous process are sent before any others, and records that were sent but whose
+	// segment had not yet been deleted are sent again. Records are written to the operating
+	// system as they are added, and synced to disk when a segment is full and on Stop, which
+	// also closes the spool's files until the Producer is started again.
+	SpoolDir string
+
+	// SpoolSegmentBytes is the size of the spool's segment files. Zero means
+	// DefaultSpoolSegmentBytes.
+	SpoolSegmentBytes int64
+
+	// SpoolMaxBytes limits the size of the spool. When it is reached, Add blocks or returns an
+	// error depending on AddBlocksWhenBufferFull. Zero means no limit.
+	SpoolMaxBytes int64
+
+	// AdaptiveRate, if set, paces the records sent to each shard at a rate that is lowered when
+	// Kinesis throttles the shard and raised again while it doesn't.
+	AdaptiveRate *AdaptiveRate
+
+	// DeadLetterSink, if set, receives the records that are dropped, with the number of
+	// attempts made and the last error, so that they can be inspected or replayed. See
+	// FileDeadLetterSink, StreamDeadLetterSink and FirehoseDeadLetterSink.
+	DeadLetterSink DeadLetterSink
 }
 
 // DefaultConfig is provided for convenience; if you have no specific preferences on how you’d
@@ -118,6 +221,7 @@ var DefaultConfig = Config{
 	BufferSize:              10000,
 	FlushInterval:           1 * time.Second,
 	BatchSize:               10,
+	MaxBatchBytes:           MaxKinesisBatchBytes,
 	MaxAttemptsPerRecord:    10,
 	StatInterval:            1 * time.Second,
 	Logger:                  log.New(os.Stderr, "", log.LstdFlags),
@@ -131,6 +235,17 @@ var (
 	ErrAlreadyStopped = errors.New("already stopped")
 )
 
+// RecordTooLargeError is returned by Add for a record that can never be sent because its
+// data and partition key are larger than MaxKinesisRecordBytes or Config.MaxBatchBytes.
+type RecordTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *RecordTooLargeError) Error() string {
+	return fmt.Sprintf("record of %d bytes is larger than the limit of %d bytes", e.Size, e.Limit)
+}
+
 // New creates and returns a BatchProducer that will do nothing until its Start method is called.
 // Once it is started, it will flush a batch to Kinesis whenever either
 // the flushInterval occurs (if flushInterval > 0) or the batchSize is reached,
@@ -152,31 +267,101 @@ func New(
 		return nil, errors.New("are you crazy")
 	}
 
+	if config.MaxBatchBytes < 0 || config.MaxBatchBytes > MaxKinesisBatchBytes {
+		return nil, errors.New("MaxBatchBytes must be between 0 and 5 MB inclusive")
+	}
+	if config.MaxBatchBytes == 0 {
+		config.MaxBatchBytes = MaxKinesisBatchBytes
+	}
+
+	if config.MaxConcurrentRequests < 0 {
+		return nil, errors.New("MaxConcurrentRequests must not be negative")
+	}
+
+	var rates *rateController
+	if config.AdaptiveRate != nil {
+		adaptiveRate := config.AdaptiveRate.withDefaults()
+		if err := adaptiveRate.validate(); err != nil {
+			return nil, err
+		}
+		rates = newRateController(adaptiveRate, config.ShardMap)
+	}
+
+	logger := config.StructuredLogger
+	if logger == nil {
+		if config.Logger != nil {
+			logger = kinesis.NewPrintfLogger(config.Logger, kinesis.LogDebug)
+		} else {
+			logger = kinesis.NoopLogger{}
+		}
+	}
+
 	batchProducer := batchProducer{
 		client:      client,
 		streamName:  streamName,
 		config:      config,
-		logger:      config.Logger,
+		logger:      logger,
+		retryPolicy: config.RetryPolicy,
+		rates:       rates,
 		currentStat: new(StatsBatch),
-		records:     make(chan batchRecord, config.BufferSize),
+		records:     newRecordBuffer(config.BufferSize, config.PreservePartitionKeyOrder),
 		start:       make(chan interface{}),
 		stop:        make(chan interface{}),
 	}
+	if batchProducer.retryPolicy == nil {
+		batchProducer.retryPolicy = DefaultRetryPolicy.clone()
+	}
+	if config.MaxConcurrentRequests > 1 {
+		batchProducer.slots = make(chan struct{}, config.MaxConcurrentRequests)
+	}
+
+	if config.SpoolDir != "" {
+		spool, problems, err := openSpool(config.SpoolDir, config.SpoolSegmentBytes, config.SpoolMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		for _, problem := range problems {
+			batchProducer.log(kinesis.LogWarn, problem)
+		}
+		batchProducer.spool = spool
+	}
 
 	return &batchProducer, nil
 }
 
 type batchProducer struct {
-	client            BatchingKinesisClient
-	streamName        string
-	config            Config
-	logger            BatchProducerLogger
-	running           bool
-	runningMu         sync.RWMutex
+	client      BatchingKinesisClient
+	streamName  string
+	config      Config
+	logger      kinesis.Logger
+	retryPolicy RetryPolicy
+	running     bool
+	runningMu   sync.RWMutex
+	records     *recordBuffer
+
+	// rates is nil unless Config.AdaptiveRate is set
+	rates *rateController
+
+	// mu guards the fields below, which are updated by batches sent concurrently
+	mu                sync.Mutex
 	consecutiveErrors int
-	currentDelay      time.Duration
-	currentStat       *StatsBatch
-	records           chan batchRecord
+	// retryAt is when the delay the retry policy set after the last error ends
+	retryAt     time.Time
+	currentStat *StatsBatch
+
+	// slots holds a value for each batch in flight if MaxConcurrentRequests is more than one,
+	// and is nil otherwise. inFlight counts the batches sent in the background.
+	slots    chan struct{}
+	inFlight sync.WaitGroup
+
+	// spool is nil unless Config.SpoolDir is set
+	spool *spool
+
+	// deferred holds the batches taken but held back by Config.RateLimiter or the adaptive
+	// rate, oldest first, and deferredKeys counts their records for each partition key. They
+	// are only used by the goroutine starting batches.
+	deferred     []*batch
+	deferredKeys map[string]int
 
 	// start and stop will be unbuffered and will be used to send signals to start/stop and
 	// response signals that indicate that the respective operations have completed.
@@ -188,18 +373,45 @@ type batchRecord struct {
 	data         []byte
 	partitionKey string
 	sendAttempts int
+	// result is nil unless the record was added with AddWithResult
+	result *Result
+	// spoolSegment is the spool segment holding the record, if any
+	spoolSegment *spoolSegment
+}
+
+// size is the size Kinesis counts against its limits for the record.
+func (r batchRecord) size() int {
+	return len(r.data) + len(r.partitionKey)
 }
 
 // from/for interface Producer
 func (b *batchProducer) Add(data []byte, partitionKey string) error {
+	return b.add(batchRecord{data: data, partitionKey: partitionKey})
+}
+
+// from/for interface Producer
+func (b *batchProducer) AddWithResult(data []byte, partitionKey string) (*Result, error) {
+	record := batchRecord{data: data, partitionKey: partitionKey, result: newResult()}
+	if err := b.add(record); err != nil {
+		return nil, err
+	}
+	return record.result, nil
+}
+
+func (b *batchProducer) add(record batchRecord) error {
 	if !b.isRunning() {
 		return errors.New("Cannot call Add when BatchProducer is not running (to prevent the buffer filling up and Add blocking indefinitely).")
 	}
+	if limit := b.maxRecordBytes(); record.size() > limit {
+		return &RecordTooLargeError{Size: record.size(), Limit: limit}
+	}
+	if b.spool != nil {
+		return b.spool.append(record, b.config.AddBlocksWhenBufferFull)
+	}
 	if b.isBufferFull() && !b.config.AddBlocksWhenBufferFull {
-		return errors.New("Buffer is full")
+		return errBufferFull
 	}
-	b.records <- batchRecord{data: data, partitionKey: partitionKey}
-	return nil
+	return b.records.add(record, b.config.AddBlocksWhenBufferFull)
 }
 
 // from/for interface Producer
@@ -239,20 +451,29 @@ func (b *batchProducer) run() {
 	// used to signal Start that we are now running (entering the main loop)
 	b.start <- true
 
+	var sent int64
 	for {
 		select {
 		case <-flushTicker.C:
-			b.sendBatch(b.config.BatchSize)
+			b.fillFromSpool()
+			b.startBatch(b.config.BatchSize, &sent)
 		case <-statTicker.C:
 			b.sendStats()
 		case <-b.stop:
+			b.inFlight.Wait()
+			b.returnDeferred()
+			if b.spool != nil {
+				if err := b.spool.close(); err != nil {
+					b.log(kinesis.LogError, fmt.Sprintf("Error closing the spool: %v", err), kinesis.LogKeyError, err)
+				}
+			}
 			b.sendStats()
 			b.stop <- true
 			return
 		default:
-			if len(b.records) >= b.config.BatchSize {
-				b.sendBatch(b.config.BatchSize)
-			} else {
+			b.fillFromSpool()
+			full := b.records.Len() >= b.config.BatchSize || b.records.Bytes() >= b.config.MaxBatchBytes
+			if !(full || b.deferredDue()) || !b.startBatch(b.config.BatchSize, &sent) {
 				time.Sleep(1 * time.Millisecond)
 			}
 		}
@@ -280,7 +501,6 @@ func (b *batchProducer) Stop() error {
 }
 
 // from/for interface Producer
-// TODO: send all batches in parallel, will require broader refactoring
 func (b *batchProducer) Flush(timeout time.Duration, sendStats bool) (int, int, error) {
 	b.Stop()
 
@@ -290,24 +510,121 @@ func (b *batchProducer) Flush(timeout time.Duration, sendStats bool) (int, int,
 	}
 
 	timedOut := false
-	sent := 0
+	var sent int64
 
 loop:
-	for len(b.records) > 0 {
+	for {
 		select {
 		case <-timer.C:
 			timedOut = true
 			break loop
 		default:
-			sent += b.sendBatch(MaxKinesisBatchSize)
+		}
+		b.fillFromSpool()
+		if b.records.Len() == 0 && len(b.deferred) == 0 {
+			if len(b.slots) == 0 {
+				break loop
+			}
+			// records that fail in a batch in flight are returned to the buffer
+			time.Sleep(1 * time.Millisecond)
+		} else if !b.startBatch(MaxKinesisBatchSize, &sent) {
+			time.Sleep(1 * time.Millisecond)
 		}
 	}
+	// batches in flight when the timeout expires are allowed to finish
+	b.inFlight.Wait()
+	b.returnDeferred()
 
 	if !timedOut && sendStats {
 		b.sendStats()
 	}
 
-	return sent, len(b.records), nil
+	return int(sent), b.records.Len() + b.spoolLen(), nil
+}
+
+// fillFromSpool moves records from the spool to the buffer while it has room for them.
+func (b *batchProducer) fillFromSpool() {
+	if b.spool == nil {
+		return
+	}
+	for b.records.Len() < b.records.Cap() {
+		record, ok, err := b.spool.next()
+		if err != nil {
+			b.log(kinesis.LogError, fmt.Sprintf("Error reading the spool: %v", err), kinesis.LogKeyError, err)
+			if serr, ok := err.(*spoolReadError); ok {
+				b.dropUnreadable(serr)
+			}
+			continue
+		}
+		if !ok {
+			return
+		}
+		if limit := b.maxRecordBytes(); record.size() > limit {
+			// the record was spooled under a larger Config.MaxBatchBytes, and would stop take
+			// from ever returning the records behind it
+			b.dropUnsent(record, RecordTooLargeErrorCode, &RecordTooLargeError{Size: record.size(), Limit: limit})
+			continue
+		}
+		b.records.push(record)
+	}
+}
+
+// dropUnreadable counts the records skipped after an error reading the spool as dropped,
+// and passes a DeadLetter without data or partition key for each to the dead-letter sink.
+func (b *batchProducer) dropUnreadable(serr *spoolReadError) {
+	b.mu.Lock()
+	b.currentStat.RecordsDroppedSinceLastStat += serr.lost
+	b.mu.Unlock()
+	if b.config.DeadLetterSink == nil {
+		return
+	}
+	letters := make([]DeadLetter, serr.lost)
+	for i := range letters {
+		letters[i] = DeadLetter{
+			StreamName:   b.streamName,
+			ErrorCode:    SpoolReadErrorCode,
+			ErrorMessage: serr.Error(),
+			Time:         time.Now(),
+		}
+	}
+	b.writeDeadLetters(letters)
+}
+
+// dropUnsent drops a record that can't be sent before it reaches the buffer, passing it to
+// the dead-letter sink with errorCode.
+func (b *batchProducer) dropUnsent(record batchRecord, errorCode string, err error) {
+	b.log(kinesis.LogError, fmt.Sprintf("Dropping record from the spool: %v", err), kinesis.LogKeyError, err)
+	b.mu.Lock()
+	b.currentStat.RecordsDroppedSinceLastStat++
+	b.mu.Unlock()
+	if record.result != nil {
+		record.result.resolve(kinesis.PutRecordsRespRecord{}, &RecordDroppedError{Attempts: record.sendAttempts, Err: err})
+	}
+	// not finish, as the record was never taken from the buffer
+	if err := b.spool.ack([]batchRecord{record}); err != nil {
+		b.log(kinesis.LogError, fmt.Sprintf("Error deleting a spool file: %v", err), kinesis.LogKeyError, err)
+	}
+	if b.config.DeadLetterSink != nil {
+		b.writeDeadLetters([]DeadLetter{b.deadLetter(record, record.sendAttempts, errorCode, err.Error(), nil)})
+	}
+}
+
+// spoolLen returns the number of records in the spool that have not been moved to the buffer.
+func (b *batchProducer) spoolLen() int {
+	if b.spool == nil {
+		return 0
+	}
+	return b.spool.Len()
+}
+
+// finish releases records that have been sent or dropped.
+func (b *batchProducer) finish(records []batchRecord) {
+	b.records.done(records)
+	if b.spool != nil {
+		if err := b.spool.ack(records); err != nil {
+			b.log(kinesis.LogError, fmt.Sprintf("Error deleting a spool file: %v", err), kinesis.LogKeyError, err)
+		}
+	}
 }
 
 func (b *batchProducer) isRunning() bool {
@@ -319,84 +636,328 @@ func (b *batchProducer) isRunning() bool {
 // Sends batches of records to Kinesis, possibly re-enqueing them if there are any errors or failed
 // records. Returns the number of records successfully sent, if any.
 func (b *batchProducer) sendBatch(batchSize int) int {
-	if len(b.records) == 0 {
+	batch := b.nextBatch(batchSize)
+	if batch == nil {
 		return 0
 	}
+	return b.send(batch)
+}
 
-	// In the future, maybe this could be a RetryPolicy or something
-	if b.consecutiveErrors == 1 {
-		b.currentDelay = 50 * time.Millisecond
-	} else if b.consecutiveErrors > 1 {
-		b.currentDelay *= 2
+// startBatch sends a batch in the background if MaxConcurrentRequests allows more than one
+// request at a time, and otherwise sends it before returning. The number of records sent
+// successfully is added to sent. It returns false if no batch was started, because the retry
+// policy's delay after an error has not passed, as many batches as allowed are in flight, or
+// there is no batch ready to send.
+func (b *batchProducer) startBatch(batchSize int, sent *int64) bool {
+	if !b.readyToSend() {
+		return false
 	}
+	if b.slots == nil {
+		batch := b.nextBatch(batchSize)
+		if batch == nil {
+			return false
+		}
+		atomic.AddInt64(sent, int64(b.send(batch)))
+		return true
+	}
+
+	select {
+	case b.slots <- struct{}{}:
+	default:
+		return false
+	}
+
+	batch := b.nextBatch(batchSize)
+	if batch == nil {
+		<-b.slots
+		return false
+	}
+	b.inFlight.Add(1)
+	go func() {
+		defer b.inFlight.Done()
+		atomic.AddInt64(sent, int64(b.send(batch)))
+		<-b.slots
+	}()
+	return true
+}
+
+// readyToSend reports whether the delay the retry policy set after the last error has passed.
+func (b *batchProducer) readyToSend() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !time.Now().Before(b.retryAt)
+}
+
+// batch is a set of records taken from the buffer to be sent in one PutRecords request.
+type batch struct {
+	// records are in the order they were taken
+	records []batchRecord
+	// entries holds the index in args.Records of the Kinesis record holding each record,
+	// if records were aggregated
+	entries []int
+	args    *kinesis.RequestArgs
+	// sendAt is when a deferred batch may be sent
+	sendAt time.Time
+}
+
+// entry returns the index in the request and response of the Kinesis record holding the
+// i'th record.
+func (b *batch) entry(i int) int {
+	if b.entries != nil {
+		return b.entries[i]
+	}
+	return i
+}
+
+// nextBatch returns the next batch to send: the oldest deferred batch that may now be sent, or
+// else a batch taken from the buffer. A batch that Config.RateLimiter or the adaptive rate
+// doesn't allow to be sent yet is deferred until it is, rather than waited for, so that stats,
+// flushes and Stop are not held up, and the records for other shards can still be sent. It
+// returns nil if there is no batch to send.
+func (b *batchProducer) nextBatch(batchSize int) *batch {
+	now := time.Now()
+	for i, batch := range b.deferred {
+		if !now.Before(batch.sendAt) {
+			b.deferred = append(b.deferred[:i], b.deferred[i+1:]...)
+			b.countDeferred(batch, -1)
+			return batch
+		}
+	}
+
+	if b.records.Len() == 0 {
+		return nil
+	}
+	batch := b.takeBatch(batchSize)
+	if batch == nil {
+		return nil
+	}
+	if wait := b.reserve(batch); wait > 0 {
+		batch.sendAt = now.Add(wait)
+		b.deferred = append(b.deferred, batch)
+		b.countDeferred(batch, 1)
+		return nil
+	}
+	return batch
+}
+
+// reserve takes capacity for a batch from Config.RateLimiter and the adaptive rate, and
+// returns how long to wait before sending it.
+func (b *batchProducer) reserve(batch *batch) time.Duration {
+	var wait time.Duration
+	if b.config.RateLimiter != nil {
+		wait = b.config.RateLimiter.ReserveRecords(b.streamName, batch.args.Records)
+	}
+	if b.rates != nil {
+		wait = maxDuration(wait, b.rates.reserve(batch.args.Records))
+	}
+	return wait
+}
+
+// sendable returns a function that reports whether a record can be taken for a batch now. It
+// can't if its shard has yet to pay off the capacity reserved for earlier batches, so that
+// the shard's records stay in the buffer rather than in deferred batches, or if a deferred
+// batch holds a record for its partition key, which must be sent first. The answers are
+// remembered for each partition key, for use during a single take.
+func (b *batchProducer) sendable() func(record batchRecord) bool {
+	rl := b.config.RateLimiter
+	if rl == nil && b.rates == nil {
+		return func(batchRecord) bool { return true }
+	}
+	answers := make(map[string]bool)
+	return func(record batchRecord) bool {
+		key := record.partitionKey
+		answer, ok := answers[key]
+		if !ok {
+			answer = b.deferredKeys[key] == 0 &&
+				(rl == nil || rl.ReserveWrite(b.streamName, rl.ShardFor(b.streamName, key, ""), 0, 0) == 0) &&
+				(b.rates == nil || b.rates.ready(kinesis.Record{PartitionKey: key}))
+			answers[key] = answer
+		}
+		return answer
+	}
+}
+
+// countDeferred adds delta to the count of deferred records for the partition key of each
+// record in batch.
+func (b *batchProducer) countDeferred(batch *batch, delta int) {
+	if b.deferredKeys == nil {
+		b.deferredKeys = make(map[string]int)
+	}
+	for _, record := range batch.records {
+		if b.deferredKeys[record.partitionKey] += delta; b.deferredKeys[record.partitionKey] == 0 {
+			delete(b.deferredKeys, record.partitionKey)
+		}
+	}
+}
+
+// deferredDue reports whether a deferred batch may now be sent.
+func (b *batchProducer) deferredDue() bool {
+	now := time.Now()
+	for _, batch := range b.deferred {
+		if !now.Before(batch.sendAt) {
+			return true
+		}
+	}
+	return false
+}
 
-	if b.currentDelay > 0 {
-		b.logger.Printf("Delaying the batch by %v because of %v consecutive errors", b.currentDelay, b.consecutiveErrors)
-		time.Sleep(b.currentDelay)
+// returnDeferred puts the records of the deferred batches back at the front of the buffer when
+// the Producer stops, so that they are counted as remaining and sent after it starts again.
+func (b *batchProducer) returnDeferred() {
+	var records []batchRecord
+	for _, batch := range b.deferred {
+		records = append(records, batch.records...)
+	}
+	b.deferred, b.deferredKeys = nil, nil
+	b.returnRecordsToBuffer(records)
+}
+
+// takeBatch takes the records for a batch from the buffer, or returns nil if there are none.
+func (b *batchProducer) takeBatch(batchSize int) *batch {
+	if b.config.Aggregate {
+		records, entries, args := b.takeAggregated(batchSize)
+		if len(records) == 0 {
+			return nil
+		}
+		return &batch{records: records, entries: entries, args: args}
 	}
 
 	records := b.takeRecordsFromBuffer(batchSize)
-	res, err := b.client.PutRecords(b.recordsToArgs(records))
+	if len(records) == 0 {
+		return nil
+	}
+	return &batch{records: records, args: b.recordsToArgs(records)}
+}
+
+// send sends a batch, returning the records that failed to the buffer or dropping them.
+// Returns the number of records successfully sent.
+func (b *batchProducer) send(batch *batch) int {
+	records := batch.records
+	res, err := b.client.PutRecords(batch.args)
+	if err == nil && (res == nil || len(res.Records) != len(batch.args.Records)) {
+		// the results can't be matched to the records, so none of them are known to be written
+		results := 0
+		if res != nil {
+			results = len(res.Records)
+		}
+		err = fmt.Errorf("PutRecords returned %v results for %v records", results, len(batch.args.Records))
+	}
+	if err == nil && b.rates != nil {
+		b.rates.observe(batch.args.Records, res)
+	}
+
+	// dropped records are passed to the dead-letter sink once the lock is released
+	var dropped []DeadLetter
+	defer func() { b.writeDeadLetters(dropped) }()
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
 	if err != nil {
 		b.consecutiveErrors++
 		b.currentStat.KinesisErrorsSinceLastStat++
-		b.logger.Printf("Error occurred when sending PutRecords request to Kinesis stream %v: %v", b.streamName, err)
+		fields := []interface{}{kinesis.LogKeyError, err}
+		if kerr, ok := err.(*kinesis.Error); ok {
+			fields = append(fields, kinesis.LogKeyErrorCode, kerr.Code)
+		}
+		b.log(kinesis.LogWarn, fmt.Sprintf("Error occurred when sending PutRecords request to Kinesis stream %v: %v", b.streamName, err), fields...)
 
-		if b.consecutiveErrors >= 5 && b.isBufferFullOrNearlyFull() {
-			// In order to prevent Add from hanging indefinitely, we start dropping records
-			b.logger.Printf("DROPPING %v records because buffer is full or nearly full and there have been %v consecutive errors from Kinesis", len(records), b.consecutiveErrors)
+		delay := b.retryPolicy.Delay(b.consecutiveErrors, err)
+		b.retryAt = time.Now().Add(delay)
+		if delay > 0 {
+			b.log(kinesis.LogInfo, fmt.Sprintf("Delaying the next batch by %v because of %v consecutive errors", delay, b.consecutiveErrors))
+		}
+
+		// With a spool, Add doesn't depend on the buffer, so records needn't be dropped to make
+		// room for new ones.
+		bufferUsage := 0.0
+		if b.spool == nil {
+			bufferUsage = b.bufferUsage()
+		}
+		if b.retryPolicy.DropBatch(b.consecutiveErrors, err, bufferUsage) {
+			b.log(kinesis.LogError, fmt.Sprintf("DROPPING %v records after %v consecutive errors from Kinesis, with the buffer %.0f%% full", len(records), b.consecutiveErrors, bufferUsage*100))
+			b.currentStat.RecordsDroppedSinceLastStat += len(records)
+			for _, record := range records {
+				if record.result != nil {
+					record.result.resolve(kinesis.PutRecordsRespRecord{}, &RecordDroppedError{Attempts: record.sendAttempts + 1, Err: err})
+				}
+				if b.config.DeadLetterSink != nil {
+					dropped = append(dropped, b.deadLetter(record, record.sendAttempts+1, "", "", err))
+				}
+			}
+			b.finish(records)
 		} else {
-			b.logger.Printf("Returning %v records to buffer (%v consecutive errors)", len(records), b.consecutiveErrors)
-			// returnRecordsToBuffer can block if the buffer (channel) if full so we’ll
-			// call it in a goroutine. This might be problematic WRT ordering. TODO: revisit this.
-			go b.returnRecordsToBuffer(records)
+			b.log(kinesis.LogInfo, fmt.Sprintf("Returning %v records to buffer (%v consecutive errors)", len(records), b.consecutiveErrors))
+			b.returnRecordsToBuffer(records)
 		}
 
 		return 0
 	}
 
 	b.consecutiveErrors = 0
-	b.currentDelay = 0
-	succeeded := len(records) - res.FailedRecordCount
+	b.retryAt = time.Time{}
+	failed := res.FailedRecordCount
+	if batch.entries != nil {
+		failed = 0
+		for _, entry := range batch.entries {
+			if res.Records[entry].ErrorCode != "" {
+				failed++
+			}
+		}
+	}
+	succeeded := len(records) - failed
 
 	b.currentStat.RecordsSentSuccessfullySinceLastStat += succeeded
 
-	if res.FailedRecordCount == 0 {
-		b.logger.Printf("PutRecords request succeeded: sent %v records to Kinesis stream %v", succeeded, b.streamName)
+	if failed == 0 {
+		b.log(kinesis.LogDebug, fmt.Sprintf("PutRecords request succeeded: sent %v records to Kinesis stream %v", succeeded, b.streamName))
+		for i, record := range records {
+			if record.result != nil {
+				record.result.resolve(res.Records[batch.entry(i)], nil)
+			}
+		}
+		b.finish(records)
 	} else {
-		b.logger.Printf("Partial success when sending a PutRecords request to Kinesis stream %v: %v succeeded, %v failed. Re-enqueueing failed records.", b.streamName, succeeded, res.FailedRecordCount)
-		// returnSomeFailedRecordsToBuffer can block if the buffer (channel) if full so we’ll
-		// call it in a goroutine. This might be problematic WRT ordering. TODO: revisit this.
-		go b.returnSomeFailedRecordsToBuffer(res, records)
+		b.log(kinesis.LogWarn, fmt.Sprintf("Partial success when sending a PutRecords request to Kinesis stream %v: %v succeeded, %v failed. Re-enqueueing failed records.", b.streamName, succeeded, failed))
+		dropped = b.returnSomeFailedRecordsToBuffer(res, records, batch.entries)
 	}
 
 	return succeeded
 }
 
-func (b *batchProducer) isBufferFullOrNearlyFull() bool {
-	return float32(len(b.records))/float32(cap(b.records)) >= 0.95
+// bufferUsage returns the fraction of the buffer's capacity in use.
+func (b *batchProducer) bufferUsage() float64 {
+	return float64(b.records.Len()) / float64(b.records.Cap())
 }
 
 func (b *batchProducer) isBufferFull() bool {
-	// Treating 99% as full because IIRC, len(chan) has a margin of error
-	return float32(len(b.records))/float32(cap(b.records)) >= 0.99
+	// Treating 99% as full so that Add leaves a little room for records being retried
+	return float32(b.records.Len())/float32(b.records.Cap()) >= 0.99
 }
 
+// takeRecordsFromBuffer takes up to batchSize records totalling at most MaxBatchBytes, skipping
+// those that aren't sendable.
 func (b *batchProducer) takeRecordsFromBuffer(batchSize int) []batchRecord {
-	var size int
-	bufferLen := len(b.records)
-	if bufferLen >= batchSize {
-		size = batchSize
-	} else {
-		size = bufferLen
-	}
+	sendable := b.sendable()
+	n, bytes := 0, 0
+	return b.records.takeFunc(func(record batchRecord) takeDecision {
+		if !sendable(record) {
+			return skipRecord
+		}
+		if n == batchSize || bytes+record.size() > b.config.MaxBatchBytes {
+			return stopTaking
+		}
+		n++
+		bytes += record.size()
+		return takeRecord
+	})
+}
 
-	result := make([]batchRecord, size)
-	for i := 0; i < size; i++ {
-		result[i] = <-b.records
+// maxRecordBytes is the size of the largest record that can be sent.
+func (b *batchProducer) maxRecordBytes() int {
+	if b.config.MaxBatchBytes < MaxKinesisRecordBytes {
+		return b.config.MaxBatchBytes
 	}
-	return result
+	return MaxKinesisRecordBytes
 }
 
 func (b *batchProducer) recordsToArgs(records []batchRecord) *kinesis.RequestArgs {
@@ -408,39 +969,68 @@ func (b *batchProducer) recordsToArgs(records []batchRecord) *kinesis.RequestArg
 	return args
 }
 
-// returnRecordsToBuffer can block if the buffer (channel) is full, so you might want to
-// call it in a goroutine.
-// TODO: we should probably use a deque internally as the buffer so we can return records to
-// the front of the queue, so as to preserve order, which is important.
+// returnRecordsToBuffer puts records back at the front of the buffer, so that they are sent
+// again before any records added since they were taken. It never blocks.
 func (b *batchProducer) returnRecordsToBuffer(records []batchRecord) {
-	for _, record := range records {
-		// Not using b.Add because we want to preserve the value of record.sendAttempts.
-		b.records <- record
-	}
+	// Not using b.Add because we want to preserve the value of record.sendAttempts.
+	b.records.returnToFront(records)
 }
 
-// returnSomeFailedRecordsToBuffer can block if the buffer (channel) is full, so you might want to
-// call it in a goroutine.
-// TODO: we should probably use a deque internally as the buffer so we can return records to
-// the front of the queue, so as to preserve order, which is important.
-func (b *batchProducer) returnSomeFailedRecordsToBuffer(res *kinesis.PutRecordsResp, records []batchRecord) {
-	for i, result := range res.Records {
-		record := records[i]
-		if result.ErrorCode != "" {
+// returnSomeFailedRecordsToBuffer puts the records that failed and can be retried back at the
+// front of the buffer, in their original order, and releases the rest. If entries is not nil,
+// it holds the index in res.Records of the result for each record. It never blocks. It returns
+// the dead letters of the records dropped, if Config.DeadLetterSink is set.
+func (b *batchProducer) returnSomeFailedRecordsToBuffer(res *kinesis.PutRecordsResp, records []batchRecord, entries []int) []DeadLetter {
+	var retry, finished []batchRecord
+	var dropped []DeadLetter
+	for i, record := range records {
+		entry := i
+		if entries != nil {
+			entry = entries[i]
+		}
+		result := res.Records[entry]
+		if result.ErrorCode == "" {
+			if record.result != nil {
+				record.result.resolve(result, nil)
+			}
+			finished = append(finished, record)
+		} else {
 			record.sendAttempts++
+			fields := []interface{}{kinesis.LogKeyErrorCode, result.ErrorCode}
+			if result.ShardId != "" {
+				fields = append(fields, kinesis.LogKeyShard, result.ShardId)
+			}
 
-			if record.sendAttempts < b.config.MaxAttemptsPerRecord {
-				b.logger.Printf("Re-enqueueing failed record to buffer for retry. Error code was: '%v' and message was '%v'", result.ErrorCode, result.ErrorMessage)
-				// Not using b.Add because we want to preserve the value of record.sendAttempts.
-				b.records <- record
+			if record.sendAttempts < b.config.MaxAttemptsPerRecord && b.retryPolicy.RetryRecord(result.ErrorCode, record.sendAttempts) {
+				b.log(kinesis.LogDebug, fmt.Sprintf("Re-enqueueing failed record to buffer for retry. Error code was: '%v' and message was '%v'", result.ErrorCode, result.ErrorMessage), fields...)
+				retry = append(retry, record)
 			} else {
 				b.currentStat.RecordsDroppedSinceLastStat++
 				msg := "Dropping failed record; it has hit %v attempts " +
 					"which is the maximum. Error code was: '%v' and message was '%v'."
-				b.logger.Printf(msg, record.sendAttempts, result.ErrorCode, result.ErrorMessage)
+				if record.sendAttempts < b.config.MaxAttemptsPerRecord {
+					msg = "Dropping failed record after %v attempts as the retry policy " +
+						"doesn't retry it. Error code was: '%v' and message was '%v'."
+				}
+				b.log(kinesis.LogError, fmt.Sprintf(msg, record.sendAttempts, result.ErrorCode, result.ErrorMessage), fields...)
+				if record.result != nil {
+					record.result.resolve(kinesis.PutRecordsRespRecord{}, &RecordDroppedError{Attempts: record.sendAttempts, ErrorCode: result.ErrorCode, ErrorMessage: result.ErrorMessage})
+				}
+				if b.config.DeadLetterSink != nil {
+					dropped = append(dropped, b.deadLetter(record, record.sendAttempts, result.ErrorCode, result.ErrorMessage, nil))
+				}
+				finished = append(finished, record)
 			}
 		}
 	}
+	b.finish(finished)
+	b.returnRecordsToBuffer(retry)
+	return dropped
+}
+
+// log logs msg with the stream name and any other fields.
+func (b *batchProducer) log(level kinesis.LogLevel, msg string, keyvals ...interface{}) {
+	b.logger.Log(level, msg, append([]interface{}{kinesis.LogKeyStream, b.streamName}, keyvals...)...)
 }
 
 func (b *batchProducer) sendStats() {
@@ -448,11 +1038,18 @@ func (b *batchProducer) sendStats() {
 		return
 	}
 
-	b.currentStat.BufferSize = len(b.records)
+	b.mu.Lock()
+	stat := b.currentStat
+	b.currentStat = new(StatsBatch)
+	b.mu.Unlock()
+
+	stat.BufferSize = b.records.Len()
+	stat.SpoolSize = b.spoolLen()
+	if b.rates != nil {
+		stat.ShardSendRates = b.rates.rates()
+	}
 
 	// I considered running this as a goroutine, but I’m concerned about leaks. So instead, for now,
 	// the provider of the BatchStatReceiver must ensure that it is either very fast or non-blocking.
-	b.config.StatReceiver.Receive(*b.currentStat)
-
-	b.currentStat = new(StatsBatch)
+	b.config.StatReceiver.Receive(*stat)
 }
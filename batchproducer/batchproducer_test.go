@@ -3,9 +3,11 @@ package batchproducer
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -226,16 +228,16 @@ func TestFlushInterval(t *testing.T) {
 	defer b.Stop()
 
 	b.addRecordsAndWait(10, 0)
-	if len(b.records) != 10 {
-		t.Errorf("%v != 10", len(b.records))
+	if b.records.Len() != 10 {
+		t.Errorf("%v != 10", b.records.Len())
 	}
 	if c.calls != 0 {
 		t.Errorf("%v != 0", c.calls)
 	}
 
 	time.Sleep(3 * time.Millisecond)
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	if b.records.Len() != 0 {
+		t.Errorf("%v != 0", b.records.Len())
 	}
 	if c.calls != 1 {
 		t.Errorf("%v != 1", c.calls)
@@ -243,8 +245,8 @@ func TestFlushInterval(t *testing.T) {
 
 	// 20 more records should result in two more batches being sent
 	b.addRecordsAndWait(20, 8)
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	if b.records.Len() != 0 {
+		t.Errorf("%v != 0", b.records.Len())
 	}
 	if c.calls != 3 {
 		t.Errorf("%v != 3", c.calls)
@@ -259,32 +261,32 @@ func TestBatchSize(t *testing.T) {
 	defer b.Stop()
 
 	b.addRecordsAndWait(4, 2)
-	if len(b.records) != 4 {
-		t.Errorf("%v != 4", len(b.records))
+	if b.records.Len() != 4 {
+		t.Errorf("%v != 4", b.records.Len())
 	}
 	if c.calls != 0 {
 		t.Errorf("%v != 0", c.calls)
 	}
 
 	b.addRecordsAndWait(1, 2)
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	if b.records.Len() != 0 {
+		t.Errorf("%v != 0", b.records.Len())
 	}
 	if c.calls != 1 {
 		t.Errorf("%v != 1", c.calls)
 	}
 
 	b.addRecordsAndWait(6, 2)
-	if len(b.records) != 1 {
-		t.Errorf("%v != 1", len(b.records))
+	if b.records.Len() != 1 {
+		t.Errorf("%v != 1", b.records.Len())
 	}
 	if c.calls != 2 {
 		t.Errorf("%v != 2", c.calls)
 	}
 
 	b.addRecordsAndWait(19, 2)
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	if b.records.Len() != 0 {
+		t.Errorf("%v != 0", b.records.Len())
 	}
 	if c.calls != 6 {
 		t.Errorf("%v != 6", c.calls)
@@ -302,8 +304,8 @@ func TestBatchError(t *testing.T) {
 	if b.consecutiveErrors != 1 {
 		t.Errorf("%v != 1", b.consecutiveErrors)
 	}
-	if len(b.records) != 5 {
-		t.Errorf("%v != 5", len(b.records))
+	if b.records.Len() != 5 {
+		t.Errorf("%v != 5", b.records.Len())
 	}
 
 	// Wait another 55 ms and another error should have occurred
@@ -311,8 +313,8 @@ func TestBatchError(t *testing.T) {
 	if b.consecutiveErrors != 2 {
 		t.Errorf("%v != 2", b.consecutiveErrors)
 	}
-	if len(b.records) != 5 {
-		t.Errorf("%v != 5", len(b.records))
+	if b.records.Len() != 5 {
+		t.Errorf("%v != 5", b.records.Len())
 	}
 
 	b.Stop()
@@ -323,8 +325,8 @@ func TestBatchError(t *testing.T) {
 	if b.consecutiveErrors != 0 {
 		t.Errorf("%v != 0", b.consecutiveErrors)
 	}
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	if b.records.Len() != 0 {
+		t.Errorf("%v != 0", b.records.Len())
 	}
 
 	// This next batch should succeed immediately
@@ -332,8 +334,8 @@ func TestBatchError(t *testing.T) {
 	if b.consecutiveErrors != 0 {
 		t.Errorf("%v != 0", b.consecutiveErrors)
 	}
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	if b.records.Len() != 0 {
+		t.Errorf("%v != 0", b.records.Len())
 	}
 }
 
@@ -352,15 +354,15 @@ func TestBatchPartialFailure(t *testing.T) {
 
 	// First attempt
 	time.Sleep(5 * time.Millisecond)
-	if len(b.records) != 1 {
-		t.Errorf("%v != 1", len(b.records))
+	if b.records.Len() != 1 {
+		t.Errorf("%v != 1", b.records.Len())
 	}
 
 	// Second attempt
 	b.addRecordsAndWait(19, 1)
 	// The failing record should be thrown away at this point
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	if b.records.Len() != 0 {
+		t.Errorf("%v != 0", b.records.Len())
 	}
 }
 
@@ -546,10 +548,11 @@ func TestKinesisErrorsStatWhenKinesisReturnsError(t *testing.T) {
 	defer b.Stop()
 
 	b.addRecordsAndWait(20, 5)
+	// the retry policy delays the next attempt by 50ms, which doesn't hold up Stop
 	b.Stop()
 
-	if sr.totalKinesisErrorsSinceLastStat != 2 {
-		t.Errorf("%v != 2", sr.totalKinesisErrorsSinceLastStat)
+	if sr.totalKinesisErrorsSinceLastStat != 1 {
+		t.Errorf("%v != 1", sr.totalKinesisErrorsSinceLastStat)
 	}
 }
 
@@ -558,7 +561,7 @@ func TestLogMessageWhenKinesisSucceeds(t *testing.T) {
 
 	b := newProducer(&mockBatchingClient{shouldErr: false}, 100, 0, 20)
 	loggerBuffer, logger := newBufferedLogger()
-	b.logger = logger
+	b.logger = kinesis.NewPrintfLogger(logger, kinesis.LogDebug)
 	b.Start()
 	defer b.Stop()
 
@@ -577,7 +580,7 @@ func TestLogMessageWhenKinesisReturnsError(t *testing.T) {
 
 	b := newProducer(&mockBatchingClient{shouldErr: true}, 100, 0, 20)
 	loggerBuffer, logger := newBufferedLogger()
-	b.logger = logger
+	b.logger = kinesis.NewPrintfLogger(logger, kinesis.LogDebug)
 	b.Start()
 	defer b.Stop()
 
@@ -600,7 +603,7 @@ func TestLogMessageWhenSomeRecordsFail(t *testing.T) {
 	b.config.StatInterval = 1 * time.Millisecond
 	b.config.MaxAttemptsPerRecord = 2
 	loggerBuffer, logger := newBufferedLogger()
-	b.logger = logger
+	b.logger = kinesis.NewPrintfLogger(logger, kinesis.LogDebug)
 	b.Start()
 	defer b.Stop()
 
@@ -633,6 +636,224 @@ func TestLogMessageWhenSomeRecordsFail(t *testing.T) {
 	}
 }
 
+type logRecorder struct {
+	mu      sync.Mutex
+	entries []map[interface{}]interface{}
+}
+
+func (lr *logRecorder) Enabled(kinesis.LogLevel) bool { return true }
+
+func (lr *logRecorder) Log(level kinesis.LogLevel, msg string, keyvals ...interface{}) {
+	e := map[interface{}]interface{}{"level": level, "msg": msg}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		e[keyvals[i]] = keyvals[i+1]
+	}
+	lr.mu.Lock()
+	lr.entries = append(lr.entries, e)
+	lr.mu.Unlock()
+}
+
+func TestStructuredLogger(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
+	recorder := &logRecorder{}
+	b.logger = recorder
+
+	res := &kinesis.PutRecordsResp{
+		FailedRecordCount: 2,
+		Records: []kinesis.PutRecordsRespRecord{
+			{ErrorCode: "ProvisionedThroughputExceededException", ShardId: "shardId-000000000001"},
+			{ErrorCode: "InternalFailure"},
+		},
+	}
+	records := []batchRecord{{sendAttempts: 0}, {sendAttempts: 1}}
+	b.returnSomeFailedRecordsToBuffer(res, records, nil)
+
+	if len(recorder.entries) != 2 {
+		t.Fatalf("%v != 2", len(recorder.entries))
+	}
+	retried, dropped := recorder.entries[0], recorder.entries[1]
+	if retried["level"] != kinesis.LogDebug || retried[kinesis.LogKeyStream] != "foo" || retried[kinesis.LogKeyShard] != "shardId-000000000001" || retried[kinesis.LogKeyErrorCode] != "ProvisionedThroughputExceededException" {
+		t.Errorf("unexpected entry %v", retried)
+	}
+	if _, ok := dropped[kinesis.LogKeyShard]; dropped["level"] != kinesis.LogError || ok || dropped[kinesis.LogKeyErrorCode] != "InternalFailure" {
+		t.Errorf("unexpected entry %v", dropped)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 200, 0, 20)
+	b.config.RateLimiter = kinesis.NewRateLimiter(kinesis.ShardLimits{WriteRecordsPerSecond: 100})
+
+	for i := 0; i < 110; i++ {
+		b.records.add(batchRecord{data: []byte("foo"), partitionKey: "foo"}, false)
+	}
+
+	// the first batch empties the bucket, so the second is held back for 100ms
+	if sent := b.sendBatch(100); sent != 100 {
+		t.Errorf("%v != 100", sent)
+	}
+	if sent := b.sendBatch(10); sent != 0 {
+		t.Errorf("batch was not delayed: %v sent", sent)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if sent := b.sendBatch(10); sent != 10 {
+		t.Errorf("%v != 10", sent)
+	}
+}
+
+func TestAddRecordTooLarge(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 10, 0, 20)
+	b.Start()
+	defer b.Stop()
+
+	err := b.Add(make([]byte, MaxKinesisRecordBytes), "key")
+	if e, ok := err.(*RecordTooLargeError); !ok || e.Size != MaxKinesisRecordBytes+3 || e.Limit != MaxKinesisRecordBytes {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if err := b.Add(make([]byte, MaxKinesisRecordBytes-3), "key"); err != nil {
+		t.Errorf("%v != nil", err)
+	}
+
+	b = newProducer(&mockBatchingClient{}, 10, 0, 20)
+	b.config.MaxBatchBytes = 100
+	b.Start()
+	defer b.Stop()
+	if _, ok := b.Add(make([]byte, 98), "key").(*RecordTooLargeError); !ok {
+		t.Errorf("expected RecordTooLargeError")
+	}
+}
+
+func TestBatchBytes(t *testing.T) {
+	t.Parallel()
+
+	c := &mockBatchingClient{}
+	b := newProducer(c, 100, 0, 20)
+	b.config.MaxBatchBytes = 1000
+	b.Start()
+	defer b.Stop()
+
+	// 5 records of 300 bytes: more bytes than a batch holds, but fewer records
+	for i := 0; i < 5; i++ {
+		b.Add(make([]byte, 297), "key")
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	c.callsMu.Lock()
+	calls := c.calls
+	c.callsMu.Unlock()
+	if calls != 1 {
+		t.Errorf("%v != 1", calls)
+	}
+	if b.records.Len() != 2 {
+		t.Errorf("%v != 2", b.records.Len())
+	}
+}
+
+func TestMaxBatchBytesConfig(t *testing.T) {
+	config := DefaultConfig
+	config.MaxBatchBytes = MaxKinesisBatchBytes + 1
+	if _, err := New(&mockBatchingClient{}, "foo", config); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+// concurrentClient fails the first attempt at each record whose data is in failOnce, and
+// records the most requests it handled at once and the data it accepted for each key.
+type concurrentClient struct {
+	mu          sync.Mutex
+	failOnce    map[string]bool
+	accepted    map[string][]int
+	current     int
+	maxInFlight int
+}
+
+func (c *concurrentClient) PutRecords(args *kinesis.RequestArgs) (*kinesis.PutRecordsResp, error) {
+	c.mu.Lock()
+	c.current++
+	if c.current > c.maxInFlight {
+		c.maxInFlight = c.current
+	}
+	c.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current--
+	res := &kinesis.PutRecordsResp{Records: make([]kinesis.PutRecordsRespRecord, len(args.Records))}
+	for i, r := range args.Records {
+		if c.failOnce[string(r.Data)] {
+			delete(c.failOnce, string(r.Data))
+			res.FailedRecordCount++
+			res.Records[i].ErrorCode = "ProvisionedThroughputExceededException"
+			continue
+		}
+		n, _ := strconv.Atoi(string(r.Data))
+		c.accepted[r.PartitionKey] = append(c.accepted[r.PartitionKey], n)
+	}
+	return res, nil
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	t.Parallel()
+
+	c := &concurrentClient{failOnce: make(map[string]bool), accepted: make(map[string][]int)}
+	config := DefaultConfig
+	config.Logger = discardLogger
+	config.BatchSize = 10
+	config.MaxConcurrentRequests = 4
+	config.PreservePartitionKeyOrder = true
+	p, err := New(c, "foo", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i += 7 {
+		c.failOnce[strconv.Itoa(i)] = true
+	}
+
+	// enough records with enough keys for Flush to send several batches of 500 at once
+	p.Start()
+	for i := 0; i < 2000; i++ {
+		if err := p.Add([]byte(strconv.Itoa(i)), fmt.Sprintf("k%d", i%1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, remaining, _ := p.Flush(5*time.Second, false); remaining != 0 {
+		t.Errorf("%v != 0", remaining)
+	}
+
+	if c.maxInFlight < 2 || c.maxInFlight > 4 {
+		t.Errorf("%v requests in flight at once", c.maxInFlight)
+	}
+	total := 0
+	for key, accepted := range c.accepted {
+		total += len(accepted)
+		for i := 1; i < len(accepted); i++ {
+			if accepted[i] < accepted[i-1] {
+				t.Errorf("%v: out of order: %v", key, accepted)
+				break
+			}
+		}
+	}
+	if total != 2000 {
+		t.Errorf("%v != 2000", total)
+	}
+}
+
+func TestMaxConcurrentRequestsConfig(t *testing.T) {
+	config := DefaultConfig
+	config.MaxConcurrentRequests = -1
+	if _, err := New(&mockBatchingClient{}, "foo", config); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
 func TestAddBlocksFalse(t *testing.T) {
 	t.Parallel()
 
@@ -673,8 +894,8 @@ func TestAddBlocksTrue(t *testing.T) {
 
 	time.Sleep(1 * time.Millisecond)
 
-	if len(b.records) != 10 {
-		t.Errorf("%v != 10", len(b.records))
+	if b.records.Len() != 10 {
+		t.Errorf("%v != 10", b.records.Len())
 	}
 }
 
@@ -700,8 +921,8 @@ func TestFlush(t *testing.T) {
 	if remaining > 0 {
 		t.Errorf("%v > 0", remaining)
 	}
-	if len(b.records) > 0 {
-		t.Errorf("%v > 0", len(b.records))
+	if b.records.Len() > 0 {
+		t.Errorf("%v > 0", b.records.Len())
 	}
 	if b.isRunning() {
 		t.Errorf("b.running != false")
@@ -741,8 +962,8 @@ func TestFlushWithTimeout(t *testing.T) {
 	if remaining != 100 {
 		t.Errorf("%v != 100", remaining)
 	}
-	if len(b.records) != 100 {
-		t.Errorf("%v != 100", len(b.records))
+	if b.records.Len() != 100 {
+		t.Errorf("%v != 100", b.records.Len())
 	}
 	if duration < 6*time.Millisecond || duration > 8*time.Millisecond {
 		t.Errorf("%v seems off", duration)
@@ -782,8 +1003,8 @@ func TestFlushWithoutTimeout(t *testing.T) {
 	if remaining != 0 {
 		t.Errorf("%v != 0", remaining)
 	}
-	if len(b.records) != 0 {
-		t.Errorf("%v != 0", len(b.records))
+	if b.records.Len() != 0 {
+		t.Errorf("%v != 0", b.records.Len())
 	}
 	if duration < 12*time.Millisecond || duration > 16*time.Millisecond {
 		t.Errorf("%v seems off", duration)
@@ -823,6 +1044,32 @@ func (s *mockBatchingClient) PutRecords(args *kinesis.RequestArgs) (resp *kinesi
 	return &res, nil
 }
 
+// shortResponseClient returns fewer results than the records it is sent.
+type shortResponseClient struct{}
+
+func (shortResponseClient) PutRecords(args *kinesis.RequestArgs) (*kinesis.PutRecordsResp, error) {
+	return &kinesis.PutRecordsResp{Records: make([]kinesis.PutRecordsRespRecord, len(args.Records)-1)}, nil
+}
+
+func TestShortResponseIsAnError(t *testing.T) {
+	b := newProducer(&mockBatchingClient{}, 100, 0, 5)
+	b.client = shortResponseClient{}
+	b.rates = newRateController(DefaultAdaptiveRate, nil)
+	for i := 0; i < 5; i++ {
+		b.records.add(batchRecord{data: []byte("data"), partitionKey: "key"}, false)
+	}
+
+	if sent := b.sendBatch(5); sent != 0 {
+		t.Errorf("%v != 0", sent)
+	}
+	if b.consecutiveErrors != 1 || b.currentStat.KinesisErrorsSinceLastStat != 1 {
+		t.Errorf("%v consecutive errors, %v errors", b.consecutiveErrors, b.currentStat.KinesisErrorsSinceLastStat)
+	}
+	if b.records.Len() != 5 {
+		t.Errorf("%v != 5", b.records.Len())
+	}
+}
+
 func newProducer(client *mockBatchingClient, bufferSize int, flushInterval time.Duration, batchSize int) *batchProducer {
 	config := Config{
 		BufferSize: bufferSize,
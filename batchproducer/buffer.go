@@ -0,0 +1,180 @@
+package batchproducer
+
+import (
+	"errors"
+	"sync"
+)
+
+var errBufferFull = errors.New("Buffer is full")
+
+// recordBuffer is a bounded deque of the records waiting to be sent. Records are added at
+// the back and taken from the front, and records that need to be retried are returned to
+// the front in their original order, so that they are sent before any records added after
+// them. A recordBuffer is safe for concurrent use.
+//
+// If holdBack is set, at most one record per partition key is out of the buffer at a
+// time: later records for a key are held back until the earlier one has been sent
+// successfully or dropped, so records for a key are written in the order they were added
+// even when some of them have to be retried.
+type recordBuffer struct {
+	mu       sync.Mutex
+	notFull  *sync.Cond
+	records  []batchRecord
+	bytes    int
+	capacity int
+
+	holdBack bool
+	// inFlight holds the partition keys of records that have been taken but not yet
+	// marked done or returned, when holdBack is set
+	inFlight map[string]bool
+}
+
+func newRecordBuffer(capacity int, holdBack bool) *recordBuffer {
+	rb := &recordBuffer{
+		capacity: capacity,
+		holdBack: holdBack,
+		inFlight: make(map[string]bool),
+	}
+	rb.notFull = sync.NewCond(&rb.mu)
+	return rb
+}
+
+// Len returns the number of records in the buffer, including any that are held back.
+func (rb *recordBuffer) Len() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return len(rb.records)
+}
+
+// Bytes returns the total size of the records in the buffer.
+func (rb *recordBuffer) Bytes() int {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.bytes
+}
+
+// Cap returns the number of records the buffer holds before add blocks or fails.
+func (rb *recordBuffer) Cap() int {
+	return rb.capacity
+}
+
+// add appends record to the back of the buffer. If the buffer is full it blocks until
+// there is room if block is true, and otherwise returns errBufferFull.
+func (rb *recordBuffer) add(record batchRecord, block bool) error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for len(rb.records) >= rb.capacity {
+		if !block {
+			return errBufferFull
+		}
+		rb.notFull.Wait()
+	}
+	rb.records = append(rb.records, record)
+	rb.bytes += record.size()
+	return nil
+}
+
+// push appends record to the back of the buffer even if it is full. It is used for records
+// that have already been accepted, by the spool, so that they are not lost.
+func (rb *recordBuffer) push(record batchRecord) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.records = append(rb.records, record)
+	rb.bytes += record.size()
+}
+
+// take removes and returns up to max records totalling at most maxBytes from the front of
+// the buffer, skipping any that are held back. It stops at the first record that would
+// take the total over maxBytes, so that records are not sent out of order just because
+// they are smaller.
+func (rb *recordBuffer) take(max, maxBytes int) []batchRecord {
+	n, bytes := 0, 0
+	return rb.takeFunc(func(record batchRecord) takeDecision {
+		if n == max || bytes+record.size() > maxBytes {
+			return stopTaking
+		}
+		n++
+		bytes += record.size()
+		return takeRecord
+	})
+}
+
+// takeDecision is what the function passed to takeFunc decides to do with a record.
+type takeDecision int
+
+const (
+	takeRecord takeDecision = iota
+	skipRecord
+	stopTaking
+)
+
+// takeFunc removes and returns the records from the front of the buffer that decide
+// chooses to take, in order, until it chooses to stop. Records that are held back are
+// skipped without calling decide, and skipped records keep their place in the buffer. The
+// records skipped are moved up against the rest in place, so a call costs only as much as
+// the records it scans.
+func (rb *recordBuffer) takeFunc(decide func(record batchRecord) takeDecision) []batchRecord {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	defer rb.notFull.Broadcast()
+
+	var taken []batchRecord
+	bytes, skipped, i := 0, 0, 0
+	for ; i < len(rb.records); i++ {
+		record := rb.records[i]
+		decision := skipRecord
+		// taking a record marks its key in flight, which holds back the later records for it
+		if !rb.holdBack || !rb.inFlight[record.partitionKey] {
+			decision = decide(record)
+		}
+		if decision == stopTaking {
+			break
+		}
+		if decision == skipRecord {
+			rb.records[skipped] = record
+			skipped++
+			continue
+		}
+		if rb.holdBack {
+			rb.inFlight[record.partitionKey] = true
+		}
+		taken = append(taken, record)
+		bytes += record.size()
+	}
+	copy(rb.records[i-skipped:i], rb.records[:skipped])
+	rb.records = rb.records[i-skipped:]
+	rb.bytes -= bytes
+	return taken
+}
+
+// returnToFront puts records that need to be retried back at the front of the buffer, in
+// the order given. It never blocks, so the buffer may briefly hold more than its capacity.
+func (rb *recordBuffer) returnToFront(records []batchRecord) {
+	if len(records) == 0 {
+		return
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for _, record := range records {
+		delete(rb.inFlight, record.partitionKey)
+	}
+	front := make([]batchRecord, 0, len(records)+len(rb.records))
+	front = append(front, records...)
+	rb.records = append(front, rb.records...)
+	for _, record := range records {
+		rb.bytes += record.size()
+	}
+}
+
+// done releases the partition keys of records that were sent successfully or dropped, so
+// that the records held back behind them can be taken.
+func (rb *recordBuffer) done(records []batchRecord) {
+	if !rb.holdBack || len(records) == 0 {
+		return
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for _, record := range records {
+		delete(rb.inFlight, record.partitionKey)
+	}
+}
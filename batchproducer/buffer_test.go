@@ -0,0 +1,208 @@
+package batchproducer
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sendgridlabs/go-kinesis"
+)
+
+func testRecords(keysAndData ...string) []batchRecord {
+	var records []batchRecord
+	for _, kd := range keysAndData {
+		parts := strings.SplitN(kd, ":", 2)
+		records = append(records, batchRecord{partitionKey: parts[0], data: []byte(parts[1])})
+	}
+	return records
+}
+
+func recordData(records []batchRecord) string {
+	var data []string
+	for _, r := range records {
+		data = append(data, string(r.data))
+	}
+	return strings.Join(data, ",")
+}
+
+func TestRecordBufferReturnToFront(t *testing.T) {
+	rb := newRecordBuffer(10, false)
+	for _, r := range testRecords("a:1", "b:2", "a:3", "c:4") {
+		rb.add(r, false)
+	}
+
+	taken := rb.take(2, MaxKinesisBatchBytes)
+	if recordData(taken) != "1,2" {
+		t.Errorf("%v != 1,2", recordData(taken))
+	}
+	rb.add(testRecords("a:5")[0], false)
+	rb.returnToFront(taken)
+
+	if taken := rb.take(10, MaxKinesisBatchBytes); recordData(taken) != "1,2,3,4,5" {
+		t.Errorf("%v != 1,2,3,4,5", recordData(taken))
+	}
+}
+
+func TestRecordBufferHoldBack(t *testing.T) {
+	rb := newRecordBuffer(10, true)
+	for _, r := range testRecords("a:1", "a:2", "b:3", "a:4", "c:5", "b:6") {
+		rb.add(r, false)
+	}
+
+	// only the first record for each key is taken
+	first := rb.take(10, MaxKinesisBatchBytes)
+	if recordData(first) != "1,3,5" {
+		t.Errorf("%v != 1,3,5", recordData(first))
+	}
+	// nothing can be taken until those are resolved
+	if taken := rb.take(10, MaxKinesisBatchBytes); len(taken) != 0 {
+		t.Errorf("unexpected records %v", recordData(taken))
+	}
+
+	// 1 and 5 succeed and 3 is retried, so 3 still holds back 6
+	rb.done(first[0:1])
+	rb.done(first[2:3])
+	rb.returnToFront(first[1:2])
+	if taken := rb.take(10, MaxKinesisBatchBytes); recordData(taken) != "3,2" {
+		t.Errorf("%v != 3,2", recordData(taken))
+	}
+
+	// max is honoured, and a record is not taken ahead of one held back for its key
+	rb = newRecordBuffer(10, true)
+	for _, r := range testRecords("a:1", "b:2", "a:3", "c:4") {
+		rb.add(r, false)
+	}
+	rb.take(1, MaxKinesisBatchBytes)
+	if taken := rb.take(1, MaxKinesisBatchBytes); recordData(taken) != "2" {
+		t.Errorf("%v != 2", recordData(taken))
+	}
+	if taken := rb.take(10, MaxKinesisBatchBytes); recordData(taken) != "4" {
+		t.Errorf("%v != 4", recordData(taken))
+	}
+
+	// records held back in a scan that stops early keep their place
+	rb = newRecordBuffer(10, true)
+	for _, r := range testRecords("a:1", "a:2", "b:3", "c:4", "d:5") {
+		rb.add(r, false)
+	}
+	first = rb.take(1, MaxKinesisBatchBytes)
+	if taken := rb.take(1, MaxKinesisBatchBytes); recordData(taken) != "3" {
+		t.Errorf("%v != 3", recordData(taken))
+	}
+	if rb.Len() != 3 || rb.Bytes() != 6 {
+		t.Errorf("%v records of %v bytes left", rb.Len(), rb.Bytes())
+	}
+	rb.done(first)
+	if taken := rb.take(10, MaxKinesisBatchBytes); recordData(taken) != "2,4,5" {
+		t.Errorf("%v != 2,4,5", recordData(taken))
+	}
+}
+
+func TestRecordBufferBytes(t *testing.T) {
+	for _, holdBack := range []bool{false, true} {
+		rb := newRecordBuffer(10, holdBack)
+		// sizes count the partition key: 3, 5, 2, 3
+		for _, r := range testRecords("a:12", "b:1234", "c:1", "d:12") {
+			rb.add(r, false)
+		}
+		if rb.Bytes() != 13 {
+			t.Errorf("%v != 13", rb.Bytes())
+		}
+
+		// stops at the first record that doesn't fit rather than skipping it
+		taken := rb.take(10, 7)
+		if recordData(taken) != "12" || rb.Bytes() != 10 {
+			t.Errorf("holdBack %v: %v != 12, %v bytes left", holdBack, recordData(taken), rb.Bytes())
+		}
+		rb.done(taken)
+		rb.returnToFront(taken)
+		if taken := rb.take(10, 8); recordData(taken) != "12,1234" || rb.Bytes() != 5 {
+			t.Errorf("holdBack %v: %v != 12,1234, %v bytes left", holdBack, recordData(taken), rb.Bytes())
+		}
+	}
+}
+
+func TestRecordBufferFull(t *testing.T) {
+	rb := newRecordBuffer(2, false)
+	records := testRecords("a:1", "a:2", "a:3")
+	rb.add(records[0], false)
+	rb.add(records[1], false)
+	if err := rb.add(records[2], false); err != errBufferFull {
+		t.Errorf("%v != %v", err, errBufferFull)
+	}
+
+	added := make(chan bool)
+	go func() {
+		rb.add(records[2], true)
+		added <- true
+	}()
+	select {
+	case <-added:
+		t.Fatalf("add did not block")
+	case <-time.After(10 * time.Millisecond):
+	}
+	rb.take(1, MaxKinesisBatchBytes)
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatalf("add did not unblock")
+	}
+
+	// returning records never blocks
+	rb.returnToFront(testRecords("a:0"))
+	if rb.Len() != 3 {
+		t.Errorf("%v != 3", rb.Len())
+	}
+}
+
+// orderingClient fails the first attempt at each record whose data is in failOnce, and
+// records the data of the records it accepts.
+type orderingClient struct {
+	mu       sync.Mutex
+	failOnce map[string]bool
+	accepted []string
+}
+
+func (c *orderingClient) PutRecords(args *kinesis.RequestArgs) (*kinesis.PutRecordsResp, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := &kinesis.PutRecordsResp{Records: make([]kinesis.PutRecordsRespRecord, len(args.Records))}
+	for i, r := range args.Records {
+		if c.failOnce[string(r.Data)] {
+			delete(c.failOnce, string(r.Data))
+			res.FailedRecordCount++
+			res.Records[i].ErrorCode = "ProvisionedThroughputExceededException"
+			continue
+		}
+		c.accepted = append(c.accepted, r.PartitionKey+":"+string(r.Data))
+	}
+	return res, nil
+}
+
+func TestPreservePartitionKeyOrder(t *testing.T) {
+	for _, preserve := range []bool{false, true} {
+		c := &orderingClient{failOnce: map[string]bool{"1": true}}
+		config := DefaultConfig
+		config.Logger = discardLogger
+		config.BatchSize = 10
+		config.PreservePartitionKeyOrder = preserve
+		p, err := New(c, "foo", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := p.(*batchProducer)
+		for _, r := range testRecords("a:1", "a:2", "b:3") {
+			b.records.add(r, false)
+		}
+		b.Flush(time.Second, false)
+
+		expected := "a:2,b:3,a:1"
+		if preserve {
+			expected = "b:3,a:1,a:2"
+		}
+		if accepted := strings.Join(c.accepted, ","); accepted != expected {
+			t.Errorf("preserve %v: %v != %v", preserve, accepted, expected)
+		}
+	}
+}
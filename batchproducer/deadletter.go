@@ -0,0 +1,237 @@
+package batchproducer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sendgridlabs/go-kinesis"
+)
+
+const (
+	// MaxFirehoseBatchSize is the maximum number of records that Firehose accepts in a
+	// PutRecordBatch request
+	MaxFirehoseBatchSize = 500
+
+	// MaxFirehoseBatchBytes is the maximum total size of the records that Firehose accepts in a
+	// PutRecordBatch request
+	MaxFirehoseBatchBytes = 4 * 1024 * 1024
+)
+
+// The error codes of DeadLetters for records the Producer dropped itself, rather than because
+// of an error from Kinesis.
+const (
+	// RecordTooLargeErrorCode is for a record read back from the spool that is larger than
+	// the Producer can send, because it was added under a larger Config.MaxBatchBytes.
+	RecordTooLargeErrorCode = "RecordTooLarge"
+
+	// SpoolReadErrorCode is for a record that couldn't be read back from the spool. Its
+	// DeadLetter has no data or partition key.
+	SpoolReadErrorCode = "SpoolReadError"
+)
+
+// DeadLetter is a record that a Producer dropped without writing it to Kinesis.
+type DeadLetter struct {
+	StreamName   string
+	PartitionKey string
+	Data         []byte
+	// Attempts is the number of times the record was sent.
+	Attempts int
+	// ErrorCode and ErrorMessage are from the last attempt: the error PutRecords rejected the
+	// record with, or the error of the request if it failed as a whole. ErrorCode is empty if
+	// the request failed without an error code from Kinesis, e.g. because of a network error.
+	ErrorCode    string
+	ErrorMessage string
+	// Time is when the record was dropped.
+	Time time.Time
+}
+
+// DeadLetterSink receives the records a Producer drops, whether because they failed
+// Config.MaxAttemptsPerRecord times, the retry policy doesn't retry them, or the retry policy
+// dropped the batch they were in, e.g. because the buffer was full, or because a record read
+// back from the spool can't be sent or couldn't be read. Write is called after the records
+// are released, from the goroutine that sent them, so a slow sink slows sending down. An
+// error is logged, and the records are lost. Write must be safe for concurrent use.
+type DeadLetterSink interface {
+	Write(letters []DeadLetter) error
+}
+
+// FileDeadLetterSink is a DeadLetterSink that appends each record to a file as a line of
+// JSON, with the data encoded in base64.
+type FileDeadLetterSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileDeadLetterSink opens the file at path for appending, creating it if necessary.
+func NewFileDeadLetterSink(path string) (*FileDeadLetterSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDeadLetterSink{file: file}, nil
+}
+
+// Write appends letters to the file in a single write.
+func (s *FileDeadLetterSink) Write(letters []DeadLetter) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, letter := range letters {
+		if err := encoder.Encode(letter); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.file.Write(buf.Bytes())
+	return err
+}
+
+// Close closes the file.
+func (s *FileDeadLetterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// StreamDeadLetterSink is a DeadLetterSink that writes each record to another Kinesis stream
+// as a line of JSON, like FileDeadLetterSink, with its original partition key. A record close
+// to MaxKinesisRecordBytes can't be written, as encoding it makes it larger.
+type StreamDeadLetterSink struct {
+	Client     BatchingKinesisClient
+	StreamName string
+}
+
+// Write sends letters with as few PutRecords requests as possible. It returns an error if a
+// request fails or any record is rejected.
+func (s *StreamDeadLetterSink) Write(letters []DeadLetter) error {
+	lines, err := encodeDeadLetters(letters)
+	if err != nil {
+		return err
+	}
+	return putInBatches(lines, letters, MaxKinesisBatchSize, MaxKinesisBatchBytes, func(lines [][]byte, letters []DeadLetter) error {
+		args := kinesis.NewArgs()
+		args.Add("StreamName", s.StreamName)
+		for i, line := range lines {
+			args.AddRecord(line, letters[i].PartitionKey)
+		}
+		res, err := s.Client.PutRecords(args)
+		if err != nil {
+			return err
+		}
+		if res.FailedRecordCount > 0 {
+			return fmt.Errorf("%v of %v records were rejected by Kinesis stream %v", res.FailedRecordCount, len(lines), s.StreamName)
+		}
+		return nil
+	})
+}
+
+// FirehoseClient is the subset of KinesisClient used by FirehoseDeadLetterSink. A
+// *kinesis.Kinesis switches to Firehose when PutRecordBatch is called, so it shouldn't be
+// shared with a Producer.
+type FirehoseClient interface {
+	PutRecordBatch(args *kinesis.RequestArgs) (resp *kinesis.PutRecordBatchResp, err error)
+}
+
+// FirehoseDeadLetterSink is a DeadLetterSink that writes each record to a Firehose delivery
+// stream as a line of JSON, like FileDeadLetterSink, so that it is delivered to S3 or another
+// destination as a JSON-lines file.
+type FirehoseDeadLetterSink struct {
+	Client             FirehoseClient
+	DeliveryStreamName string
+}
+
+// Write sends letters with as few PutRecordBatch requests as possible. It returns an error if a
+// request fails or any record is rejected.
+func (s *FirehoseDeadLetterSink) Write(letters []DeadLetter) error {
+	lines, err := encodeDeadLetters(letters)
+	if err != nil {
+		return err
+	}
+	return putInBatches(lines, letters, MaxFirehoseBatchSize, MaxFirehoseBatchBytes, func(lines [][]byte, letters []DeadLetter) error {
+		args := kinesis.NewArgs()
+		args.Add("DeliveryStreamName", s.DeliveryStreamName)
+		for _, line := range lines {
+			args.AddRecord(line, "")
+		}
+		res, err := s.Client.PutRecordBatch(args)
+		if err != nil {
+			return err
+		}
+		if res.FailedPutCount > 0 {
+			return fmt.Errorf("%v of %v records were rejected by Firehose delivery stream %v", res.FailedPutCount, len(lines), s.DeliveryStreamName)
+		}
+		return nil
+	})
+}
+
+// encodeDeadLetters encodes each letter as a line of JSON.
+func encodeDeadLetters(letters []DeadLetter) ([][]byte, error) {
+	lines := make([][]byte, len(letters))
+	for i, letter := range letters {
+		line, err := json.Marshal(letter)
+		if err != nil {
+			return nil, err
+		}
+		lines[i] = append(line, '\n')
+	}
+	return lines, nil
+}
+
+// putInBatches calls put with consecutive batches of lines, and the letters they encode, of
+// at most maxRecords records and maxBytes bytes, counting each line and partition key. It
+// sends every batch, and returns the first error.
+func putInBatches(lines [][]byte, letters []DeadLetter, maxRecords, maxBytes int, put func([][]byte, []DeadLetter) error) error {
+	var firstErr error
+	start, size := 0, 0
+	for i, line := range lines {
+		recordSize := len(line) + len(letters[i].PartitionKey)
+		if i > start && (i-start == maxRecords || size+recordSize > maxBytes) {
+			if err := put(lines[start:i], letters[start:i]); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			start, size = i, 0
+		}
+		size += recordSize
+	}
+	if start < len(lines) {
+		if err := put(lines[start:], letters[start:]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// writeDeadLetters passes letters to Config.DeadLetterSink, if set, logging any error.
+func (b *batchProducer) writeDeadLetters(letters []DeadLetter) {
+	if b.config.DeadLetterSink == nil || len(letters) == 0 {
+		return
+	}
+	if err := b.config.DeadLetterSink.Write(letters); err != nil {
+		b.log(kinesis.LogError, fmt.Sprintf("Error writing %v dropped records to the dead-letter sink: %v", len(letters), err), kinesis.LogKeyError, err)
+	}
+}
+
+// deadLetter returns the DeadLetter of a record dropped after it was rejected with errorCode
+// and errorMessage or, if errorCode is empty, after its request failed with err.
+func (b *batchProducer) deadLetter(record batchRecord, attempts int, errorCode, errorMessage string, err error) DeadLetter {
+	if errorCode == "" && err != nil {
+		errorMessage = err.Error()
+		if kerr, ok := err.(*kinesis.Error); ok {
+			errorCode, errorMessage = kerr.Code, kerr.Message
+		}
+	}
+	return DeadLetter{
+		StreamName:   b.streamName,
+		PartitionKey: record.partitionKey,
+		Data:         record.data,
+		Attempts:     attempts,
+		ErrorCode:    errorCode,
+		ErrorMessage: errorMessage,
+		Time:         time.Now(),
+	}
+}
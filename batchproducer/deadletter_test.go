@@ -0,0 +1,245 @@
+package batchproducer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sendgridlabs/go-kinesis"
+)
+
+type capturingSink struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+func (s *capturingSink) Write(letters []DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.letters = append(s.letters, letters...)
+	return nil
+}
+
+// capturingFirehoseClient records the requests it is sent.
+type capturingFirehoseClient struct {
+	requests [][]kinesis.Record
+}
+
+func (c *capturingFirehoseClient) PutRecordBatch(args *kinesis.RequestArgs) (*kinesis.PutRecordBatchResp, error) {
+	c.requests = append(c.requests, args.Records)
+	return &kinesis.PutRecordBatchResp{RequestResponses: make([]kinesis.PutRecordBatchResponses, len(args.Records))}, nil
+}
+
+func newDeadLetterProducer(c BatchingKinesisClient, sink DeadLetterSink) *batchProducer {
+	config := DefaultConfig
+	config.Logger = discardLogger
+	config.BufferSize = 100
+	config.MaxAttemptsPerRecord = 2
+	config.DeadLetterSink = sink
+	p, err := New(c, "foo", config)
+	if err != nil {
+		panic(err)
+	}
+	return p.(*batchProducer)
+}
+
+func TestDeadLetterAfterMaxAttempts(t *testing.T) {
+	sink := &capturingSink{}
+	b := newDeadLetterProducer(&mockBatchingClient{}, sink)
+	b.Start()
+	b.Add([]byte("a"), "fail")
+	b.Add([]byte("b"), "ok")
+	if _, remaining, _ := b.Flush(time.Second, false); remaining != 0 {
+		t.Errorf("%v != 0", remaining)
+	}
+
+	if len(sink.letters) != 1 {
+		t.Fatalf("%v != 1", len(sink.letters))
+	}
+	letter := sink.letters[0]
+	if letter.StreamName != "foo" || letter.PartitionKey != "fail" || string(letter.Data) != "a" {
+		t.Errorf("unexpected record %+v", letter)
+	}
+	if letter.Attempts != 2 || letter.ErrorCode != "foo" || letter.ErrorMessage != "bar" {
+		t.Errorf("unexpected error %+v", letter)
+	}
+	if letter.Time.IsZero() {
+		t.Error("time not set")
+	}
+}
+
+func TestDeadLetterDroppedBatch(t *testing.T) {
+	sink := &capturingSink{}
+	b := newDeadLetterProducer(&mockBatchingClient{shouldErr: true}, sink)
+	b.retryPolicy = &BackoffRetryPolicy{DropAfterErrors: 1}
+	for i := 0; i < 3; i++ {
+		b.records.add(batchRecord{data: []byte("data"), partitionKey: "key"}, false)
+	}
+	b.sendBatch(10)
+
+	if len(sink.letters) != 3 {
+		t.Fatalf("%v != 3", len(sink.letters))
+	}
+	for _, letter := range sink.letters {
+		if letter.Attempts != 1 || letter.ErrorCode != "" || letter.ErrorMessage != "Oh Noes!" {
+			t.Errorf("unexpected error %+v", letter)
+		}
+	}
+}
+
+func TestDeadLetterKinesisError(t *testing.T) {
+	b := newDeadLetterProducer(&mockBatchingClient{}, nil)
+	err := &kinesis.Error{Code: "ResourceNotFoundException", Message: "Stream foo not found"}
+	letter := b.deadLetter(batchRecord{data: []byte("a"), partitionKey: "key"}, 1, "", "", err)
+	if letter.ErrorCode != err.Code || letter.ErrorMessage != err.Message {
+		t.Errorf("unexpected error %+v", letter)
+	}
+}
+
+func TestFileDeadLetterSink(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead.jsonl")
+
+	sink, err := NewFileDeadLetterSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	letters := []DeadLetter{
+		{StreamName: "foo", PartitionKey: "a", Data: []byte("one"), Attempts: 3, ErrorCode: "InternalFailure"},
+		{StreamName: "foo", PartitionKey: "b", Data: []byte("two\n"), Attempts: 1, ErrorMessage: "timeout"},
+	}
+	if err := sink.Write(letters[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(letters[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var read []DeadLetter
+	for scanner.Scan() {
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, letter)
+	}
+	if len(read) != 2 {
+		t.Fatalf("%v != 2", len(read))
+	}
+	for i := range read {
+		if read[i].PartitionKey != letters[i].PartitionKey || string(read[i].Data) != string(letters[i].Data) ||
+			read[i].Attempts != letters[i].Attempts || read[i].ErrorCode != letters[i].ErrorCode ||
+			read[i].ErrorMessage != letters[i].ErrorMessage {
+			t.Errorf("%+v != %+v", read[i], letters[i])
+		}
+	}
+}
+
+func TestStreamDeadLetterSink(t *testing.T) {
+	c := &capturingClient{}
+	sink := &StreamDeadLetterSink{Client: c, StreamName: "dead"}
+	letters := make([]DeadLetter, 600)
+	for i := range letters {
+		letters[i] = DeadLetter{PartitionKey: "key", Data: []byte("data")}
+	}
+	if err := sink.Write(letters); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.records) != 600 {
+		t.Fatalf("%v != 600", len(c.records))
+	}
+	var letter DeadLetter
+	if err := json.Unmarshal(c.records[0].Data, &letter); err != nil || string(letter.Data) != "data" {
+		t.Errorf("unexpected record %s, %v", c.records[0].Data, err)
+	}
+	if c.records[0].PartitionKey != "key" {
+		t.Errorf("%v != key", c.records[0].PartitionKey)
+	}
+
+	letters[0].PartitionKey = "fail"
+	if err := sink.Write(letters); err == nil || !strings.Contains(err.Error(), "1 of 500") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestFirehoseDeadLetterSink(t *testing.T) {
+	c := &capturingFirehoseClient{}
+	sink := &FirehoseDeadLetterSink{Client: c, DeliveryStreamName: "dead"}
+	// encoded in base64, each record is larger than a megabyte, so 3 fit in a request
+	letters := make([]DeadLetter, 5)
+	for i := range letters {
+		letters[i] = DeadLetter{Data: make([]byte, 900*1024)}
+	}
+	if err := sink.Write(letters); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.requests) != 2 || len(c.requests[0]) != 3 || len(c.requests[1]) != 2 {
+		t.Errorf("unexpected requests of %v records", len(c.requests))
+	}
+}
+
+func TestFirehoseDeadLetterSinkRequest(t *testing.T) {
+	var request struct {
+		DeliveryStreamName string
+		Records            []map[string]interface{}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte(`{"FailedPutCount":0,"RequestResponses":[{"RecordId":"1"}]}`))
+	}))
+	defer server.Close()
+
+	resolver := kinesis.EndpointResolverFunc(func(service, region string, opts kinesis.EndpointOptions) (kinesis.Endpoint, error) {
+		return kinesis.Endpoint{URL: server.URL, SigningName: service, SigningRegion: region}, nil
+	})
+	client, err := kinesis.NewWithResolver(kinesis.NewClient(kinesis.NewAuth("KEY", "SECRET", "")), "us-east-1", resolver, kinesis.EndpointOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &FirehoseDeadLetterSink{Client: client, DeliveryStreamName: "dead"}
+	if err := sink.Write([]DeadLetter{{PartitionKey: "key", Data: []byte("data")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if request.DeliveryStreamName != "dead" || len(request.Records) != 1 {
+		t.Fatalf("unexpected request %+v", request)
+	}
+	record := request.Records[0]
+	if _, ok := record["Data"]; !ok || len(record) != 1 {
+		t.Errorf("record has fields other than Data: %v", record)
+	}
+}
+
+func TestPutInBatchesReturnsFirstError(t *testing.T) {
+	lines := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	letters := make([]DeadLetter, 3)
+	var calls int
+	err := putInBatches(lines, letters, 1, MaxKinesisBatchBytes, func([][]byte, []DeadLetter) error {
+		calls++
+		return errors.New(fmt.Sprint(calls))
+	})
+	if calls != 3 || err == nil || err.Error() != "1" {
+		t.Errorf("%v calls, %v", calls, err)
+	}
+}
@@ -0,0 +1,60 @@
+package batchproducer
+
+import (
+	"fmt"
+
+	"github.com/sendgridlabs/go-kinesis"
+)
+
+// Result is the outcome of sending a record added with AddWithResult. It is resolved once,
+// when the record has been written to Kinesis or dropped. A record still in the buffer when
+// the Producer is stopped, or when Flush times out, stays unresolved until it is sent after
+// the Producer is started again.
+type Result struct {
+	done   chan struct{}
+	record kinesis.PutRecordsRespRecord
+	err    error
+}
+
+func newResult() *Result {
+	return &Result{done: make(chan struct{})}
+}
+
+// Done returns a channel that is closed when the result is resolved.
+func (r *Result) Done() <-chan struct{} {
+	return r.done
+}
+
+// Wait blocks until the result is resolved. It returns the ShardId and SequenceNumber the
+// record was written with, or an error, a *RecordDroppedError, if it was dropped. With
+// Config.Aggregate, the records packed into the same Kinesis record share its sequence
+// number.
+func (r *Result) Wait() (kinesis.PutRecordsRespRecord, error) {
+	<-r.done
+	return r.record, r.err
+}
+
+func (r *Result) resolve(record kinesis.PutRecordsRespRecord, err error) {
+	r.record, r.err = record, err
+	close(r.done)
+}
+
+// RecordDroppedError is the error of the Result of a record that was dropped without being
+// written to Kinesis.
+type RecordDroppedError struct {
+	// Attempts is the number of times the record was sent.
+	Attempts int
+	// ErrorCode and ErrorMessage are from the last failed attempt, if it was rejected by
+	// PutRecords.
+	ErrorCode    string
+	ErrorMessage string
+	// Err is the error returned by the last PutRecords request, if it failed as a whole.
+	Err error
+}
+
+func (e *RecordDroppedError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("record dropped after %d attempts: %v", e.Attempts, e.Err)
+	}
+	return fmt.Sprintf("record dropped after %d attempts: %s: %s", e.Attempts, e.ErrorCode, e.ErrorMessage)
+}
@@ -0,0 +1,102 @@
+package batchproducer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddWithResult(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 2)
+	b.Start()
+	defer b.Stop()
+
+	result, err := b.AddWithResult([]byte("foo"), "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-result.Done():
+		t.Fatal("resolved before the record was sent")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	b.Add([]byte("foo"), "bar")
+	select {
+	case <-result.Done():
+	case <-time.After(time.Second):
+		t.Fatal("not resolved after the record was sent")
+	}
+	record, err := result.Wait()
+	if err != nil {
+		t.Errorf("%v != nil", err)
+	}
+	if record.SequenceNumber != "001" || record.ShardId != "001" {
+		t.Errorf("unexpected record %+v", record)
+	}
+}
+
+func TestAddWithResultDropped(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
+	b.running = true
+	result, err := b.AddWithResult([]byte("foo"), "fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// MaxAttemptsPerRecord is 2
+	b.sendBatch(20)
+	select {
+	case <-result.Done():
+		t.Fatal("resolved before the last attempt")
+	default:
+	}
+	b.sendBatch(20)
+
+	_, err = result.Wait()
+	e, ok := err.(*RecordDroppedError)
+	if !ok {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if e.Attempts != 2 || e.ErrorCode != "foo" || e.ErrorMessage != "bar" {
+		t.Errorf("unexpected error %+v", e)
+	}
+}
+
+func TestAddWithResultRequestError(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{shouldErr: true}, 20, 0, 20)
+	b.running = true
+	result, err := b.AddWithResult([]byte("foo"), "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 19; i++ {
+		b.records.add(batchRecord{data: []byte("foo"), partitionKey: "bar"}, false)
+	}
+
+	// the buffer is nearly full, so the record is dropped after 5 consecutive errors
+	for i := 0; i < 5; i++ {
+		b.sendBatch(1)
+	}
+	select {
+	case <-result.Done():
+	default:
+		t.Fatal("not resolved")
+	}
+	_, err = result.Wait()
+	if e, ok := err.(*RecordDroppedError); !ok || e.Err == nil || e.Attempts != 1 {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestAddWithResultNotRunning(t *testing.T) {
+	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
+	if result, err := b.AddWithResult([]byte("foo"), "bar"); err == nil || result != nil {
+		t.Errorf("expected an error")
+	}
+}
@@ -0,0 +1,121 @@
+package batchproducer
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/sendgridlabs/go-kinesis"
+)
+
+// RetryPolicy decides how a Producer handles failures. Its methods are called from the
+// goroutines sending batches, so they must be safe for concurrent use.
+type RetryPolicy interface {
+	// Delay returns how long to wait before sending another batch after consecutiveErrors
+	// PutRecords requests in a row have failed, the last of them with err. Batches are not
+	// sent while waiting, but Add, stats and Flush's timeout are not held up.
+	Delay(consecutiveErrors int, err error) time.Duration
+
+	// RetryRecord reports whether a record that PutRecords rejected with errorCode should be
+	// sent again. attempts is the number of times it has been sent. Records are dropped after
+	// Config.MaxAttemptsPerRecord attempts in any case.
+	RetryRecord(errorCode string, attempts int) bool
+
+	// DropBatch reports whether the records of a PutRecords request that failed with err, the
+	// last of consecutiveErrors failures in a row, should be dropped rather than returned to the
+	// buffer. bufferUsage is the fraction of the buffer's capacity in use, or zero if the
+	// Producer has a spool.
+	DropBatch(consecutiveErrors int, err error, bufferUsage float64) bool
+}
+
+// BackoffRetryPolicy is a RetryPolicy that waits for exponentially longer after each
+// consecutive error.
+type BackoffRetryPolicy struct {
+	// InitialDelay is the delay after the first error.
+	InitialDelay time.Duration
+
+	// Multiplier is the factor the delay grows by after each further error. Zero means 2.
+	Multiplier float64
+
+	// MaxDelay caps the delay. Zero means no cap.
+	MaxDelay time.Duration
+
+	// Jitter is the fraction of each delay, between 0 and 1, that is randomised, so that
+	// producers that failed at the same time don't all retry at the same time. A delay d is
+	// replaced by a random delay between d*(1-Jitter) and d.
+	Jitter float64
+
+	// DropErrorCodes are the error codes for which records are dropped rather than retried,
+	// whether a record was rejected with the code or the whole request failed with it.
+	DropErrorCodes []string
+
+	// The records of a failed request are dropped once there have been DropAfterErrors
+	// consecutive errors and the buffer is at least DropBufferUsage full, so that Add doesn't
+	// block or fail indefinitely while Kinesis is unavailable. Zero DropAfterErrors means never.
+	DropAfterErrors int
+	DropBufferUsage float64
+}
+
+// DefaultRetryPolicy is copied into each Producer created while Config.RetryPolicy is nil. It
+// waits 50ms after an error, doubling the delay after each further error up to 30s, and drops
+// the records of failed requests after 5 consecutive errors if the buffer is 95% full. A copy
+// with some fields changed can be used as Config.RetryPolicy.
+var DefaultRetryPolicy = BackoffRetryPolicy{
+	InitialDelay:    50 * time.Millisecond,
+	Multiplier:      2,
+	MaxDelay:        30 * time.Second,
+	DropAfterErrors: 5,
+	DropBufferUsage: 0.95,
+}
+
+// Delay returns InitialDelay grown by Multiplier for each error after the first, capped at
+// MaxDelay and reduced at random by up to Jitter.
+func (p BackoffRetryPolicy) Delay(consecutiveErrors int, err error) time.Duration {
+	if consecutiveErrors < 1 {
+		return 0
+	}
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	delay := float64(p.InitialDelay) * math.Pow(multiplier, float64(consecutiveErrors-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if max := math.Nextafter(math.MaxInt64, 0); delay > max {
+		delay = max
+	}
+	if p.Jitter > 0 {
+		delay -= delay * p.Jitter * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+// RetryRecord returns false if errorCode is one of DropErrorCodes.
+func (p BackoffRetryPolicy) RetryRecord(errorCode string, attempts int) bool {
+	return !p.isDropErrorCode(errorCode)
+}
+
+// DropBatch returns true if err is a *kinesis.Error with one of DropErrorCodes, or there have
+// been DropAfterErrors consecutive errors and bufferUsage is at least DropBufferUsage.
+func (p BackoffRetryPolicy) DropBatch(consecutiveErrors int, err error, bufferUsage float64) bool {
+	if kerr, ok := err.(*kinesis.Error); ok && p.isDropErrorCode(kerr.Code) {
+		return true
+	}
+	return p.DropAfterErrors > 0 && consecutiveErrors >= p.DropAfterErrors && bufferUsage >= p.DropBufferUsage
+}
+
+// clone returns a copy of p that shares nothing with it.
+func (p BackoffRetryPolicy) clone() BackoffRetryPolicy {
+	p.DropErrorCodes = append([]string(nil), p.DropErrorCodes...)
+	return p
+}
+
+func (p BackoffRetryPolicy) isDropErrorCode(code string) bool {
+	for _, c := range p.DropErrorCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
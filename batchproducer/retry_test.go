@@ -0,0 +1,163 @@
+package batchproducer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sendgridlabs/go-kinesis"
+)
+
+func TestBackoffRetryPolicyDelay(t *testing.T) {
+	p := &BackoffRetryPolicy{InitialDelay: 50 * time.Millisecond, MaxDelay: time.Second}
+	for _, tt := range []struct {
+		errors int
+		delay  time.Duration
+	}{
+		{0, 0},
+		{1, 50 * time.Millisecond},
+		{2, 100 * time.Millisecond},
+		{5, 800 * time.Millisecond},
+		{6, time.Second},
+		{1000, time.Second},
+	} {
+		if delay := p.Delay(tt.errors, nil); delay != tt.delay {
+			t.Errorf("%v: %v != %v", tt.errors, delay, tt.delay)
+		}
+	}
+
+	p = &BackoffRetryPolicy{InitialDelay: time.Millisecond, Multiplier: 10}
+	if delay := p.Delay(3, nil); delay != 100*time.Millisecond {
+		t.Errorf("%v != 100ms", delay)
+	}
+	if delay := p.Delay(1000, nil); delay <= 0 {
+		t.Errorf("%v overflowed", delay)
+	}
+
+	p = &BackoffRetryPolicy{InitialDelay: 100 * time.Millisecond, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if delay := p.Delay(1, nil); delay < 50*time.Millisecond || delay > 100*time.Millisecond {
+			t.Fatalf("%v out of range", delay)
+		}
+	}
+}
+
+func TestBackoffRetryPolicyDrop(t *testing.T) {
+	p := &BackoffRetryPolicy{
+		DropErrorCodes:  []string{"ResourceNotFoundException"},
+		DropAfterErrors: 5,
+		DropBufferUsage: 0.95,
+	}
+	notFound := &kinesis.Error{Code: "ResourceNotFoundException"}
+	other := errors.New("timeout")
+
+	for _, tt := range []struct {
+		errors int
+		err    error
+		usage  float64
+		drop   bool
+	}{
+		{1, notFound, 0, true},
+		{1, other, 1, false},
+		{4, other, 1, false},
+		{5, other, 0.9, false},
+		{5, other, 0.95, true},
+	} {
+		if drop := p.DropBatch(tt.errors, tt.err, tt.usage); drop != tt.drop {
+			t.Errorf("%v, %v, %v: %v != %v", tt.errors, tt.err, tt.usage, drop, tt.drop)
+		}
+	}
+
+	if p.RetryRecord("ResourceNotFoundException", 1) {
+		t.Errorf("retried ResourceNotFoundException")
+	}
+	if !p.RetryRecord("ProvisionedThroughputExceededException", 1) {
+		t.Errorf("didn't retry ProvisionedThroughputExceededException")
+	}
+}
+
+func TestRetryPolicyRecords(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{}, 100, 0, 20)
+	b.config.MaxAttemptsPerRecord = 10
+	b.retryPolicy = &BackoffRetryPolicy{DropErrorCodes: []string{"foo"}}
+	b.records.add(batchRecord{data: []byte("foo"), partitionKey: "fail"}, false)
+
+	b.sendBatch(20)
+	if b.records.Len() != 0 {
+		t.Errorf("%v != 0", b.records.Len())
+	}
+	if b.currentStat.RecordsDroppedSinceLastStat != 1 {
+		t.Errorf("%v != 1", b.currentStat.RecordsDroppedSinceLastStat)
+	}
+}
+
+func TestRetryPolicyDropBatch(t *testing.T) {
+	t.Parallel()
+
+	b := newProducer(&mockBatchingClient{shouldErr: true}, 100, 0, 20)
+	b.retryPolicy = &BackoffRetryPolicy{DropAfterErrors: 1}
+	for i := 0; i < 3; i++ {
+		b.records.add(batchRecord{data: []byte("foo"), partitionKey: "bar"}, false)
+	}
+
+	b.sendBatch(20)
+	if b.records.Len() != 0 {
+		t.Errorf("%v != 0", b.records.Len())
+	}
+	if b.currentStat.RecordsDroppedSinceLastStat != 3 {
+		t.Errorf("%v != 3", b.currentStat.RecordsDroppedSinceLastStat)
+	}
+}
+
+func TestRetryDelayDoesNotBlock(t *testing.T) {
+	t.Parallel()
+
+	c := &mockBatchingClient{shouldErr: true}
+	b := newProducer(c, 100, 0, 1)
+	b.retryPolicy = &BackoffRetryPolicy{InitialDelay: time.Hour}
+	b.Start()
+	b.Add([]byte("foo"), "bar")
+	time.Sleep(20 * time.Millisecond)
+
+	// the producer is waiting for an hour, but stops and flushes with a timeout promptly
+	start := time.Now()
+	_, remaining, _ := b.Flush(50*time.Millisecond, false)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Flush took %v", elapsed)
+	}
+	if remaining != 1 {
+		t.Errorf("%v != 1", remaining)
+	}
+	c.callsMu.Lock()
+	defer c.callsMu.Unlock()
+	if c.calls != 1 {
+		t.Errorf("%v != 1", c.calls)
+	}
+}
+
+func TestDefaultRetryPolicyIsCopied(t *testing.T) {
+	saved := DefaultRetryPolicy
+	defer func() { DefaultRetryPolicy = saved }()
+	DefaultRetryPolicy.DropErrorCodes = []string{"foo"}
+	b := newProducer(&mockBatchingClient{}, 100, 0, 5)
+	DefaultRetryPolicy.InitialDelay = time.Hour
+	DefaultRetryPolicy.DropErrorCodes[0] = "bar"
+	if delay := b.retryPolicy.Delay(1, nil); delay != 50*time.Millisecond {
+		t.Errorf("%v != 50ms", delay)
+	}
+	if b.retryPolicy.RetryRecord("foo", 1) || !b.retryPolicy.RetryRecord("bar", 1) {
+		t.Error("DropErrorCodes shared with DefaultRetryPolicy")
+	}
+
+	// a changed copy can be used as Config.RetryPolicy
+	policy := saved
+	policy.MaxDelay = time.Second
+	config := DefaultConfig
+	config.Logger = discardLogger
+	config.RetryPolicy = policy
+	if _, err := New(&mockBatchingClient{}, "foo", config); err != nil {
+		t.Errorf("%v != nil", err)
+	}
+}
@@ -0,0 +1,427 @@
+package batchproducer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sendgridlabs/go-kinesis"
+)
+
+// DefaultSpoolSegmentBytes is the size at which a spool file is closed and a new one started,
+// if Config.SpoolSegmentBytes is zero.
+const DefaultSpoolSegmentBytes = 64 * 1024 * 1024
+
+const (
+	spoolSuffix = ".spool"
+
+	// Each entry in a spool file is the length and CRC-32C of its payload, followed by the
+	// payload: the partition key's length as a uvarint, the partition key and the data.
+	spoolHeaderSize = 8
+)
+
+var (
+	errSpoolFull       = errors.New("Spool is full")
+	errSpoolCorrupt    = errors.New("spool entry is corrupt")
+	spoolChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// spool is a write-ahead queue of records on disk, in front of the in-memory buffer. Records
+// are appended to the newest of a sequence of segment files and read back in order, and a
+// segment is deleted once all its records have been read and then sent or dropped. The
+// segments left by a previous process are read before any records added since. A spool is
+// safe for concurrent use.
+type spool struct {
+	dir          string
+	segmentBytes int64
+	maxBytes     int64
+
+	mu      sync.Mutex
+	notFull *sync.Cond
+	// segments holds the segments not yet deleted, oldest first
+	segments []*spoolSegment
+	// active is the segment records are appended to, or nil until the next append
+	active *spoolSegment
+	nextId uint64
+	bytes  int64
+
+	// reading is the segment records are read from, through readFile and reader
+	reading  *spoolSegment
+	readFile *os.File
+	reader   *bufio.Reader
+
+	// results holds the Result of each record added with AddWithResult until it is read
+	results map[spoolPosition]*Result
+}
+
+type spoolSegment struct {
+	id   uint64
+	path string
+	size int64
+	// entries is the number of records in the segment, read the number that have been read
+	// back and acked the number that have since been sent or dropped
+	entries, read, acked int
+	// file is open for appending while the segment is active
+	file *os.File
+}
+
+// spoolPosition identifies a record in the spool.
+type spoolPosition struct {
+	segment *spoolSegment
+	index   int
+}
+
+// openSpool opens the spool in dir, creating dir if necessary. It checks the segments left
+// by a previous process, and truncates any entry that was only partly written. It also
+// returns a description of each problem found, for logging.
+func openSpool(dir string, segmentBytes, maxBytes int64) (*spool, []string, error) {
+	if segmentBytes <= 0 {
+		segmentBytes = DefaultSpoolSegmentBytes
+	}
+	// a segment is only deleted when all its records are done, so the spool must hold several
+	if maxBytes > 0 && segmentBytes > maxBytes/4 {
+		segmentBytes = maxBytes / 4
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &spool{
+		dir:          dir,
+		segmentBytes: segmentBytes,
+		maxBytes:     maxBytes,
+		results:      make(map[spoolPosition]*Result),
+	}
+	s.notFull = sync.NewCond(&s.mu)
+
+	var problems []string
+	for _, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		entries, size, err := scanSpoolSegment(name)
+		if err != nil && err != errSpoolCorrupt {
+			return nil, nil, err
+		}
+		if err == errSpoolCorrupt {
+			problems = append(problems, fmt.Sprintf("truncating spool file %v after %v records at a corrupt or partly written record", name, entries))
+			if err := os.Truncate(name, size); err != nil {
+				return nil, nil, err
+			}
+		}
+		if entries == 0 {
+			if err := os.Remove(name); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		s.segments = append(s.segments, &spoolSegment{id: id, path: name, size: size, entries: entries})
+		s.bytes += size
+		if id >= s.nextId {
+			s.nextId = id + 1
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+	return s, problems, nil
+}
+
+// scanSpoolSegment counts the valid entries at the start of a segment file, and returns
+// their size. It returns errSpoolCorrupt if they are followed by anything else.
+func scanSpoolSegment(name string) (int, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	entries := 0
+	var size int64
+	for {
+		n, _, err := readSpoolEntry(r)
+		if err == io.EOF {
+			return entries, size, nil
+		}
+		if err != nil {
+			return entries, size, err
+		}
+		entries++
+		size += int64(n)
+	}
+}
+
+// Len returns the number of records in the spool that have not been read.
+func (s *spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, segment := range s.segments {
+		n += segment.entries - segment.read
+	}
+	return n
+}
+
+// append writes record to the spool. If the spool has reached its maximum size it blocks
+// until there is room if block is true, and otherwise returns errSpoolFull.
+func (s *spool) append(record batchRecord, block bool) error {
+	entry := encodeSpoolEntry(record)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.maxBytes > 0 && s.bytes > 0 && s.bytes+int64(len(entry)) > s.maxBytes {
+		if !block {
+			return errSpoolFull
+		}
+		s.notFull.Wait()
+	}
+
+	if s.active != nil && s.active.size+int64(len(entry)) > s.segmentBytes {
+		if err := s.seal(); err != nil {
+			return err
+		}
+	}
+	if s.active == nil {
+		path := filepath.Join(s.dir, fmt.Sprintf("%020d%v", s.nextId, spoolSuffix))
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.active = &spoolSegment{id: s.nextId, path: path, file: file}
+		s.segments = append(s.segments, s.active)
+		s.nextId++
+	}
+
+	if _, err := s.active.file.Write(entry); err != nil {
+		// the entry may have been partly written, so no more can be appended after it
+		s.seal()
+		return err
+	}
+	if record.result != nil {
+		s.results[spoolPosition{s.active, s.active.entries}] = record.result
+	}
+	s.active.entries++
+	s.active.size += int64(len(entry))
+	s.bytes += int64(len(entry))
+	return nil
+}
+
+// seal closes the active segment, so that the next append starts a new one.
+func (s *spool) seal() error {
+	active := s.active
+	s.active = nil
+	err := active.file.Sync()
+	if cerr := active.file.Close(); err == nil {
+		err = cerr
+	}
+	active.file = nil
+	s.removeIfDone(active)
+	return err
+}
+
+// next reads the oldest record that has not been read, returning false if there is none.
+func (s *spool) next() (batchRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var segment *spoolSegment
+	for _, candidate := range s.segments {
+		if candidate.read < candidate.entries {
+			segment = candidate
+			break
+		}
+	}
+	if segment == nil {
+		return batchRecord{}, false, nil
+	}
+
+	if s.reading != segment {
+		s.closeReader()
+		f, err := os.Open(segment.path)
+		if err != nil {
+			return batchRecord{}, false, s.skipRest(segment, err)
+		}
+		s.reading, s.readFile, s.reader = segment, f, bufio.NewReader(f)
+		for i := 0; i < segment.read; i++ {
+			if _, _, err := readSpoolEntry(s.reader); err != nil {
+				return batchRecord{}, false, s.skipRest(segment, err)
+			}
+		}
+	}
+
+	_, record, err := readSpoolEntry(s.reader)
+	if err != nil {
+		return batchRecord{}, false, s.skipRest(segment, err)
+	}
+	position := spoolPosition{segment, segment.read}
+	record.spoolSegment = segment
+	record.result = s.results[position]
+	delete(s.results, position)
+	segment.read++
+	return record, true, nil
+}
+
+// spoolReadError is returned by next when the records in a segment that had not been read
+// are skipped after an error reading them.
+type spoolReadError struct {
+	path string
+	lost int
+	err  error
+}
+
+func (e *spoolReadError) Error() string {
+	return fmt.Sprintf("skipping %v records in spool file %v: %v", e.lost, e.path, e.err)
+}
+
+// skipRest gives up on the records in segment that have not been read, after an error
+// reading them, resolving the Results of any added with AddWithResult.
+func (s *spool) skipRest(segment *spoolSegment, err error) error {
+	serr := &spoolReadError{path: segment.path, lost: segment.entries - segment.read, err: err}
+	for i := segment.read; i < segment.entries; i++ {
+		position := spoolPosition{segment, i}
+		if result := s.results[position]; result != nil {
+			result.resolve(kinesis.PutRecordsRespRecord{}, &RecordDroppedError{Err: serr})
+			delete(s.results, position)
+		}
+	}
+	segment.entries = segment.read
+	s.closeReader()
+	s.removeIfDone(segment)
+	return serr
+}
+
+func (s *spool) closeReader() {
+	if s.readFile != nil {
+		s.readFile.Close()
+	}
+	s.reading, s.readFile, s.reader = nil, nil, nil
+}
+
+// ack records that records read from the spool have been sent or dropped, deleting the
+// segments that hold no other records.
+func (s *spool) ack(records []batchRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, record := range records {
+		if record.spoolSegment == nil {
+			continue
+		}
+		record.spoolSegment.acked++
+		if rerr := s.removeIfDone(record.spoolSegment); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// removeIfDone deletes segment if all the records in it have been read and acked, unless
+// records may still be appended to it.
+func (s *spool) removeIfDone(segment *spoolSegment) error {
+	if segment.read < segment.entries || segment.acked < segment.read {
+		return nil
+	}
+	if segment == s.active {
+		if segment.entries == 0 {
+			return nil
+		}
+		s.active = nil
+		segment.file.Close()
+		segment.file = nil
+	}
+	if segment == s.reading {
+		s.closeReader()
+	}
+	for i, candidate := range s.segments {
+		if candidate == segment {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+	s.bytes -= segment.size
+	s.notFull.Broadcast()
+	return os.Remove(segment.path)
+}
+
+// close seals the active segment and closes the segment being read, so that no files are
+// left open while the Producer is stopped. The spool can still be used, and opens them again
+// when needed.
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeReader()
+	if s.active == nil {
+		return nil
+	}
+	return s.seal()
+}
+
+// sync flushes the active segment to stable storage.
+func (s *spool) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	return s.active.file.Sync()
+}
+
+func encodeSpoolEntry(record batchRecord) []byte {
+	payload := make([]byte, spoolHeaderSize, spoolHeaderSize+binary.MaxVarintLen64+len(record.partitionKey)+len(record.data))
+	var n [binary.MaxVarintLen64]byte
+	payload = append(payload, n[:binary.PutUvarint(n[:], uint64(len(record.partitionKey)))]...)
+	payload = append(payload, record.partitionKey...)
+	payload = append(payload, record.data...)
+	binary.LittleEndian.PutUint32(payload[0:4], uint32(len(payload)-spoolHeaderSize))
+	binary.LittleEndian.PutUint32(payload[4:8], crc32.Checksum(payload[spoolHeaderSize:], spoolChecksumTable))
+	return payload
+}
+
+// readSpoolEntry reads an entry, returning its size and the record it holds. It returns
+// io.EOF at the end of r, and errSpoolCorrupt for an entry that was only partly written or
+// has the wrong checksum.
+func readSpoolEntry(r *bufio.Reader) (int, batchRecord, error) {
+	var header [spoolHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errSpoolCorrupt
+		}
+		return 0, batchRecord{}, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if length > 2*MaxKinesisRecordBytes {
+		return 0, batchRecord{}, errSpoolCorrupt
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errSpoolCorrupt
+		}
+		return 0, batchRecord{}, err
+	}
+	if crc32.Checksum(payload, spoolChecksumTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		return 0, batchRecord{}, errSpoolCorrupt
+	}
+	keyLength, n := binary.Uvarint(payload)
+	if n <= 0 || keyLength > uint64(len(payload)-n) {
+		return 0, batchRecord{}, errSpoolCorrupt
+	}
+	record := batchRecord{
+		partitionKey: string(payload[n : n+int(keyLength)]),
+		data:         payload[n+int(keyLength):],
+	}
+	return spoolHeaderSize + int(length), record, nil
+}
@@ -0,0 +1,349 @@
+package batchproducer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func spoolFiles(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func newSpoolingProducer(t *testing.T, c BatchingKinesisClient, dir string) *batchProducer {
+	config := DefaultConfig
+	config.Logger = discardLogger
+	config.BatchSize = 10
+	config.BufferSize = 5
+	config.MaxAttemptsPerRecord = 2
+	config.SpoolDir = dir
+	config.SpoolSegmentBytes = 100
+	p, err := New(c, "foo", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*batchProducer)
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	// Kinesis is down, so the records stay in the spool when the producer stops
+	b := newSpoolingProducer(t, &mockBatchingClient{shouldErr: true}, dir)
+	b.Start()
+	for i := 0; i < 20; i++ {
+		if err := b.Add([]byte(fmt.Sprint(i)), "key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Stop()
+	if len(spoolFiles(t, dir)) == 0 {
+		t.Fatal("no spool files")
+	}
+
+	c := &capturingClient{}
+	b = newSpoolingProducer(t, c, dir)
+	if b.spool.Len() != 20 {
+		t.Errorf("%v != 20", b.spool.Len())
+	}
+	b.Start()
+	if _, remaining, _ := b.Flush(time.Second, false); remaining != 0 {
+		t.Errorf("%v != 0", remaining)
+	}
+
+	if len(c.records) != 20 {
+		t.Fatalf("%v != 20", len(c.records))
+	}
+	for i, r := range c.records {
+		if string(r.Data) != fmt.Sprint(i) || r.PartitionKey != "key" {
+			t.Errorf("%v: unexpected record %v:%s", i, r.PartitionKey, r.Data)
+		}
+	}
+	if files := spoolFiles(t, dir); len(files) != 0 {
+		t.Errorf("spool files not deleted: %v", files)
+	}
+}
+
+func TestSpoolDropsAfterMaxAttempts(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	c := &capturingClient{}
+	b := newSpoolingProducer(t, c, dir)
+	b.Start()
+	b.Add([]byte("a"), "fail")
+	b.Add([]byte("b"), "ok")
+	if _, remaining, _ := b.Flush(time.Second, false); remaining != 0 {
+		t.Errorf("%v != 0", remaining)
+	}
+	if len(c.records) != 1 {
+		t.Errorf("%v != 1", len(c.records))
+	}
+	if files := spoolFiles(t, dir); len(files) != 0 {
+		t.Errorf("spool files not deleted: %v", files)
+	}
+}
+
+func TestSpoolAddWithResult(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	b := newSpoolingProducer(t, &mockBatchingClient{}, dir)
+	b.Start()
+	result, err := b.AddWithResult([]byte("a"), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Flush(time.Second, false)
+
+	select {
+	case <-result.Done():
+	default:
+		t.Fatal("not resolved")
+	}
+	if record, err := result.Wait(); err != nil || record.SequenceNumber != "001" {
+		t.Errorf("unexpected result %+v, %v", record, err)
+	}
+}
+
+func TestSpoolTruncatesPartialRecord(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, _, err := openSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.append(batchRecord{data: []byte(fmt.Sprint(i)), partitionKey: "key"}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.sync()
+
+	// the process died while writing a fourth record
+	partial := encodeSpoolEntry(batchRecord{data: []byte("3"), partitionKey: "key"})
+	f, err := os.OpenFile(s.active.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(partial[:len(partial)-1])
+	f.Close()
+
+	s, problems, err := openSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 {
+		t.Errorf("%v != 1", len(problems))
+	}
+	if s.Len() != 3 {
+		t.Errorf("%v != 3", s.Len())
+	}
+	for i := 0; i < 3; i++ {
+		record, ok, err := s.next()
+		if err != nil || !ok || string(record.data) != fmt.Sprint(i) || record.partitionKey != "key" {
+			t.Errorf("%v: unexpected record %+v, %v, %v", i, record, ok, err)
+		}
+	}
+	if _, ok, _ := s.next(); ok {
+		t.Errorf("unexpected record")
+	}
+}
+
+func TestSpoolCorruptRecord(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, _, err := openSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		s.append(batchRecord{data: []byte("data"), partitionKey: "key"}, false)
+	}
+	s.sync()
+
+	// flip a bit in the second record's data
+	data, err := ioutil.ReadFile(s.active.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)*2/3-1] ^= 1
+	if err := ioutil.WriteFile(s.active.path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, problems, err := openSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || s.Len() != 1 {
+		t.Errorf("%v problems, %v records", len(problems), s.Len())
+	}
+}
+
+func TestSpoolMaxBytes(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, _, err := openSpool(dir, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := batchRecord{data: make([]byte, 30), partitionKey: "key"}
+	for i := 0; i < 2; i++ {
+		if err := s.append(record, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.append(record, false); err != errSpoolFull {
+		t.Errorf("%v != %v", err, errSpoolFull)
+	}
+
+	// sending the first record frees its segment
+	read, _, _ := s.next()
+	s.ack([]batchRecord{read})
+	if err := s.append(record, false); err != nil {
+		t.Errorf("%v != nil", err)
+	}
+}
+
+func TestSpoolDropsRecordTooLarge(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	// spooled by a producer with a larger MaxBatchBytes
+	s, _, err := openSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.append(batchRecord{data: make([]byte, 200), partitionKey: "big"}, false)
+	s.append(batchRecord{data: []byte("small"), partitionKey: "key"}, false)
+	s.sync()
+
+	c := &capturingClient{}
+	sink := &capturingSink{}
+	config := DefaultConfig
+	config.Logger = discardLogger
+	config.MaxBatchBytes = 100
+	config.SpoolDir = dir
+	config.DeadLetterSink = sink
+	p, err := New(c, "foo", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	if _, remaining, _ := p.Flush(time.Second, false); remaining != 0 {
+		t.Errorf("%v != 0", remaining)
+	}
+
+	if len(c.records) != 1 || c.records[0].PartitionKey != "key" {
+		t.Errorf("unexpected records %v", c.records)
+	}
+	if len(sink.letters) != 1 || sink.letters[0].PartitionKey != "big" || sink.letters[0].ErrorCode != RecordTooLargeErrorCode {
+		t.Errorf("unexpected dead letters %+v", sink.letters)
+	}
+	if files := spoolFiles(t, dir); len(files) != 0 {
+		t.Errorf("spool files not deleted: %v", files)
+	}
+}
+
+func TestSpoolSkipResolvesResults(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, _, err := openSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []*Result
+	for i := 0; i < 3; i++ {
+		result := newResult()
+		results = append(results, result)
+		s.append(batchRecord{data: []byte("data"), partitionKey: "key", result: result}, false)
+	}
+	s.sync()
+
+	// flip a bit in the second record's data
+	data, err := ioutil.ReadFile(s.active.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)*2/3-1] ^= 1
+	if err := ioutil.WriteFile(s.active.path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := s.next(); !ok || err != nil {
+		t.Fatalf("unexpected read %v, %v", ok, err)
+	}
+	_, _, err = s.next()
+	if serr, ok := err.(*spoolReadError); !ok || serr.lost != 2 {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, result := range results[1:] {
+		select {
+		case <-result.Done():
+		default:
+			t.Fatal("not resolved")
+		}
+		if _, err := result.Wait(); err == nil {
+			t.Error("no error")
+		} else if derr, ok := err.(*RecordDroppedError); !ok || derr.Err == nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if len(s.results) != 0 {
+		t.Errorf("%v results left", len(s.results))
+	}
+}
+
+func TestSpoolClosedOnStop(t *testing.T) {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("open files can't be counted:", err)
+	}
+	before := len(fds)
+
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	b := newSpoolingProducer(t, &mockBatchingClient{}, dir)
+	for i := 0; i < 3; i++ {
+		b.Start()
+		if err := b.Add([]byte("data"), "key"); err != nil {
+			t.Fatal(err)
+		}
+		// wait for the record to be read into the buffer, where it is too small a batch to send
+		for deadline := time.Now().Add(time.Second); b.spoolLen() > 0 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		b.Stop()
+		if b.spool.active != nil || b.spool.readFile != nil {
+			t.Errorf("spool files left open after Stop %v", i)
+		}
+	}
+
+	if fds, _ := ioutil.ReadDir("/proc/self/fd"); len(fds) != before {
+		t.Errorf("%v open files != %v", len(fds), before)
+	}
+	if files := spoolFiles(t, dir); len(files) == 0 {
+		t.Error("spool files deleted before their records were sent")
+	}
+}
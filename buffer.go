@@ -0,0 +1,56 @@
+package kinesis
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// bufferPool holds the buffers request bodies are marshalled into, so that large
+// PutRecords payloads don't allocate a new buffer for every request.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// maxPooledBufferSize is the largest buffer that is returned to bufferPool; anything
+// bigger is left to the garbage collector so one unusual request doesn't pin memory.
+const maxPooledBufferSize = 8 << 20
+
+// requestBuffer is a pooled request body that can be read any number of times, e.g.
+// by signing and by a retry. The buffer goes back to the pool once its owner and
+// every reader handed out by body have released it, since the http.Transport may
+// close a request body after RoundTrip has returned.
+type requestBuffer struct {
+	buf  *bytes.Buffer
+	refs int32
+}
+
+func newRequestBuffer() *requestBuffer {
+	return &requestBuffer{buf: bufferPool.Get().(*bytes.Buffer), refs: 1}
+}
+
+// body returns a new reader over the buffer's contents.
+func (rb *requestBuffer) body() (io.ReadCloser, error) {
+	atomic.AddInt32(&rb.refs, 1)
+	return &requestBufferReader{Reader: bytes.NewReader(rb.buf.Bytes()), owner: rb}, nil
+}
+
+// release drops one reference to the buffer.
+func (rb *requestBuffer) release() {
+	if atomic.AddInt32(&rb.refs, -1) == 0 && rb.buf.Cap() <= maxPooledBufferSize {
+		rb.buf.Reset()
+		bufferPool.Put(rb.buf)
+	}
+}
+
+type requestBufferReader struct {
+	*bytes.Reader
+	owner *requestBuffer
+	once  sync.Once
+}
+
+func (r *requestBufferReader) Close() error {
+	r.once.Do(r.owner.release)
+	return nil
+}
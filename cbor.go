@@ -0,0 +1,754 @@
+package kinesis
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Content types of the wire protocols the Kinesis API accepts.
+const (
+	jsonContentType = "application/x-amz-json-1.1"
+	cborContentType = "application/x-amz-cbor-1.1"
+)
+
+// Codec encodes request bodies and decodes response bodies for the Kinesis API.
+type Codec interface {
+	// ContentType is sent as the Content-Type of requests.
+	ContentType() string
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+var (
+	// JSONCodec speaks application/x-amz-json-1.1, in which record data is base64
+	// encoded. It is the default, and the only codec Firehose accepts.
+	JSONCodec Codec = jsonCodec{}
+
+	// CBORCodec speaks application/x-amz-cbor-1.1, the binary protocol the AWS SDKs
+	// use by default for Kinesis, in which record data is sent as raw bytes.
+	CBORCodec Codec = cborCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return jsonContentType }
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (jsonCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) ContentType() string { return cborContentType }
+
+func (cborCodec) Encode(w io.Writer, v interface{}) error {
+	e := &cborEncoder{}
+	err := e.encode(reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(e.buf)
+	return err
+}
+
+func (cborCodec) Decode(r io.Reader, v interface{}) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return cborUnmarshal(data, v)
+}
+
+// CBOR major types
+const (
+	cborUint byte = iota
+	cborNegInt
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+const (
+	cborFalse      = 0xf4
+	cborTrue       = 0xf5
+	cborNull       = 0xf6
+	cborUndefined  = 0xf7
+	cborFloat16    = 0xf9
+	cborFloat32    = 0xfa
+	cborFloat64    = 0xfb
+	cborBreak      = 0xff
+	cborIndefinite = 31
+
+	// cborTagEpoch marks an epoch-based date/time.
+	cborTagEpoch = 1
+)
+
+type cborEncoder struct {
+	buf []byte
+}
+
+func (e *cborEncoder) writeHead(major byte, n uint64) {
+	switch {
+	case n < 24:
+		e.buf = append(e.buf, major<<5|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, major<<5|24, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, major<<5|25, byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		e.buf = append(e.buf, major<<5|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	default:
+		e.buf = append(e.buf, major<<5|27)
+		e.buf = appendUint64(e.buf, n)
+	}
+}
+
+func (e *cborEncoder) writeString(s string) {
+	e.writeHead(cborText, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *cborEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, cborNull)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, cborNull)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, cborTrue)
+		} else {
+			e.buf = append(e.buf, cborFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := v.Int(); n < 0 {
+			e.writeHead(cborNegInt, uint64(-1-n))
+		} else {
+			e.writeHead(cborUint, uint64(n))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeHead(cborUint, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		e.buf = append(e.buf, cborFloat64)
+		e.buf = appendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			e.buf = append(e.buf, cborNull)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.writeHead(cborBytes, uint64(v.Len()))
+			if v.Kind() == reflect.Slice {
+				e.buf = append(e.buf, v.Bytes()...)
+			} else {
+				for i := 0; i < v.Len(); i++ {
+					e.buf = append(e.buf, byte(v.Index(i).Uint()))
+				}
+			}
+			return nil
+		}
+		e.writeHead(cborArray, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("cbor: unsupported map key type %v", v.Type().Key())
+		}
+		if v.IsNil() {
+			e.buf = append(e.buf, cborNull)
+			return nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		e.writeHead(cborMap, uint64(len(keys)))
+		for _, k := range keys {
+			e.writeString(k.String())
+			if err := e.encode(v.MapIndex(k)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := cborFields(v.Type())
+		var present []cborField
+		for _, f := range fields {
+			if !f.omitEmpty || !isEmptyValue(v.Field(f.index)) {
+				present = append(present, f)
+			}
+		}
+		e.writeHead(cborMap, uint64(len(present)))
+		for _, f := range present {
+			e.writeString(f.name)
+			if err := e.encode(v.Field(f.index)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+func appendUint64(b []byte, n uint64) []byte {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], n)
+	return append(b, tmp[:]...)
+}
+
+// cborField is an exported struct field, named as encoding/json would name it.
+type cborField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+var cborFieldCache sync.Map // map[reflect.Type][]cborField
+
+func cborFields(t reflect.Type) []cborField {
+	if fields, ok := cborFieldCache.Load(t); ok {
+		return fields.([]cborField)
+	}
+	var fields []cborField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		f := cborField{name: sf.Name, index: i}
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if parts := strings.Split(tag, ","); tag != "" {
+			if parts[0] != "" {
+				f.name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "omitempty" {
+					f.omitEmpty = true
+				}
+			}
+		}
+		fields = append(fields, f)
+	}
+	cborFieldCache.Store(t, fields)
+	return fields
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// cborUnmarshal decodes a CBOR data item into v, which must be a non-nil pointer. As
+// with encoding/json, struct fields are matched to map keys by name, case-insensitively,
+// honouring json tags, and unknown keys are ignored. Slices and byte strings are decoded
+// into the existing capacity of their targets.
+func cborUnmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("cbor: cannot decode into %T", v)
+	}
+	d := &cborDecoder{data: data}
+	return d.decode(rv.Elem())
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// readHead reads the initial byte and argument of a data item. For indefinite lengths
+// indefinite is true and n is zero.
+func (d *cborDecoder) readHead() (major byte, info byte, n uint64, indefinite bool, err error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, 0, false, errCBORTruncated
+	}
+	b := d.data[d.pos]
+	d.pos++
+	major, info = b>>5, b&0x1f
+
+	var size int
+	switch {
+	case info < 24:
+		return major, info, uint64(info), false, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	case info == cborIndefinite:
+		if major == cborUint || major == cborNegInt || major == cborTag {
+			return 0, 0, 0, false, fmt.Errorf("cbor: invalid indefinite length for major type %d", major)
+		}
+		return major, info, 0, true, nil
+	default:
+		return 0, 0, 0, false, fmt.Errorf("cbor: invalid additional information %d", info)
+	}
+
+	if len(d.data)-d.pos < size {
+		return 0, 0, 0, false, errCBORTruncated
+	}
+	for _, c := range d.data[d.pos : d.pos+size] {
+		n = n<<8 | uint64(c)
+	}
+	d.pos += size
+	return major, info, n, false, nil
+}
+
+// peekBreak consumes the break that ends an indefinite length item, if it is next.
+func (d *cborDecoder) peekBreak() (bool, error) {
+	if d.pos >= len(d.data) {
+		return false, errCBORTruncated
+	}
+	if d.data[d.pos] == cborBreak {
+		d.pos++
+		return true, nil
+	}
+	return false, nil
+}
+
+// readBytes reads the content of a byte or text string, joining the chunks of an
+// indefinite length string. dst is reused if it has the capacity.
+func (d *cborDecoder) readBytes(major byte, n uint64, indefinite bool, dst []byte) ([]byte, error) {
+	if !indefinite {
+		if uint64(len(d.data)-d.pos) < n {
+			return nil, errCBORTruncated
+		}
+		dst = append(dst, d.data[d.pos:d.pos+int(n)]...)
+		d.pos += int(n)
+		return dst, nil
+	}
+	for {
+		done, err := d.peekBreak()
+		if err != nil || done {
+			return dst, err
+		}
+		chunkMajor, _, chunkLen, chunkIndefinite, err := d.readHead()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor != major || chunkIndefinite {
+			return nil, errors.New("cbor: invalid chunk in indefinite length string")
+		}
+		dst, err = d.readBytes(major, chunkLen, false, dst)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// decode decodes the next data item into v. An invalid v skips the item.
+func (d *cborDecoder) decode(v reflect.Value) error {
+	start := d.pos
+	major, info, n, indefinite, err := d.readHead()
+	if err != nil {
+		return err
+	}
+
+	if major == cborSimple && (info == cborNull&0x1f || info == cborUndefined&0x1f) {
+		if v.IsValid() && v.CanSet() {
+			switch v.Kind() {
+			case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+				v.Set(reflect.Zero(v.Type()))
+			}
+		}
+		return nil
+	}
+
+	if v.IsValid() {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			d.pos = start
+			return d.decode(v.Elem())
+		}
+		if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+			d.pos = start
+			generic, err := d.decodeGeneric()
+			if err != nil {
+				return err
+			}
+			if generic != nil {
+				v.Set(reflect.ValueOf(generic))
+			} else {
+				v.Set(reflect.Zero(v.Type()))
+			}
+			return nil
+		}
+	}
+
+	switch major {
+	case cborUint, cborNegInt:
+		return setNumber(v, major, n, math.NaN())
+	case cborBytes, cborText:
+		var dst []byte
+		if major == cborBytes && v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			dst = v.Bytes()[:0]
+		}
+		b, err := d.readBytes(major, n, indefinite, dst)
+		if err != nil || !v.IsValid() {
+			return err
+		}
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(b))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			if b == nil {
+				b = []byte{}
+			}
+			v.SetBytes(b)
+		default:
+			return fmt.Errorf("cbor: cannot decode a string into %v", v.Type())
+		}
+		return nil
+	case cborArray:
+		return d.decodeArray(v, n, indefinite)
+	case cborMap:
+		return d.decodeMap(v, n, indefinite)
+	case cborTag:
+		if n == cborTagEpoch && v.IsValid() && (v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64) {
+			return d.decodeEpoch(v)
+		}
+		return d.decode(v)
+	}
+
+	// simple values and floats
+	switch d.data[start] {
+	case cborFalse, cborTrue:
+		if !v.IsValid() {
+			return nil
+		}
+		if v.Kind() != reflect.Bool {
+			return fmt.Errorf("cbor: cannot decode a bool into %v", v.Type())
+		}
+		v.SetBool(d.data[start] == cborTrue)
+		return nil
+	case cborFloat16:
+		return setNumber(v, cborSimple, 0, float16(uint16(n)))
+	case cborFloat32:
+		return setNumber(v, cborSimple, 0, float64(math.Float32frombits(uint32(n))))
+	case cborFloat64:
+		return setNumber(v, cborSimple, 0, math.Float64frombits(n))
+	}
+	return fmt.Errorf("cbor: unsupported simple value %#x", d.data[start])
+}
+
+// decodeEpoch decodes the content of an epoch date/time tag into a float of seconds.
+// Kinesis sends integer milliseconds rather than the integer seconds RFC 8949
+// specifies, as the AWS SDKs do for timestamps; floats are seconds.
+func (d *cborDecoder) decodeEpoch(v reflect.Value) error {
+	var generic interface{}
+	generic, err := d.decodeGeneric()
+	if err != nil {
+		return err
+	}
+	switch t := generic.(type) {
+	case int64:
+		v.SetFloat(float64(t) / 1000)
+	case uint64:
+		v.SetFloat(float64(t) / 1000)
+	case float64:
+		v.SetFloat(t)
+	default:
+		return fmt.Errorf("cbor: invalid epoch date/time %v", generic)
+	}
+	return nil
+}
+
+// setNumber stores an integer (major is cborUint or cborNegInt, with argument n) or a
+// float f in v.
+func setNumber(v reflect.Value, major byte, n uint64, f float64) error {
+	if !v.IsValid() {
+		return nil
+	}
+	isInt := major != cborSimple
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !isInt {
+			if f != math.Trunc(f) {
+				return fmt.Errorf("cbor: cannot decode %v into %v", f, v.Type())
+			}
+			v.SetInt(int64(f))
+			return nil
+		}
+		if n > math.MaxInt64 {
+			return fmt.Errorf("cbor: integer overflows %v", v.Type())
+		}
+		i := int64(n)
+		if major == cborNegInt {
+			i = -1 - i
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("cbor: integer overflows %v", v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if !isInt || major == cborNegInt || v.OverflowUint(n) {
+			return fmt.Errorf("cbor: cannot decode number into %v", v.Type())
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		if isInt {
+			f = float64(n)
+			if major == cborNegInt {
+				f = -1 - f
+			}
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("cbor: cannot decode a number into %v", v.Type())
+	}
+	return nil
+}
+
+func (d *cborDecoder) decodeArray(v reflect.Value, n uint64, indefinite bool) error {
+	if v.IsValid() && v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return fmt.Errorf("cbor: cannot decode an array into %v", v.Type())
+	}
+	if v.IsValid() && v.Kind() == reflect.Slice {
+		v.SetLen(0)
+	}
+	for i := 0; indefinite || uint64(i) < n; i++ {
+		if indefinite {
+			done, err := d.peekBreak()
+			if err != nil {
+				return err
+			}
+			if done {
+				break
+			}
+		}
+		var elem reflect.Value
+		if v.IsValid() {
+			switch {
+			case v.Kind() == reflect.Array && i < v.Len():
+				elem = v.Index(i)
+			case v.Kind() == reflect.Slice:
+				if i < v.Cap() {
+					v.SetLen(i + 1)
+					elem = v.Index(i)
+					resetValue(elem)
+				} else {
+					v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+					elem = v.Index(i)
+				}
+			}
+		}
+		if err := d.decode(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetValue zeroes a reused slice element, keeping the capacity of any byte slices
+// directly inside it so that they can be decoded into again.
+func resetValue(v reflect.Value) {
+	if v.Kind() != reflect.Struct {
+		v.Set(reflect.Zero(v.Type()))
+		return
+	}
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+		if f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Uint8 {
+			f.SetLen(0)
+		} else {
+			f.Set(reflect.Zero(f.Type()))
+		}
+	}
+}
+
+func (d *cborDecoder) decodeMap(v reflect.Value, n uint64, indefinite bool) error {
+	var fields []cborField
+	switch {
+	case !v.IsValid():
+	case v.Kind() == reflect.Struct:
+		fields = cborFields(v.Type())
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	default:
+		return fmt.Errorf("cbor: cannot decode a map into %v", v.Type())
+	}
+
+	for i := uint64(0); indefinite || i < n; i++ {
+		if indefinite {
+			done, err := d.peekBreak()
+			if err != nil {
+				return err
+			}
+			if done {
+				break
+			}
+		}
+		var key string
+		if err := d.decode(reflect.ValueOf(&key).Elem()); err != nil {
+			return err
+		}
+
+		switch {
+		case !v.IsValid():
+			if err := d.decode(reflect.Value{}); err != nil {
+				return err
+			}
+		case v.Kind() == reflect.Struct:
+			var field reflect.Value
+			for _, f := range fields {
+				if f.name == key {
+					field = v.Field(f.index)
+					break
+				}
+				if !field.IsValid() && strings.EqualFold(f.name, key) {
+					field = v.Field(f.index)
+				}
+			}
+			if err := d.decode(field); err != nil {
+				return err
+			}
+		default:
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+	}
+	return nil
+}
+
+// decodeGeneric decodes the next data item into the types encoding/json uses for an
+// interface{}, except that integers are int64 (or uint64 if they are too large) and
+// byte strings are []byte.
+func (d *cborDecoder) decodeGeneric() (interface{}, error) {
+	start := d.pos
+	major, _, n, indefinite, err := d.readHead()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case cborUint:
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return nil, errors.New("cbor: negative integer overflows int64")
+		}
+		return -1 - int64(n), nil
+	case cborBytes:
+		return d.readBytes(major, n, indefinite, []byte{})
+	case cborText:
+		b, err := d.readBytes(major, n, indefinite, nil)
+		return string(b), err
+	case cborArray:
+		var a []interface{}
+		d.pos = start
+		err := d.decode(reflect.ValueOf(&a).Elem())
+		if a == nil && err == nil {
+			a = []interface{}{}
+		}
+		return a, err
+	case cborMap:
+		m := make(map[string]interface{})
+		d.pos = start
+		return m, d.decode(reflect.ValueOf(&m).Elem())
+	case cborTag:
+		return d.decodeGeneric()
+	}
+
+	switch d.data[start] {
+	case cborFalse:
+		return false, nil
+	case cborTrue:
+		return true, nil
+	case cborNull, cborUndefined:
+		return nil, nil
+	case cborFloat16:
+		return float16(uint16(n)), nil
+	case cborFloat32:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case cborFloat64:
+		return math.Float64frombits(n), nil
+	}
+	return nil, fmt.Errorf("cbor: unsupported simple value %#x", d.data[start])
+}
+
+// float16 converts an IEEE 754 half-precision float to a float64.
+func float16(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+// isCBORMap reports whether body starts like a CBOR map, which JSON never does.
+func isCBORMap(body []byte) bool {
+	return len(body) > 0 && body[0]>>5 == cborMap
+}
@@ -0,0 +1,242 @@
+package kinesis
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func cborEncode(t *testing.T, v interface{}) []byte {
+	buf := new(bytes.Buffer)
+	err := CBORCodec.Encode(buf, v)
+	if err != nil {
+		t.Fatalf("%v: %v", v, err)
+	}
+	return buf.Bytes()
+}
+
+// Examples from RFC 8949 Appendix A.
+var cborExamples = []struct {
+	value interface{}
+	hex   string
+}{
+	{int64(0), "00"},
+	{int64(1), "01"},
+	{int64(10), "0a"},
+	{int64(23), "17"},
+	{int64(24), "1818"},
+	{int64(100), "1864"},
+	{int64(1000), "1903e8"},
+	{int64(1000000), "1a000f4240"},
+	{int64(1000000000000), "1b000000e8d4a51000"},
+	{uint64(18446744073709551615), "1bffffffffffffffff"},
+	{int64(-1), "20"},
+	{int64(-10), "29"},
+	{int64(-100), "3863"},
+	{int64(-1000), "3903e7"},
+	{1.1, "fb3ff199999999999a"},
+	{false, "f4"},
+	{true, "f5"},
+	{nil, "f6"},
+	{[]byte{}, "40"},
+	{[]byte{1, 2, 3, 4}, "4401020304"},
+	{"", "60"},
+	{"a", "6161"},
+	{"IETF", "6449455446"},
+	{"ü", "62c3bc"},
+	{[]interface{}{}, "80"},
+	{[]interface{}{int64(1), int64(2), int64(3)}, "83010203"},
+	{map[string]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}, "a26161016162820203"},
+}
+
+func TestCBOREncode(t *testing.T) {
+	for _, tt := range cborExamples {
+		if encoded := hex.EncodeToString(cborEncode(t, tt.value)); encoded != tt.hex {
+			t.Errorf("%#v: %v != %v", tt.value, encoded, tt.hex)
+		}
+	}
+}
+
+func TestCBORDecode(t *testing.T) {
+	examples := append(cborExamples[:len(cborExamples):len(cborExamples)], []struct {
+		value interface{}
+		hex   string
+	}{
+		{1.0, "f93c00"},
+		{-4.0, "f9c400"},
+		{5.960464477539063e-8, "f90001"},
+		{math.Inf(1), "f97c00"},
+		{100000.0, "fa47c35000"},
+		{int64(1363896240), "c11a514b67b0"},
+		{[]byte{1, 2, 3, 4, 5}, "5f42010243030405ff"},
+		{"streaming", "7f657374726561646d696e67ff"},
+		{[]interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}, "9f018202039f0405ffff"},
+		{map[string]interface{}{"Fun": true, "Amt": int64(-2)}, "bf6346756ef563416d7421ff"},
+	}...)
+	for _, tt := range examples {
+		data, _ := hex.DecodeString(tt.hex)
+		var decoded interface{}
+		err := cborUnmarshal(data, &decoded)
+		if err != nil {
+			t.Errorf("%v: %v", tt.hex, err)
+		} else if !reflect.DeepEqual(decoded, tt.value) {
+			t.Errorf("%v: %#v != %#v", tt.hex, decoded, tt.value)
+		}
+	}
+}
+
+func TestCBORDecodeInvalid(t *testing.T) {
+	for _, h := range []string{"", "18", "1a0000", "62c3", "9f01", "a161", "1f", "5f6161ff"} {
+		data, _ := hex.DecodeString(h)
+		var decoded interface{}
+		if err := cborUnmarshal(data, &decoded); err == nil {
+			t.Errorf("%v: expected an error", h)
+		}
+	}
+
+	var n uint8
+	if err := cborUnmarshal([]byte{0x19, 0x01, 0x00}, &n); err == nil {
+		t.Errorf("expected overflow error")
+	}
+	var s string
+	if err := cborUnmarshal([]byte{0x01}, &s); err == nil {
+		t.Errorf("expected type error")
+	}
+}
+
+func TestCBORStructs(t *testing.T) {
+	records := []Record{{Data: []byte("data"), PartitionKey: "a"}, {Data: []byte{0, 255}, PartitionKey: "b", ExplicitHashKey: "1"}}
+	data := cborEncode(t, records)
+
+	// ExplicitHashKey is omitted when empty
+	var generic []map[string]interface{}
+	if err := cborUnmarshal(data, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := generic[0]["ExplicitHashKey"]; ok || len(generic[1]) != 3 {
+		t.Errorf("unexpected fields %v", generic)
+	}
+
+	var decoded []Record
+	if err := cborUnmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, records) {
+		t.Errorf("%v != %v", decoded, records)
+	}
+
+	// keys match fields case-insensitively and through json tags
+	var errors jsonErrors
+	if err := cborUnmarshal(cborEncode(t, map[string]string{"__type": "Code", "message": "text", "other": "x"}), &errors); err != nil {
+		t.Fatal(err)
+	}
+	if errors.Code != "Code" || errors.Message != "text" {
+		t.Errorf("unexpected %+v", errors)
+	}
+}
+
+func TestCBORTimestamp(t *testing.T) {
+	var resp GetRecordsRecords
+	// tag 1 with integer milliseconds, as Kinesis sends
+	data, _ := hex.DecodeString("a1781b417070726f78696d6174654172726976616c54696d657374616d70c11b0000014f7e9b6ffb")
+	if err := cborUnmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ApproximateArrivalTimestamp != 1440938160.123 {
+		t.Errorf("%v != 1440938160.123", resp.ApproximateArrivalTimestamp)
+	}
+
+	// tag 1 with float seconds
+	data, _ = hex.DecodeString("a1781b417070726f78696d6174654172726976616c54696d657374616d70c1fb41d452d9ec200000")
+	if err := cborUnmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ApproximateArrivalTimestamp != 1363896240.5 {
+		t.Errorf("%v != 1363896240.5", resp.ApproximateArrivalTimestamp)
+	}
+}
+
+// newCBORServer is a stand-in for Kinesis that only speaks CBOR.
+func newCBORServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", cborContentType)
+		if r.Header.Get("Content-Type") != cborContentType {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(cborEncode(t, map[string]string{"__type": "SerializationException", "message": "not CBOR"}))
+			return
+		}
+
+		var req map[string]interface{}
+		if err := CBORCodec.Decode(r.Body, &req); err != nil {
+			t.Errorf("cannot decode request: %v", err)
+		}
+
+		switch target := r.Header.Get("X-Amz-Target"); target {
+		case "Kinesis_20131202.PutRecords":
+			record := req["Records"].([]interface{})[0].(map[string]interface{})
+			if data, ok := record["Data"].([]byte); !ok || string(data) != "data" {
+				t.Errorf("Data was not sent as a byte string: %#v", record["Data"])
+			}
+			w.Write(cborEncode(t, PutRecordsResp{Records: []PutRecordsRespRecord{{SequenceNumber: "1", ShardId: "shardId-000000000000"}}}))
+		case "Kinesis_20131202.GetRecords":
+			w.Write(cborEncode(t, map[string]interface{}{
+				"NextShardIterator": "next",
+				"Records": []interface{}{
+					map[string]interface{}{"Data": []byte("first"), "PartitionKey": "a", "SequenceNumber": "1"},
+					map[string]interface{}{"Data": []byte("second"), "PartitionKey": "b", "SequenceNumber": "2"},
+				},
+			}))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(cborEncode(t, map[string]string{"__type": "ResourceNotFoundException", "message": "Stream foo not found"}))
+		}
+	}))
+}
+
+func TestCBORCodec(t *testing.T) {
+	server := newCBORServer(t)
+	defer server.Close()
+
+	k := NewWithEndpoint(NewAuth("BAD_ACCESS_KEY", "BAD_SECRET_KEY", ""), USEast1, server.URL)
+	k.SetCodec(CBORCodec)
+
+	args := NewArgs()
+	args.Add("StreamName", "foo")
+	args.AddRecord([]byte("data"), "key")
+	put, err := k.PutRecords(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(put.Records) != 1 || put.Records[0].ShardId != "shardId-000000000000" {
+		t.Errorf("unexpected response %+v", put)
+	}
+
+	args = NewArgs()
+	args.Add("ShardIterator", "iterator")
+	resp := &GetRecordsResp{Records: []GetRecordsRecords{{Data: make([]byte, 0, 16)}}}
+	data := &resp.Records[0].Data[:1][0]
+	if err := k.GetRecordsInto(args, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.NextShardIterator != "next" || len(resp.Records) != 2 || string(resp.Records[0].Data) != "first" || resp.Records[1].PartitionKey != "b" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if &resp.Records[0].Data[0] != data {
+		t.Errorf("Data buffer was not reused")
+	}
+
+	err = k.DeleteStream("foo")
+	if e, ok := err.(*Error); !ok || e.Code != "ResourceNotFoundException" || e.Message != "Stream foo not found" {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	k.SetCodec(nil)
+	err = k.DeleteStream("foo")
+	if e, ok := err.(*Error); !ok || e.Code != "SerializationException" {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
@@ -1,15 +1,51 @@
 package kinesis
 
 import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// maxRequestAttempts caps how many times a request is sent, however often
+// middleware asks for it to be retried.
+const maxRequestAttempts = 10
+
+// minClockSkew is the smallest difference between our clock and the server's
+// that is treated as skew rather than as network latency or a genuinely bad
+// signature.
+const minClockSkew = 1 * time.Minute
+
+// clockSkewErrorCodes are the error codes AWS services return when the signing
+// time of a request is too far from the server's clock.
+var clockSkewErrorCodes = map[string]bool{
+	"RequestTimeTooSkewed":      true,
+	"RequestExpired":            true,
+	"RequestInTheFuture":        true,
+	"InvalidSignatureException": true,
+	"SignatureDoesNotMatch":     true,
+	"AuthFailure":               true,
+}
+
 // Client is like http.Client, but signs all requests using Auth.
 type Client struct {
 	// Auth holds the credentials for this client instance
 	auth Auth
 	// The http client to make requests with. If nil, http.DefaultClient is used.
 	client *http.Client
+	// clockOffset is added to the local time when signing, in nanoseconds. It is
+	// updated from the Date header of responses that reject a request as skewed.
+	clockOffset int64
+
+	middlewareMu sync.Mutex
+	middleware   []Middleware
 }
 
 // NewClient creates a new Client that uses the credentials in the specified
@@ -18,7 +54,7 @@ type Client struct {
 // This function assumes the Auth object has been sanely initialized. If you
 // wish to infer auth credentials from the environment, refer to NewAuth
 func NewClient(auth Auth) *Client {
-	return &Client{auth: auth, client: http.DefaultClient}
+	return NewClientWithHTTPClient(auth, http.DefaultClient)
 }
 
 // NewClientWithHTTPClient creates a client with a non-default http client
@@ -26,15 +62,230 @@ func NewClient(auth Auth) *Client {
 // response in a timely manner like after the 5 minute mark where the current
 // shard iterator expires
 func NewClientWithHTTPClient(auth Auth, httpClient *http.Client) *Client {
-	return &Client{auth: auth, client: httpClient}
+	c := &Client{auth: auth, client: httpClient}
+	c.middleware = []Middleware{defaultUserAgentMiddleware, tracingMiddleware, loggingMiddleware, c.clockSkewMiddleware()}
+	return c
+}
+
+// Use appends middleware to the chain run around every request the client sends.
+// Middleware runs in the order it was added, after the client's own middleware,
+// which sets the default User-Agent, traces and logs each attempt made by a Kinesis
+// client, and retries requests rejected for clock skew. Other failures are not
+// retried unless RetryMiddleware is added, since callers such as batchproducer
+// retry failed requests themselves.
+func (c *Client) Use(middleware ...Middleware) {
+	c.middlewareMu.Lock()
+	defer c.middlewareMu.Unlock()
+	// copy on write, so that requests in flight keep the chain they started with
+	chain := make([]Middleware, 0, len(c.middleware)+len(middleware))
+	c.middleware = append(append(chain, c.middleware...), middleware...)
+}
+
+func (c *Client) getMiddleware() []Middleware {
+	c.middlewareMu.Lock()
+	defer c.middlewareMu.Unlock()
+	return c.middleware
+}
+
+// ClockOffset returns the correction currently applied to the local clock when
+// signing requests.
+func (c *Client) ClockOffset() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.clockOffset))
+}
+
+// Presign is like the package-level Presign, but takes the credentials from the
+// client and, unless r has a Date header, signs with the local clock corrected by
+// ClockOffset, so that the URL isn't rejected as expired or not yet valid when the
+// local clock is wrong.
+func (c *Client) Presign(r *http.Request, expires time.Duration) (*url.URL, error) {
+	t := time.Now().Add(c.ClockOffset())
+	if r.Header.Get("Date") != "" {
+		var err error
+		t, err = signingTime(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return serviceForHost(r.Host).presignAt(c.auth, r, t, expires)
 }
 
 // Do some request, but sign it before sending
 func (c *Client) Do(req *http.Request) (*http.Response, error) {
-	err := Sign(c.auth, req)
+	return c.doWithService(serviceForHost(req.Host), req)
+}
+
+// doWithService signs the request for service s rather than a service derived
+// from the request's host, then sends it, running the middleware around each
+// attempt. Unless the caller has set a Date header, the request is signed with
+// the corrected clock.
+func (c *Client) doWithService(s *Service, req *http.Request) (*http.Response, error) {
+	middleware := c.getMiddleware()
+
+	var fixedTime time.Time
+	if req.Header.Get("Date") != "" {
+		var err error
+		fixedTime, err = signingTime(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	info := getRequestInfo(req.Context())
+	for number := 1; ; number++ {
+		if info != nil {
+			info.Attempts = number
+		}
+		if number > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		for _, m := range middleware {
+			if m.BeforeSign != nil {
+				if err := m.BeforeSign(req); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		t := fixedTime
+		if t.IsZero() {
+			t = time.Now().Add(c.ClockOffset())
+		}
+		err := s.signAt(c.auth, req, t, "")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range middleware {
+			if m.AfterSign != nil {
+				if err := m.AfterSign(req); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		resp, err := c.client.Do(req)
+		attempt := &Attempt{Request: req, Response: resp, Err: err, Number: number, fixedTime: !fixedTime.IsZero()}
+		for _, m := range middleware {
+			if m.AfterResponse != nil {
+				m.AfterResponse(attempt)
+			}
+		}
+
+		if !attempt.Retry || !canResend(req) || number >= maxRequestAttempts {
+			return attempt.Response, attempt.Err
+		}
+		if attempt.Response != nil {
+			io.Copy(ioutil.Discard, attempt.Response.Body)
+			attempt.Response.Body.Close()
+		}
+	}
+}
+
+// canResend returns whether req can be sent again, which needs GetBody unless it has no body.
+func canResend(req *http.Request) bool {
+	return req.GetBody != nil || req.Body == nil || req.Body == http.NoBody
+}
+
+// requestInfo describes the API call a request belongs to. The Kinesis client
+// attaches it to the context of the requests it sends.
+type requestInfo struct {
+	Operation  string
+	StreamName string
+	ShardId    string
+	// Attempts is updated by the client as the request is sent.
+	Attempts int
+
+	// tracer, if set, is used to start a span for each attempt as a child of
+	// the span in ctx.
+	tracer Tracer
+	ctx    context.Context
+
+	// logger, if set, is used to log each attempt.
+	logger Logger
+
+	// attemptSpan and sent describe the attempt in progress, for the tracing and
+	// logging middleware.
+	attemptSpan Span
+	sent        time.Time
+}
+
+type requestInfoKey struct{}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+func getRequestInfo(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// clockSkewMiddleware retries requests that were rejected because of the
+// local clock once the clock offset has been corrected.
+func (c *Client) clockSkewMiddleware() Middleware {
+	return Middleware{
+		Name: "ClockSkew",
+		AfterResponse: func(a *Attempt) {
+			if a.Err == nil && !a.fixedTime && c.correctClockSkew(a.Response) {
+				a.Retry = true
+			}
+		},
+	}
+}
+
+// correctClockSkew reports whether resp rejected a request because our clock
+// differs from the server's, in which case it updates the clock offset. The body
+// of resp is left readable.
+func (c *Client) correctClockSkew(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusForbidden {
+		return false
+	}
+
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
 	if err != nil {
-		return nil, err
+		return false
 	}
+	offset := serverTime.Sub(time.Now())
+	skew := offset - c.ClockOffset()
+	if skew > -minClockSkew && skew < minClockSkew {
+		return false
+	}
+
+	if !clockSkewErrorCodes[peekErrorCode(resp)] {
+		return false
+	}
+
+	atomic.StoreInt64(&c.clockOffset, int64(offset))
+	return true
+}
 
-	return c.client.Do(req)
+// peekErrorCode returns the error code in the body of resp, leaving the body
+// readable.
+func peekErrorCode(resp *http.Response) string {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	return responseErrorCode(body)
+}
+
+// responseErrorCode extracts the error code from a JSON, CBOR or XML AWS error body.
+func responseErrorCode(body []byte) string {
+	var jsonErr jsonErrors
+	if unmarshalError(body, &jsonErr) == nil && jsonErr.Code != "" {
+		// some services prefix the code with a namespace, e.g. com.amazon.coral.service#
+		return jsonErr.Code[strings.LastIndex(jsonErr.Code, "#")+1:]
+	}
+	var xmlErr stsErrorResponse
+	if xml.Unmarshal(body, &xmlErr) == nil {
+		return xmlErr.Error.Code
+	}
+	return ""
 }
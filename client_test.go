@@ -0,0 +1,250 @@
+package kinesis
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientCorrectsClockSkew(t *testing.T) {
+	calls := 0
+	serverNow := func() time.Time { return time.Now().Add(time.Hour) }
+	v := testVerifier(time.Time{})
+	v.Now = serverNow
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Date", serverNow().UTC().Format(http.TimeFormat))
+		if err := v.Verify(r); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"InvalidSignatureException","message":"Signature expired"}`))
+			return
+		}
+		w.Write([]byte(`{"HasMoreStreams":false,"StreamNames":[]}`))
+	}))
+	defer server.Close()
+
+	k := NewWithEndpoint(NewAuth("ASWKEY", "AWSSECRET", ""), USEast1, server.URL)
+	_, err := k.ListStreams(NewArgs())
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if calls != 2 {
+		t.Errorf("%v != 2", calls)
+	}
+	if offset := k.client.ClockOffset(); offset < 59*time.Minute || offset > 61*time.Minute {
+		t.Errorf("%v is not about an hour", offset)
+	}
+
+	// the next request is signed with the corrected clock straight away
+	_, err = k.ListStreams(NewArgs())
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if calls != 3 {
+		t.Errorf("%v != 3", calls)
+	}
+}
+
+func TestClientPresignCorrectsClock(t *testing.T) {
+	c := NewClient(NewAuth("ASWKEY", "AWSSECRET", ""))
+	atomic.StoreInt64(&c.clockOffset, int64(2*time.Hour))
+	request, _ := http.NewRequest("GET", "https://kinesis.us-east-1.amazonaws.com", nil)
+	u, err := c.Presign(request, time.Minute)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	signed, err := time.Parse(iSO8601BasicFormat, u.Query().Get("X-Amz-Date"))
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if offset := signed.Sub(time.Now()); offset < 119*time.Minute || offset > 121*time.Minute {
+		t.Errorf("%v is not about two hours", offset)
+	}
+}
+
+func TestClientMiddleware(t *testing.T) {
+	var userAgent, requestId string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		requestId = r.Header.Get("X-Request-Id")
+		w.Header().Set("X-Amzn-Requestid", "response-id")
+		w.Write([]byte(`{"HasMoreStreams":false,"StreamNames":[]}`))
+	}))
+	defer server.Close()
+
+	var order []string
+	var signed bool
+	var responseId string
+	k := NewWithEndpoint(NewAuth("BAD_ACCESS_KEY", "BAD_SECRET_KEY", ""), USEast1, server.URL)
+	k.client.Use(
+		UserAgentMiddleware("my-app/1.0"),
+		Middleware{
+			Name: "RequestId",
+			BeforeSign: func(req *http.Request) error {
+				order = append(order, "BeforeSign")
+				req.Header.Set("X-Request-Id", "abc")
+				return nil
+			},
+			AfterSign: func(req *http.Request) error {
+				order = append(order, "AfterSign")
+				signed = strings.Contains(req.Header.Get("Authorization"), "x-request-id")
+				return nil
+			},
+			AfterResponse: func(a *Attempt) {
+				order = append(order, "AfterResponse")
+				responseId = a.Response.Header.Get("X-Amzn-Requestid")
+			},
+		},
+	)
+
+	_, err := k.ListStreams(NewArgs())
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if userAgent != "my-app/1.0" || requestId != "abc" || !signed || responseId != "response-id" {
+		t.Errorf("unexpected values %q %q %v %q", userAgent, requestId, signed, responseId)
+	}
+	if strings.Join(order, ",") != "BeforeSign,AfterSign,AfterResponse" {
+		t.Errorf("unexpected order %v", order)
+	}
+}
+
+func TestClientDefaultUserAgent(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	NewWithEndpoint(NewAuth("BAD_ACCESS_KEY", "BAD_SECRET_KEY", ""), USEast1, server.URL).ListStreams(NewArgs())
+	if userAgent != DefaultUserAgent {
+		t.Errorf("%q != %q", userAgent, DefaultUserAgent)
+	}
+}
+
+func TestClientRetryMiddleware(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "{\"StreamName\":\"foo\"}\n" {
+			t.Errorf("unexpected body %q on attempt %v", body, calls)
+		}
+		if calls < 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ProvisionedThroughputExceededException","message":"Rate exceeded"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	k := NewWithEndpoint(NewAuth("BAD_ACCESS_KEY", "BAD_SECRET_KEY", ""), USEast1, server.URL)
+	k.client.Use(RetryMiddleware(3, time.Millisecond))
+
+	args := NewArgs()
+	args.Add("StreamName", "foo")
+	_, err := k.DescribeStream(args)
+	if err != nil {
+		t.Errorf("%v != nil", err)
+	}
+	if calls != 3 {
+		t.Errorf("%v != 3", calls)
+	}
+}
+
+func TestClientRetriesRequestWithoutBody(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"InvalidSignatureException","message":"Signature expired"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	c := NewClient(NewAuth("ASWKEY", "AWSSECRET", ""))
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := c.Do(request)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	resp.Body.Close()
+	if calls != 2 || resp.StatusCode != http.StatusOK {
+		t.Errorf("%v calls, status %v", calls, resp.StatusCode)
+	}
+}
+
+func TestRetryMiddlewareStopsWhenContextDone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	c := NewClient(NewAuth("ASWKEY", "AWSSECRET", ""))
+	c.Use(RetryMiddleware(5, time.Hour))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	start := time.Now()
+	resp, err := c.Do(request.WithContext(ctx))
+	if err != context.DeadlineExceeded || resp != nil {
+		t.Errorf("unexpected result %v, %v", resp, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v", elapsed)
+	}
+}
+
+func TestRetryMiddlewareSkipsBodyWithoutGetBody(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	c := NewClient(NewAuth("ASWKEY", "AWSSECRET", ""))
+	c.Use(RetryMiddleware(5, time.Hour))
+	request, _ := http.NewRequest("POST", server.URL, ioutil.NopCloser(strings.NewReader("data")))
+	start := time.Now()
+	resp, err := c.Do(request)
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	resp.Body.Close()
+	if calls != 1 || resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("%v calls, status %v", calls, resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v", elapsed)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for _, test := range []struct {
+		base     time.Duration
+		attempts int
+		expected time.Duration
+	}{
+		{10 * time.Millisecond, 1, 10 * time.Millisecond},
+		{10 * time.Millisecond, 3, 40 * time.Millisecond},
+		{time.Second, 100, maxRetryDelay},
+		{time.Minute, 5, time.Minute},
+		{-time.Second, 2, 0},
+	} {
+		if delay := retryDelay(test.base, test.attempts); delay != test.expected {
+			t.Errorf("retryDelay(%v, %v) = %v != %v", test.base, test.attempts, delay, test.expected)
+		}
+	}
+}
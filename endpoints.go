@@ -0,0 +1,172 @@
+package kinesis
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// Partitions
+	PartitionAWS      = "aws"
+	PartitionChina    = "aws-cn"
+	PartitionGovCloud = "aws-us-gov"
+	PartitionISO      = "aws-iso"
+	PartitionISOB     = "aws-iso-b"
+)
+
+type partition struct {
+	name            string
+	regionPrefix    string
+	dnsSuffix       string
+	dualStackSuffix string
+	globalRegion    string
+}
+
+// partitions is ordered so that the more specific region prefixes are tried first;
+// the last entry is the fallback for regions that match no prefix.
+var partitions = []partition{
+	{PartitionChina, "cn-", "amazonaws.com.cn", "api.amazonwebservices.com.cn", "cn-north-1"},
+	{PartitionGovCloud, "us-gov-", "amazonaws.com", "api.aws", "us-gov-west-1"},
+	{PartitionISOB, "us-isob-", "sc2s.sgov.gov", "", "us-isob-east-1"},
+	{PartitionISO, "us-iso-", "c2s.ic.gov", "", "us-iso-east-1"},
+	{PartitionAWS, "", "amazonaws.com", "api.aws", "us-east-1"},
+}
+
+// EndpointOptions selects a variant of a service endpoint.
+type EndpointOptions struct {
+	// Partition overrides the partition otherwise derived from the region, e.g. aws-cn
+	// for cn-north-1.
+	Partition string
+
+	// FIPS selects the FIPS 140-2 validated endpoint.
+	FIPS bool
+
+	// DualStack selects the endpoint that accepts both IPv4 and IPv6.
+	DualStack bool
+}
+
+// Endpoint is a resolved service endpoint and the scope requests to it are signed with.
+type Endpoint struct {
+	URL           string
+	SigningName   string
+	SigningRegion string
+}
+
+// EndpointResolver maps a service and region to the endpoint to send requests to.
+type EndpointResolver interface {
+	ResolveEndpoint(service, region string, opts EndpointOptions) (Endpoint, error)
+}
+
+// EndpointResolverFunc adapts a function to the EndpointResolver interface.
+type EndpointResolverFunc func(service, region string, opts EndpointOptions) (Endpoint, error)
+
+// ResolveEndpoint calls f(service, region, opts).
+func (f EndpointResolverFunc) ResolveEndpoint(service, region string, opts EndpointOptions) (Endpoint, error) {
+	return f(service, region, opts)
+}
+
+// DefaultEndpointResolver resolves the public AWS endpoints of every partition.
+var DefaultEndpointResolver EndpointResolver = EndpointResolverFunc(resolveAWSEndpoint)
+
+func resolveAWSEndpoint(service, region string, opts EndpointOptions) (Endpoint, error) {
+	if service == "" || region == "" {
+		return Endpoint{}, fmt.Errorf("cannot resolve an endpoint for service %q in region %q", service, region)
+	}
+
+	p := partitionForRegion(region)
+	if opts.Partition != "" {
+		var ok bool
+		p, ok = partitionByName(opts.Partition)
+		if !ok {
+			return Endpoint{}, fmt.Errorf("unknown partition %q", opts.Partition)
+		}
+	}
+
+	suffix := p.dnsSuffix
+	if opts.DualStack {
+		if p.dualStackSuffix == "" {
+			return Endpoint{}, fmt.Errorf("partition %s has no dual-stack endpoints", p.name)
+		}
+		suffix = p.dualStackSuffix
+	}
+
+	host := service
+	if opts.FIPS {
+		host += "-fips"
+	}
+
+	return Endpoint{
+		URL:           fmt.Sprintf("https://%s.%s.%s", host, region, suffix),
+		SigningName:   service,
+		SigningRegion: region,
+	}, nil
+}
+
+// ParseEndpoint derives the service and region that requests to host must be signed
+// with. It understands regional, FIPS, dual-stack, VPC interface endpoint and global
+// hostnames in every partition, e.g. kinesis.us-east-1.amazonaws.com,
+// kinesis-fips.us-gov-west-1.amazonaws.com, firehose.cn-north-1.amazonaws.com.cn or
+// vpce-0123-abcd.kinesis.eu-west-1.vpce.amazonaws.com. ok is false for any other host.
+func ParseEndpoint(host string) (service, region string, ok bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	// GovCloud shares its DNS suffix with the aws partition, so try the partitions
+	// in reverse to make global hostnames like sts.amazonaws.com resolve to aws
+	var labels []string
+	var p partition
+	for i := len(partitions) - 1; i >= 0; i-- {
+		candidate := partitions[i]
+		for _, suffix := range []string{candidate.dualStackSuffix, candidate.dnsSuffix} {
+			if suffix != "" && strings.HasSuffix(host, "."+suffix) {
+				labels = strings.Split(strings.TrimSuffix(host, "."+suffix), ".")
+				p = candidate
+				break
+			}
+		}
+		if labels != nil {
+			break
+		}
+	}
+
+	// VPC interface endpoints look like {id}.{service}.{region}.vpce.{suffix}
+	if n := len(labels); n == 4 && labels[3] == "vpce" {
+		labels = labels[1:3]
+	}
+
+	switch len(labels) {
+	case 1:
+		service, region = labels[0], p.globalRegion
+	case 2:
+		service, region = labels[0], labels[1]
+	default:
+		return "", "", false
+	}
+
+	service = strings.TrimSuffix(service, "-fips")
+	if service == "" {
+		return "", "", false
+	}
+	return service, region, true
+}
+
+func partitionForRegion(region string) partition {
+	for _, p := range partitions {
+		if strings.HasPrefix(region, p.regionPrefix) {
+			return p
+		}
+	}
+	return partitions[len(partitions)-1]
+}
+
+func partitionByName(name string) (partition, bool) {
+	for _, p := range partitions {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return partition{}, false
+}
@@ -0,0 +1,97 @@
+package kinesis
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var testResolveEndpointData = []struct {
+	Service string
+	Region  string
+	Options EndpointOptions
+	URL     string
+}{
+	{"kinesis", USEast1, EndpointOptions{}, "https://kinesis.us-east-1.amazonaws.com"},
+	{"firehose", EUWest1, EndpointOptions{}, "https://firehose.eu-west-1.amazonaws.com"},
+	{"kinesis", CNNorth1, EndpointOptions{}, "https://kinesis.cn-north-1.amazonaws.com.cn"},
+	{"kinesis", USGovWest1, EndpointOptions{FIPS: true}, "https://kinesis-fips.us-gov-west-1.amazonaws.com"},
+	{"kinesis", USWest2, EndpointOptions{DualStack: true}, "https://kinesis.us-west-2.api.aws"},
+	{"kinesis", CNNorth1, EndpointOptions{DualStack: true}, "https://kinesis.cn-north-1.api.amazonwebservices.com.cn"},
+	{"sts", "us-iso-east-1", EndpointOptions{}, "https://sts.us-iso-east-1.c2s.ic.gov"},
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	for _, data := range testResolveEndpointData {
+		ep, err := DefaultEndpointResolver.ResolveEndpoint(data.Service, data.Region, data.Options)
+		if err != nil {
+			t.Errorf("%v != nil", err)
+			continue
+		}
+		if ep.URL != data.URL || ep.SigningName != data.Service || ep.SigningRegion != data.Region {
+			t.Errorf("Get this endpoint (%+v), but expect this (%v)", ep, data.URL)
+		}
+	}
+}
+
+func TestResolveEndpointErrors(t *testing.T) {
+	if _, err := DefaultEndpointResolver.ResolveEndpoint("kinesis", "", EndpointOptions{}); err == nil {
+		t.Error("expected an error for an empty region")
+	}
+	if _, err := DefaultEndpointResolver.ResolveEndpoint("kinesis", USEast1, EndpointOptions{Partition: "nope"}); err == nil {
+		t.Error("expected an error for an unknown partition")
+	}
+}
+
+var testParseEndpointData = []struct {
+	Host    string
+	Service string
+	Region  string
+	OK      bool
+}{
+	{"kinesis.us-east-1.amazonaws.com", "kinesis", USEast1, true},
+	{"kinesis.us-east-1.amazonaws.com:443", "kinesis", USEast1, true},
+	{"firehose.eu-central-1.amazonaws.com", "firehose", EUCentral1, true},
+	{"kinesis-fips.us-gov-west-1.amazonaws.com", "kinesis", USGovWest1, true},
+	{"kinesis.cn-north-1.amazonaws.com.cn", "kinesis", CNNorth1, true},
+	{"kinesis.us-west-2.api.aws", "kinesis", USWest2, true},
+	{"vpce-0123456789abcdef-abcdefgh.kinesis.eu-west-1.vpce.amazonaws.com", "kinesis", EUWest1, true},
+	{"sts.amazonaws.com", "sts", USEast1, true},
+	{"127.0.0.1:4567", "", "", false},
+	{"localhost", "", "", false},
+}
+
+func TestParseEndpoint(t *testing.T) {
+	for _, data := range testParseEndpointData {
+		service, region, ok := ParseEndpoint(data.Host)
+		if service != data.Service || region != data.Region || ok != data.OK {
+			t.Errorf("%s: got (%v, %v, %v), expected (%v, %v, %v)", data.Host, service, region, ok, data.Service, data.Region, data.OK)
+		}
+	}
+}
+
+func TestFirehoseUsesResolver(t *testing.T) {
+	client, err := NewWithResolver(NewClient(NewAuth("BAD_ACCESS_KEY", "BAD_SECRET_KEY", "")), USGovWest1, nil, EndpointOptions{FIPS: true})
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	client.Firehose()
+
+	if client.getEndpoint() != "https://firehose-fips.us-gov-west-1.amazonaws.com" {
+		t.Errorf("unexpected endpoint %v", client.getEndpoint())
+	}
+	if sv := client.getService(); sv.Name != "firehose" || sv.Region != USGovWest1 {
+		t.Errorf("unexpected service %+v", sv)
+	}
+}
+
+func TestSignDerivesServiceFromFirehoseHost(t *testing.T) {
+	request, _ := http.NewRequest("POST", "https://firehose.us-east-1.amazonaws.com", nil)
+	request.Header.Set("Date", "Thu, 28 Nov 2013 15:04:05 GMT")
+	Sign(NewAuth("ASWKEY", "AWSSECRET", ""), request)
+
+	expected := "AWS4-HMAC-SHA256 Credential=ASWKEY/20131128/us-east-1/firehose/aws4_request"
+	if auth := request.Header.Get("Authorization"); !strings.HasPrefix(auth, expected) {
+		t.Errorf("Get this header (%v), but expect it to start with (%v)", auth, expected)
+	}
+}
@@ -74,13 +74,24 @@ func (kinesis *Kinesis) DescribeDeliveryStream(args *RequestArgs) (resp *Describ
 	return
 }
 
+// firehoseRecord is a record in a PutRecordBatch request, which has no partition key.
+type firehoseRecord struct {
+	Data []byte
+}
+
+// PutRecordBatch writes the records added to args with AddRecord to a Firehose delivery
+// stream. Their partition keys are ignored.
 // http://docs.aws.amazon.com/firehose/latest/APIReference/API_PutRecordBatch.html
 func (kinesis *Kinesis) PutRecordBatch(args *RequestArgs) (resp *PutRecordBatchResp, err error) {
 	kinesis.Firehose()
 
 	params := makeParams("PutRecordBatch")
 	resp = &PutRecordBatchResp{}
-	args.Add("Records", args.Records)
+	records := make([]firehoseRecord, len(args.Records))
+	for i, r := range args.Records {
+		records[i].Data = r.Data
+	}
+	args.Add("Records", records)
 	err = kinesis.query(params, args.params, resp)
 
 	if err != nil {
@@ -0,0 +1,212 @@
+package kinesis
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultMaxResponseSize is the largest response body read by default. It leaves room
+// for a GetRecords response carrying the maximum of 10 MB of data, base64 encoded.
+const DefaultMaxResponseSize = 32 << 20
+
+// ErrResponseTooLarge is returned when a response body is larger than the maximum
+// response size.
+var ErrResponseTooLarge = errors.New("kinesis: response body exceeds the maximum response size")
+
+// GetRecordsInto is like GetRecords, but decodes the response into resp, reusing the
+// capacity of resp.Records and of the Data of each record in it. With JSONCodec, records
+// are decoded as they are read from the response rather than after it has all been
+// buffered. Because buffers are reused, the records from a previous call must not be
+// retained once resp is passed to GetRecordsInto again.
+func (kinesis *Kinesis) GetRecordsInto(args *RequestArgs, resp *GetRecordsResp) error {
+	params := makeParams("GetRecords")
+	return kinesis.query(params, args.params, &getRecordsDecoder{resp})
+}
+
+// responseDecoder is implemented by responses that decode themselves from the response
+// body, rather than with the codec.
+type responseDecoder interface {
+	decodeResponse(r io.Reader, codec Codec) error
+}
+
+type getRecordsDecoder struct {
+	resp *GetRecordsResp
+}
+
+func (d *getRecordsDecoder) decodeResponse(r io.Reader, codec Codec) error {
+	if codec == JSONCodec {
+		return decodeGetRecords(json.NewDecoder(r), d.resp)
+	}
+	// CBOR carries the data as raw bytes, so it can be decoded straight into the
+	// reused records
+	d.resp.MillisBehindLatest = 0
+	d.resp.NextShardIterator = ""
+	d.resp.Records = d.resp.Records[:0]
+	return codec.Decode(r, d.resp)
+}
+
+// decodeGetRecords decodes a GetRecords response into resp one field at a time.
+func decodeGetRecords(dec *json.Decoder, resp *GetRecordsResp) error {
+	resp.MillisBehindLatest = 0
+	resp.NextShardIterator = ""
+	resp.Records = resp.Records[:0]
+
+	err := expectDelim(dec, '{')
+	if err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "MillisBehindLatest":
+			err = dec.Decode(&resp.MillisBehindLatest)
+		case "NextShardIterator":
+			err = dec.Decode(&resp.NextShardIterator)
+		case "Records":
+			err = decodeRecords(dec, resp)
+		default:
+			err = skipValue(dec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func decodeRecords(dec *json.Decoder, resp *GetRecordsResp) error {
+	t, err := dec.Token()
+	if err != nil || t == nil {
+		return err
+	}
+	if t != json.Delim('[') {
+		return fmt.Errorf("kinesis: expected Records to be an array, got %v", t)
+	}
+	for dec.More() {
+		n := len(resp.Records)
+		if n < cap(resp.Records) {
+			resp.Records = resp.Records[:n+1]
+		} else {
+			resp.Records = append(resp.Records, GetRecordsRecords{})
+		}
+		err = decodeRecord(dec, &resp.Records[n])
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func decodeRecord(dec *json.Decoder, record *GetRecordsRecords) error {
+	*record = GetRecordsRecords{Data: record.Data[:0]}
+
+	err := expectDelim(dec, '{')
+	if err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "ApproximateArrivalTimestamp":
+			err = dec.Decode(&record.ApproximateArrivalTimestamp)
+		case "Data":
+			err = dec.Decode(&base64Into{&record.Data})
+		case "PartitionKey":
+			err = dec.Decode(&record.PartitionKey)
+		case "SequenceNumber":
+			err = dec.Decode(&record.SequenceNumber)
+		default:
+			err = skipValue(dec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// base64Into decodes a base64 encoded JSON string into the existing capacity of *b.
+type base64Into struct {
+	b *[]byte
+}
+
+func (bi *base64Into) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*bi.b = (*bi.b)[:0]
+		return nil
+	}
+	if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+		return fmt.Errorf("kinesis: expected Data to be a string, got %s", data)
+	}
+	src := data[1 : len(data)-1]
+	if bytes.IndexByte(src, '\\') >= 0 {
+		// the encoder escaped something, most likely a '/', so unquote it properly
+		var s string
+		err := json.Unmarshal(data, &s)
+		if err != nil {
+			return err
+		}
+		src = []byte(s)
+	}
+
+	n := base64.StdEncoding.DecodedLen(len(src))
+	buf := (*bi.b)[:0]
+	if cap(buf) < n {
+		buf = make([]byte, n)
+	}
+	n, err := base64.StdEncoding.Decode(buf[:n], src)
+	if err != nil {
+		return err
+	}
+	*bi.b = buf[:n]
+	return nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("kinesis: expected %v in GetRecords response, got %v", delim, t)
+	}
+	return nil
+}
+
+func skipValue(dec *json.Decoder) error {
+	var skip json.RawMessage
+	return dec.Decode(&skip)
+}
+
+// limitedReader reads from r until more than n bytes have been read, and then returns
+// ErrResponseTooLarge.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.n < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	// read one byte beyond the limit, so that a body of exactly n bytes is allowed
+	if int64(len(p)) > lr.n+1 {
+		p = p[:lr.n+1]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	if lr.n < 0 {
+		return n, ErrResponseTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,176 @@
+package kinesis
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// getRecordsResponse returns a GetRecords response body holding n records of data.
+func getRecordsResponse(n int, data []byte) []byte {
+	resp := GetRecordsResp{MillisBehindLatest: 42, NextShardIterator: "next"}
+	for i := 0; i < n; i++ {
+		resp.Records = append(resp.Records, GetRecordsRecords{
+			ApproximateArrivalTimestamp: 1440938160.123,
+			Data:                        data,
+			PartitionKey:                "key" + strconv.Itoa(i),
+			SequenceNumber:              strconv.Itoa(49000000 + i),
+		})
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestDecodeGetRecords(t *testing.T) {
+	for _, body := range [][]byte{
+		getRecordsResponse(3, []byte("some data")),
+		getRecordsResponse(0, nil),
+		// fields that aren't understood are skipped; escaped characters are unquoted
+		[]byte(`{"ChildShards":[{"ShardId":"x"}],"Records":[{"Data":"Pz8\/","EncryptionType":"NONE","PartitionKey":"a"}],"NextShardIterator":null}`),
+		[]byte(`{"Records":null,"MillisBehindLatest":0}`),
+	} {
+		var expected GetRecordsResp
+		err := json.Unmarshal(body, &expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// decode into a response holding records from a previous call, to check that
+		// they are reset
+		resp := &GetRecordsResp{Records: []GetRecordsRecords{{Data: []byte("old data"), PartitionKey: "old"}, {}, {}, {}}}
+		resp.Records = resp.Records[:4]
+		err = decodeGetRecords(json.NewDecoder(bytes.NewReader(body)), resp)
+		if err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		if len(resp.Records) == 0 && len(expected.Records) == 0 {
+			resp.Records, expected.Records = nil, nil
+		}
+		for i := range expected.Records {
+			if len(expected.Records[i].Data) == 0 && len(resp.Records[i].Data) == 0 {
+				resp.Records[i].Data, expected.Records[i].Data = nil, nil
+			}
+		}
+		if !reflect.DeepEqual(*resp, expected) {
+			t.Errorf("%+v != %+v", *resp, expected)
+		}
+	}
+}
+
+func TestDecodeGetRecordsReusesBuffers(t *testing.T) {
+	body := getRecordsResponse(2, []byte("some data"))
+	resp := &GetRecordsResp{Records: make([]GetRecordsRecords, 0, 2)}
+	resp.Records = append(resp.Records, GetRecordsRecords{Data: make([]byte, 0, 64)})
+	records, data := &resp.Records[:1][0], &resp.Records[0].Data[:1][0]
+
+	err := decodeGetRecords(json.NewDecoder(bytes.NewReader(body)), resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &resp.Records[0] != records || &resp.Records[0].Data[0] != data {
+		t.Errorf("buffers were not reused")
+	}
+	if string(resp.Records[1].Data) != "some data" {
+		t.Errorf("%q != some data", resp.Records[1].Data)
+	}
+}
+
+func TestDecodeGetRecordsInvalid(t *testing.T) {
+	for _, body := range []string{
+		`[]`,
+		`{"Records":{}}`,
+		`{"Records":[{"Data":"not base64!"}]}`,
+		`{"Records":[{"Data":1}]}`,
+		`{"Records":[`,
+	} {
+		err := decodeGetRecords(json.NewDecoder(bytes.NewReader([]byte(body))), &GetRecordsResp{})
+		if err == nil {
+			t.Errorf("%s: expected an error", body)
+		}
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	body := getRecordsResponse(10, bytes.Repeat([]byte("x"), 100))
+	for _, chunked := range []bool{false, true} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if chunked {
+				// without a Content-Length the limit is only found by reading
+				w.(http.Flusher).Flush()
+			} else {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			}
+			w.Write(body)
+		}))
+
+		k := NewWithEndpoint(NewAuth("BAD_ACCESS_KEY", "BAD_SECRET_KEY", ""), USEast1, server.URL)
+		args := NewArgs()
+		args.Add("ShardIterator", "iterator")
+
+		k.SetMaxResponseSize(int64(len(body)))
+		resp, err := k.GetRecords(args)
+		if err != nil || len(resp.Records) != 10 {
+			t.Errorf("chunked %v: unexpected response %v %v", chunked, resp, err)
+		}
+
+		k.SetMaxResponseSize(int64(len(body) - 1))
+		_, err = k.GetRecords(args)
+		if err != ErrResponseTooLarge {
+			t.Errorf("chunked %v: %v != %v", chunked, err, ErrResponseTooLarge)
+		}
+
+		server.Close()
+	}
+}
+
+// benchmarkGetRecordsBody is a GetRecords response of 1000 records of 1 KB.
+var benchmarkGetRecordsBody = getRecordsResponse(1000, bytes.Repeat([]byte("x"), 1024))
+
+// BenchmarkDecodeGetRecordsReflect measures decoding a GetRecords response with
+// encoding/json, as GetRecords did before it streamed records.
+func BenchmarkDecodeGetRecordsReflect(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkGetRecordsBody)))
+	for i := 0; i < b.N; i++ {
+		var resp GetRecordsResp
+		err := json.NewDecoder(bytes.NewReader(benchmarkGetRecordsBody)).Decode(&resp)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecodeGetRecords measures decoding a GetRecords response into a new
+// GetRecordsResp, as GetRecords does.
+func BenchmarkDecodeGetRecords(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkGetRecordsBody)))
+	for i := 0; i < b.N; i++ {
+		var resp GetRecordsResp
+		err := decodeGetRecords(json.NewDecoder(bytes.NewReader(benchmarkGetRecordsBody)), &resp)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecodeGetRecordsReused measures decoding a GetRecords response into a
+// GetRecordsResp that is reused, as GetRecordsInto allows.
+func BenchmarkDecodeGetRecordsReused(b *testing.B) {
+	var resp GetRecordsResp
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkGetRecordsBody)))
+	for i := 0; i < b.N; i++ {
+		err := decodeGetRecords(json.NewDecoder(bytes.NewReader(benchmarkGetRecordsBody)), &resp)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -2,14 +2,16 @@
 package kinesis
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"sync"
+	"time"
 )
 
 const (
@@ -24,12 +26,16 @@ const (
 	APSouthEast1 = "ap-southeast-1"
 	APSouthEast2 = "ap-southeast-2"
 	APNortheast1 = "ap-northeast-1"
+	CNNorth1     = "cn-north-1"
+	USGovWest1   = "us-gov-west-1"
 
 	KinesisVersion  = "20131202"
 	FirehoseVersion = "20150804"
 
 	kinesisURL  = "https://kinesis.%s.amazonaws.com"
 	firehoseURL = "https://firehose.%s.amazonaws.com"
+
+	requestIdHeader = "X-Amzn-Requestid"
 )
 
 // NewRegionFromEnv creates a region from the an expected environment variable
@@ -39,15 +45,31 @@ func NewRegionFromEnv() string {
 
 // Structure for kinesis client
 type Kinesis struct {
-	client     *Client
-	endpoint   string
-	region     string
-	version    string
-	streamType string
+	client          *Client
+	endpoint        string
+	signingName     string
+	signingRegion   string
+	region          string
+	version         string
+	streamType      string
+	resolver        EndpointResolver
+	endpointOptions EndpointOptions
+	metrics         Metrics
+	tracer          Tracer
+	logger          Logger
+	rateLimiter     *RateLimiter
+	maxResponseSize int64
+	codec           Codec
 
 	typeMu     sync.Mutex
 	versionMu  sync.Mutex
 	endpointMu sync.Mutex
+	metricsMu  sync.Mutex
+	tracerMu   sync.Mutex
+	loggerMu   sync.Mutex
+	limiterMu  sync.Mutex
+	responseMu sync.Mutex
+	codecMu    sync.Mutex
 }
 
 // KinesisClient interface implemented by Kinesis
@@ -67,26 +89,69 @@ type KinesisClient interface {
 }
 
 // New returns an initialized AWS Kinesis client using the canonical live “production” endpoint
-// for AWS Kinesis, i.e. https://kinesis.{region}.amazonaws.com
+// for AWS Kinesis in the region's partition, e.g. https://kinesis.{region}.amazonaws.com
 func New(auth Auth, region string) *Kinesis {
-	endpoint := fmt.Sprintf(kinesisURL, region)
-	return NewWithEndpoint(auth, region, endpoint)
+	return NewWithClient(region, NewClient(auth))
 }
 
 // NewWithClient returns an initialized AWS Kinesis client using the canonical live “production” endpoint
 // for AWS Kinesis, i.e. https://kinesis.{region}.amazonaws.com but with the ability to create a custom client
 // with specific configurations like a timeout
 func NewWithClient(region string, client *Client) *Kinesis {
-	endpoint := fmt.Sprintf(kinesisURL, region)
-	return &Kinesis{client: client, version: KinesisVersion, region: region, endpoint: endpoint, streamType: "Kinesis"}
+	k := &Kinesis{client: client, version: KinesisVersion, region: region, streamType: "Kinesis", resolver: DefaultEndpointResolver}
+	k.resolveEndpoint("kinesis", kinesisURL)
+	return k
 }
 
 // NewWithEndpoint returns an initialized AWS Kinesis client using the specified endpoint.
 // This is generally useful for testing, so a local Kinesis server can be used.
+// Requests are signed for the kinesis service in region.
 func NewWithEndpoint(auth Auth, region, endpoint string) *Kinesis {
 	// TODO: remove trailing slash on endpoint if there is one? does it matter?
 	// TODO: validate endpoint somehow?
-	return &Kinesis{client: NewClient(auth), version: KinesisVersion, region: region, endpoint: endpoint, streamType: "Kinesis"}
+	return &Kinesis{client: NewClient(auth), version: KinesisVersion, region: region, endpoint: endpoint, signingName: "kinesis", signingRegion: region, streamType: "Kinesis", resolver: DefaultEndpointResolver}
+}
+
+// NewWithResolver returns an initialized AWS Kinesis client whose Kinesis and Firehose endpoints
+// are looked up with resolver, e.g. to select FIPS or dual-stack endpoints with opts or to map
+// regions to VPC endpoints. If resolver is nil, DefaultEndpointResolver is used.
+func NewWithResolver(client *Client, region string, resolver EndpointResolver, opts EndpointOptions) (*Kinesis, error) {
+	if resolver == nil {
+		resolver = DefaultEndpointResolver
+	}
+	ep, err := resolver.ResolveEndpoint("kinesis", region, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Kinesis{
+		client:          client,
+		version:         KinesisVersion,
+		region:          region,
+		endpoint:        ep.URL,
+		signingName:     ep.SigningName,
+		signingRegion:   ep.SigningRegion,
+		streamType:      "Kinesis",
+		resolver:        resolver,
+		endpointOptions: opts,
+	}, nil
+}
+
+// resolveEndpoint points k at service in its region, falling back to the
+// fallback URL format if the resolver fails.
+func (k *Kinesis) resolveEndpoint(service, fallback string) {
+	resolver := k.resolver
+	if resolver == nil {
+		resolver = DefaultEndpointResolver
+	}
+	ep, err := resolver.ResolveEndpoint(service, k.region, k.endpointOptions)
+	if err != nil {
+		ep = Endpoint{URL: fmt.Sprintf(fallback, k.region), SigningName: service, SigningRegion: k.region}
+	}
+	k.endpointMu.Lock()
+	k.endpoint = ep.URL
+	k.signingName = ep.SigningName
+	k.signingRegion = ep.SigningRegion
+	k.endpointMu.Unlock()
 }
 
 // Create params object for request
@@ -142,6 +207,14 @@ type jsonErrors struct {
 	Message string
 }
 
+// unmarshalError decodes an error body in either of the protocols Kinesis speaks.
+func unmarshalError(body []byte, errors *jsonErrors) error {
+	if isCBORMap(body) {
+		return cborUnmarshal(body, errors)
+	}
+	return json.Unmarshal(body, errors)
+}
+
 func buildError(r *http.Response) error {
 	// Reading the body into a []byte because we might need to put it into an error
 	// message after having the JSON decoding fail to produce a message.
@@ -151,12 +224,13 @@ func buildError(r *http.Response) error {
 	}
 
 	errors := jsonErrors{}
-	json.NewDecoder(bytes.NewReader(body)).Decode(&errors)
+	unmarshalError(body, &errors)
 
 	var err Error
 	err.Message = errors.Message
 	err.Code = errors.Code
 	err.StatusCode = r.StatusCode
+	err.RequestId = r.Header.Get(requestIdHeader)
 	if err.Message == "" {
 		err.Message = fmt.Sprintf("%s: %s", r.Status, body)
 	}
@@ -193,48 +267,241 @@ func (k *Kinesis) getEndpoint() string {
 	return k.endpoint
 }
 
-func (k *Kinesis) setEndpoint(endpoint string) {
+// getService returns the Service requests to the current endpoint are signed for.
+func (k *Kinesis) getService() *Service {
 	k.endpointMu.Lock()
-	k.endpoint = endpoint
-	k.endpointMu.Unlock()
+	defer k.endpointMu.Unlock()
+	return &Service{Name: k.signingName, Region: k.signingRegion}
+}
+
+// SetMetrics sets the Metrics that receive a RequestMetrics for every API call.
+// A nil Metrics disables metrics.
+func (k *Kinesis) SetMetrics(m Metrics) {
+	k.metricsMu.Lock()
+	k.metrics = m
+	k.metricsMu.Unlock()
+}
+
+func (k *Kinesis) getMetrics() Metrics {
+	k.metricsMu.Lock()
+	defer k.metricsMu.Unlock()
+	if k.metrics == nil {
+		return NoopMetrics{}
+	}
+	return k.metrics
+}
+
+// SetTracer sets the Tracer used to start spans around every API call and attempt.
+// A nil Tracer disables tracing.
+func (k *Kinesis) SetTracer(t Tracer) {
+	k.tracerMu.Lock()
+	k.tracer = t
+	k.tracerMu.Unlock()
+}
+
+func (k *Kinesis) getTracer() Tracer {
+	k.tracerMu.Lock()
+	defer k.tracerMu.Unlock()
+	if k.tracer == nil {
+		return NoopTracer{}
+	}
+	return k.tracer
+}
+
+// SetLogger sets the Logger used to log requests and responses at debug level, and
+// failed calls at warn level. A nil Logger disables logging.
+func (k *Kinesis) SetLogger(l Logger) {
+	k.loggerMu.Lock()
+	k.logger = l
+	k.loggerMu.Unlock()
+}
+
+func (k *Kinesis) getLogger() Logger {
+	k.loggerMu.Lock()
+	defer k.loggerMu.Unlock()
+	if k.logger == nil {
+		return NoopLogger{}
+	}
+	return k.logger
+}
+
+// SetRateLimiter sets the RateLimiter that PutRecord and PutRecords wait on before
+// sending records. GetRecords calls are not limited automatically, because a shard
+// iterator does not name its shard; call RateLimiter.WaitRead before them instead. A
+// nil RateLimiter disables rate limiting.
+func (k *Kinesis) SetRateLimiter(rl *RateLimiter) {
+	k.limiterMu.Lock()
+	k.rateLimiter = rl
+	k.limiterMu.Unlock()
+}
+
+func (k *Kinesis) getRateLimiter() *RateLimiter {
+	k.limiterMu.Lock()
+	defer k.limiterMu.Unlock()
+	return k.rateLimiter
+}
+
+// SetMaxResponseSize sets the largest response body that will be read, after which
+// calls fail with ErrResponseTooLarge. Zero restores DefaultMaxResponseSize, and a
+// negative size removes the limit.
+func (k *Kinesis) SetMaxResponseSize(n int64) {
+	k.responseMu.Lock()
+	k.maxResponseSize = n
+	k.responseMu.Unlock()
+}
+
+func (k *Kinesis) getMaxResponseSize() int64 {
+	k.responseMu.Lock()
+	defer k.responseMu.Unlock()
+	if k.maxResponseSize == 0 {
+		return DefaultMaxResponseSize
+	}
+	return k.maxResponseSize
+}
+
+// SetCodec sets the Codec used for request and response bodies. JSONCodec is the
+// default; CBORCodec avoids base64 encoding record data, but is only understood by
+// Kinesis, not Firehose. A nil Codec restores the default.
+func (k *Kinesis) SetCodec(c Codec) {
+	k.codecMu.Lock()
+	k.codec = c
+	k.codecMu.Unlock()
+}
+
+func (k *Kinesis) getCodec() Codec {
+	k.codecMu.Lock()
+	defer k.codecMu.Unlock()
+	if k.codec == nil {
+		return JSONCodec
+	}
+	return k.codec
 }
 
 func (k *Kinesis) Firehose() {
 	k.setStreamType("Firehose")
 	k.setVersion(FirehoseVersion)
-	k.setEndpoint(fmt.Sprintf(firehoseURL, k.region))
+	k.resolveEndpoint("firehose", firehoseURL)
 }
 
 // Query by AWS API
 func (kinesis *Kinesis) query(params map[string]string, data interface{}, resp interface{}) error {
-	jsonData, err := json.Marshal(data)
+	start := time.Now()
+	info := &requestInfo{
+		Operation:  params[ActionKey],
+		StreamName: streamName(params, data),
+		ShardId:    shardId(data),
+		tracer:     kinesis.getTracer(),
+		logger:     kinesis.getLogger(),
+	}
+	metrics := RequestMetrics{Operation: info.Operation, StreamName: info.StreamName}
+
+	attributes := map[string]string{
+		TraceAttrService:   kinesis.getService().Name,
+		TraceAttrOperation: info.Operation,
+	}
+	if info.StreamName != "" {
+		attributes[TraceAttrStreamName] = info.StreamName
+	}
+	if info.ShardId != "" {
+		attributes[TraceAttrShardId] = info.ShardId
+	}
+	var span Span
+	info.ctx, span = info.tracer.StartSpan(context.Background(), kinesis.getStreamType()+"."+info.Operation, attributes)
+
+	err := kinesis.doQuery(params, data, resp, info, &metrics)
+	if info.attemptSpan != nil {
+		// middleware after the tracing middleware aborted the last attempt
+		endAttemptSpan(info.attemptSpan, nil, err)
+	}
+
+	if err != nil {
+		span.RecordError(err)
+	} else if r, ok := resp.(*PutRecordResp); ok {
+		span.SetAttribute(TraceAttrShardId, r.ShardId)
+	}
+	span.End()
+
+	metrics.Err = err
+	metrics.Attempts = info.Attempts
+	metrics.Latency = time.Since(start)
+	if kerr, ok := err.(*Error); ok {
+		metrics.ErrorCode = kerr.Code
+	}
+	kinesis.getMetrics().ObserveRequest(metrics)
+
+	if err != nil && info.logger.Enabled(LogWarn) {
+		fields := append(info.logFields(), LogKeyAttempt, info.Attempts, LogKeyError, err)
+		if kerr, ok := err.(*Error); ok {
+			fields = append(fields, LogKeyErrorCode, kerr.Code, LogKeyRequestId, kerr.RequestId)
+		}
+		info.logger.Log(LogWarn, "request failed", fields...)
+	}
+	return err
+}
+
+func (kinesis *Kinesis) doQuery(params map[string]string, data interface{}, resp interface{}, info *requestInfo, metrics *RequestMetrics) error {
+	// The body is marshalled into a pooled buffer that signing, sending and any retry
+	// all read from, rather than into a fresh byte slice that is then copied again.
+	codec := kinesis.getCodec()
+	body := newRequestBuffer()
+	defer body.release()
+	err := codec.Encode(body.buf, data)
 	if err != nil {
 		return err
 	}
+	metrics.BytesOut = int64(body.buf.Len())
 
 	// request
 	request, err := http.NewRequest(
 		"POST",
 		kinesis.getEndpoint(),
-		bytes.NewReader(jsonData),
+		nil,
 	)
 
 	if err != nil {
 		return err
 	}
+	request = request.WithContext(withRequestInfo(request.Context(), info))
+	request.Body, _ = body.body()
+	request.GetBody = body.body
+	request.ContentLength = int64(body.buf.Len())
 
 	// headers
-	request.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	request.Header.Set("Content-Type", codec.ContentType())
 	request.Header.Set("X-Amz-Target", fmt.Sprintf("%s_%s.%s", kinesis.getStreamType(), kinesis.getVersion(), params[ActionKey]))
-	request.Header.Set("User-Agent", "Golang Kinesis")
 
 	// response
-	response, err := kinesis.client.Do(request)
+	response, err := kinesis.client.doWithService(kinesis.getService(), request)
 	if err != nil {
 		return err
 	}
 	defer response.Body.Close()
+	metrics.StatusCode = response.StatusCode
+	counter := &countingReader{r: response.Body}
+	response.Body = ioutil.NopCloser(counter)
+	defer func() { metrics.BytesIn = counter.n }()
+
+	var limited *limitedReader
+	if limit := kinesis.getMaxResponseSize(); limit > 0 {
+		if response.ContentLength > limit {
+			return ErrResponseTooLarge
+		}
+		limited = &limitedReader{r: counter, n: limit}
+		response.Body = ioutil.NopCloser(limited)
+	}
 
+	err = decodeResponse(response, resp, codec)
+	// the decoder may not have needed the bytes beyond the limit, so check
+	// whether they were read rather than relying on the error
+	if limited != nil && limited.n < 0 {
+		return ErrResponseTooLarge
+	}
+	return err
+}
+
+// decodeResponse decodes a successful response into resp with codec, or returns the
+// error a failed response holds.
+func decodeResponse(response *http.Response, resp interface{}, codec Codec) error {
 	if response.StatusCode != 200 {
 		return buildError(response)
 	}
@@ -243,7 +510,48 @@ func (kinesis *Kinesis) query(params map[string]string, data interface{}, resp i
 		return nil
 	}
 
-	return json.NewDecoder(response.Body).Decode(resp)
+	if d, ok := resp.(responseDecoder); ok {
+		return d.decodeResponse(response.Body, codec)
+	}
+	return codec.Decode(response.Body, resp)
+}
+
+// streamName returns the name of the stream or delivery stream a request is for,
+// from either its params or its body.
+func streamName(params map[string]string, data interface{}) string {
+	if name := params["StreamName"]; name != "" {
+		return name
+	}
+	if m, ok := data.(map[string]interface{}); ok {
+		for _, key := range []string{"StreamName", "DeliveryStreamName"} {
+			if name, ok := m[key].(string); ok {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// shardId returns the shard a request is for, if its body names one.
+func shardId(data interface{}) string {
+	if m, ok := data.(map[string]interface{}); ok {
+		if id, ok := m["ShardId"].(string); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
 }
 
 // CreateStream adds a new Amazon Kinesis stream to your AWS account
@@ -251,6 +559,7 @@ func (kinesis *Kinesis) query(params map[string]string, data interface{}, resp i
 // more info http://docs.aws.amazon.com/kinesis/latest/APIReference/API_CreateStream.html
 func (kinesis *Kinesis) CreateStream(StreamName string, ShardCount int) error {
 	params := makeParams("CreateStream")
+	params["StreamName"] = StreamName
 	requestParams := struct {
 		StreamName string
 		ShardCount int
@@ -270,6 +579,7 @@ func (kinesis *Kinesis) CreateStream(StreamName string, ShardCount int) error {
 // more info http://docs.aws.amazon.com/kinesis/latest/APIReference/API_DeleteStream.html
 func (kinesis *Kinesis) DeleteStream(StreamName string) error {
 	params := makeParams("DeleteStream")
+	params["StreamName"] = StreamName
 	requestParams := struct {
 		StreamName string
 	}{
@@ -403,9 +713,8 @@ type GetRecordsResp struct {
 // GetRecords returns one or more data records from a shard
 // more info http://docs.aws.amazon.com/kinesis/latest/APIReference/API_GetRecords.html
 func (kinesis *Kinesis) GetRecords(args *RequestArgs) (resp *GetRecordsResp, err error) {
-	params := makeParams("GetRecords")
 	resp = &GetRecordsResp{}
-	err = kinesis.query(params, args.params, resp)
+	err = kinesis.GetRecordsInto(args, resp)
 	if err != nil {
 		return nil, err
 	}
@@ -435,6 +744,18 @@ func (kinesis *Kinesis) PutRecord(args *RequestArgs) (resp *PutRecordResp, err e
 	if len(args.Records) > 0 {
 		args.AddData(args.Records[0].Data)
 		args.Add("PartitionKey", args.Records[0].PartitionKey)
+		if args.Records[0].ExplicitHashKey != "" {
+			args.Add("ExplicitHashKey", args.Records[0].ExplicitHashKey)
+		}
+	}
+
+	if rl := kinesis.getRateLimiter(); rl != nil {
+		var r Record
+		r.Data, _ = args.params["Data"].([]byte)
+		r.PartitionKey, _ = args.params["PartitionKey"].(string)
+		r.ExplicitHashKey, _ = args.params["ExplicitHashKey"].(string)
+		stream, _ := args.params["StreamName"].(string)
+		rl.WaitRecords(stream, []Record{r})
 	}
 
 	resp = &PutRecordResp{}
@@ -451,6 +772,10 @@ func (kinesis *Kinesis) PutRecords(args *RequestArgs) (resp *PutRecordsResp, err
 	params := makeParams("PutRecords")
 	resp = &PutRecordsResp{}
 	args.Add("Records", args.Records)
+	if rl := kinesis.getRateLimiter(); rl != nil {
+		stream, _ := args.params["StreamName"].(string)
+		rl.WaitRecords(stream, args.Records)
+	}
 	err = kinesis.query(params, args.params, resp)
 
 	if err != nil {
@@ -484,6 +809,7 @@ func (f *RequestArgs) AddRecord(value []byte, partitionKey string) {
 
 // Record stores the Data and PartitionKey for PutRecord or PutRecords calls to Kinesis API
 type Record struct {
-	Data         []byte
-	PartitionKey string
+	Data            []byte
+	PartitionKey    string
+	ExplicitHashKey string `json:",omitempty"`
 }
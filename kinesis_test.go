@@ -1,8 +1,13 @@
 package kinesis
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
@@ -196,3 +201,30 @@ func createStream(client KinesisClient, streamName string, partitions int) error
 
 	return nil
 }
+
+// BenchmarkPutRecords measures a maximum size PutRecords request (500 records of 10 KB)
+// against a local server that discards the request body.
+func BenchmarkPutRecords(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Write([]byte(`{"FailedRecordCount":0,"Records":[]}`))
+	}))
+	defer server.Close()
+
+	client := NewWithEndpoint(NewAuth("BAD_ACCESS_KEY", "BAD_SECRET_KEY", ""), USEast1, server.URL)
+	data := bytes.Repeat([]byte("x"), 10*1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		args := NewArgs()
+		args.Add("StreamName", "foo")
+		for j := 0; j < 500; j++ {
+			args.AddRecord(data, "key")
+		}
+		_, err := client.PutRecords(args)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package kinesis
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogLevel is the severity of a log message.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	}
+	return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+}
+
+// Keys of the fields attached to log messages, so that they can be filtered on.
+const (
+	LogKeyOperation = "operation"
+	LogKeyStream    = "stream"
+	LogKeyShard     = "shard"
+	LogKeyErrorCode = "error_code"
+	LogKeyRequestId = "request_id"
+	LogKeyAttempt   = "attempt"
+	LogKeyError     = "error"
+)
+
+// Logger is a leveled, structured logger. keyvals holds alternating keys and values,
+// as with log/slog.
+type Logger interface {
+	// Enabled reports whether messages at level are logged, so that expensive
+	// fields need not be built for messages that would be discarded.
+	Enabled(level LogLevel) bool
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+// NoopLogger discards all messages. It is the default.
+type NoopLogger struct{}
+
+// Enabled returns false.
+func (NoopLogger) Enabled(LogLevel) bool { return false }
+
+// Log does nothing.
+func (NoopLogger) Log(LogLevel, string, ...interface{}) {}
+
+// Printfer is implemented by *log.Logger and other Printf-style loggers.
+type Printfer interface {
+	Printf(format string, args ...interface{})
+}
+
+// NewPrintfLogger adapts a Printf-style logger such as *log.Logger, writing each message
+// at min or above as a line like `WARN message stream=foo error_code=Bar`.
+func NewPrintfLogger(l Printfer, min LogLevel) Logger {
+	return &printfLogger{l: l, min: min}
+}
+
+type printfLogger struct {
+	l   Printfer
+	min LogLevel
+}
+
+func (pl *printfLogger) Enabled(level LogLevel) bool {
+	return level >= pl.min
+}
+
+func (pl *printfLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if !pl.Enabled(level) {
+		return
+	}
+	line := new(strings.Builder)
+	line.WriteString(level.String())
+	line.WriteByte(' ')
+	line.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var value interface{} = "MISSING"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		fmt.Fprintf(line, " %v=%v", keyvals[i], value)
+	}
+	pl.l.Printf("%s", line.String())
+}
+
+// redactedHeaders are replaced by "REDACTED" when requests are logged.
+var redactedHeaders = []string{"Authorization", AWSSecurityTokenHeader}
+
+// redactHeader returns a copy of h that is safe to log.
+func redactHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = v
+	}
+	for _, k := range redactedHeaders {
+		if _, ok := c[http.CanonicalHeaderKey(k)]; ok {
+			c[http.CanonicalHeaderKey(k)] = []string{"REDACTED"}
+		}
+	}
+	return c
+}
+
+// logFields returns the fields that identify the request described by info.
+func (info *requestInfo) logFields() []interface{} {
+	fields := []interface{}{LogKeyOperation, info.Operation}
+	if info.StreamName != "" {
+		fields = append(fields, LogKeyStream, info.StreamName)
+	}
+	if info.ShardId != "" {
+		fields = append(fields, LogKeyShard, info.ShardId)
+	}
+	return fields
+}
+
+// loggingMiddleware logs each attempt at a request made by a Kinesis client at
+// debug level.
+var loggingMiddleware = Middleware{
+	Name: "Logging",
+	AfterSign: func(req *http.Request) error {
+		if info := getRequestInfo(req.Context()); info != nil {
+			logRequest(info, req)
+			info.sent = time.Now()
+		}
+		return nil
+	},
+	AfterResponse: func(a *Attempt) {
+		if info := getRequestInfo(a.Request.Context()); info != nil && !info.sent.IsZero() {
+			logResponse(info, a.Response, a.Err, time.Since(info.sent))
+			info.sent = time.Time{}
+		}
+	},
+}
+
+// logRequest logs an attempt at sending req at debug level, with its credentials redacted.
+func logRequest(info *requestInfo, req *http.Request) {
+	if info == nil || info.logger == nil || !info.logger.Enabled(LogDebug) {
+		return
+	}
+	fields := append(info.logFields(),
+		LogKeyAttempt, info.Attempts,
+		"method", req.Method,
+		"url", req.URL.String(),
+		"header", redactHeader(req.Header),
+		"content_length", req.ContentLength,
+	)
+	info.logger.Log(LogDebug, "sending request", fields...)
+}
+
+// logResponse logs the outcome of an attempt at debug level.
+func logResponse(info *requestInfo, resp *http.Response, err error, elapsed time.Duration) {
+	if info == nil || info.logger == nil || !info.logger.Enabled(LogDebug) {
+		return
+	}
+	fields := append(info.logFields(), LogKeyAttempt, info.Attempts, "elapsed", elapsed)
+	if err != nil {
+		info.logger.Log(LogDebug, "request failed", append(fields, LogKeyError, err)...)
+		return
+	}
+	fields = append(fields,
+		"status", resp.StatusCode,
+		LogKeyRequestId, resp.Header.Get(requestIdHeader),
+		"content_length", resp.ContentLength,
+	)
+	info.logger.Log(LogDebug, "received response", fields...)
+}
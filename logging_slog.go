@@ -0,0 +1,38 @@
+//go:build go1.21
+// +build go1.21
+
+package kinesis
+
+import (
+	"context"
+	"log/slog"
+)
+
+// NewSlogLogger adapts a *slog.Logger to the Logger interface.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (sl slogLogger) Enabled(level LogLevel) bool {
+	return sl.l.Enabled(context.Background(), slogLevel(level))
+}
+
+func (sl slogLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	sl.l.Log(context.Background(), slogLevel(level), msg, keyvals...)
+}
+
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case LogDebug:
+		return slog.LevelDebug
+	case LogInfo:
+		return slog.LevelInfo
+	case LogWarn:
+		return slog.LevelWarn
+	}
+	return slog.LevelError
+}
@@ -0,0 +1,27 @@
+//go:build go1.21
+// +build go1.21
+
+package kinesis
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	l.Log(LogDebug, "hidden")
+	l.Log(LogWarn, "request failed", LogKeyStream, "foo", LogKeyShard, "shardId-000000000001")
+
+	out := buf.String()
+	if strings.Contains(out, "hidden") || !strings.Contains(out, `level=WARN msg="request failed" stream=foo shard=shardId-000000000001`) {
+		t.Errorf("unexpected output %q", out)
+	}
+	if l.Enabled(LogDebug) {
+		t.Errorf("debug should not be enabled")
+	}
+}
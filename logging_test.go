@@ -0,0 +1,88 @@
+package kinesis
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type logEntry struct {
+	level   LogLevel
+	msg     string
+	keyvals map[interface{}]interface{}
+}
+
+type logRecorder struct {
+	entries []logEntry
+}
+
+func (lr *logRecorder) Enabled(LogLevel) bool { return true }
+
+func (lr *logRecorder) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	e := logEntry{level: level, msg: msg, keyvals: make(map[interface{}]interface{})}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		e.keyvals[keyvals[i]] = keyvals[i+1]
+	}
+	lr.entries = append(lr.entries, e)
+}
+
+func TestPrintfLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := NewPrintfLogger(log.New(buf, "", 0), LogInfo)
+
+	l.Log(LogDebug, "hidden")
+	l.Log(LogWarn, "request failed", LogKeyStream, "foo", LogKeyErrorCode, "Bar", "odd")
+
+	if buf.String() != "WARN request failed stream=foo error_code=Bar odd=MISSING\n" {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+	if l.Enabled(LogDebug) || !l.Enabled(LogError) {
+		t.Errorf("unexpected Enabled")
+	}
+}
+
+func TestClientLogging(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-amzn-RequestId", "abc")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"Stream foo not found"}`))
+	}))
+	defer server.Close()
+
+	recorder := &logRecorder{}
+	k := NewWithEndpoint(NewAuth("BAD_ACCESS_KEY", "BAD_SECRET_KEY", "SESSION_TOKEN"), USEast1, server.URL)
+	k.SetLogger(recorder)
+
+	args := NewArgs()
+	args.Add("StreamName", "foo")
+	args.Add("ShardId", "shardId-000000000001")
+	args.Add("ShardIteratorType", "LATEST")
+	k.GetShardIterator(args)
+
+	if len(recorder.entries) != 3 {
+		t.Fatalf("%v != 3", len(recorder.entries))
+	}
+	request, response, failure := recorder.entries[0], recorder.entries[1], recorder.entries[2]
+
+	if request.level != LogDebug || request.keyvals[LogKeyStream] != "foo" || request.keyvals[LogKeyShard] != "shardId-000000000001" {
+		t.Errorf("unexpected request entry %+v", request)
+	}
+	header := request.keyvals["header"].(http.Header)
+	if header.Get("Authorization") != "REDACTED" || header.Get(AWSSecurityTokenHeader) != "REDACTED" {
+		t.Errorf("credentials not redacted: %v", header)
+	}
+	if strings.Contains(strings.Join(header["Authorization"], ""), "BAD_ACCESS_KEY") {
+		t.Errorf("access key logged: %v", header)
+	}
+
+	if response.level != LogDebug || response.keyvals["status"] != 400 || response.keyvals[LogKeyRequestId] != "abc" {
+		t.Errorf("unexpected response entry %+v", response)
+	}
+
+	if failure.level != LogWarn || failure.keyvals[LogKeyErrorCode] != "ResourceNotFoundException" || failure.keyvals[LogKeyStream] != "foo" {
+		t.Errorf("unexpected failure entry %+v", failure)
+	}
+}
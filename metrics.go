@@ -0,0 +1,103 @@
+package kinesis
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RequestMetrics describes one call to the Kinesis or Firehose API, including any
+// retries.
+type RequestMetrics struct {
+	// Operation is the API action, e.g. PutRecords.
+	Operation string
+	// StreamName is the stream or delivery stream the call was for, if any.
+	StreamName string
+	// StatusCode is the HTTP status of the final attempt, or 0 if no response was received.
+	StatusCode int
+	// ErrorCode is the AWS error code of a failed call, e.g. ProvisionedThroughputExceededException.
+	ErrorCode string
+	// Err is the error returned to the caller, if any.
+	Err error
+	// Attempts is the number of times the request was sent.
+	Attempts int
+	// Latency is the time taken by the call, including retries.
+	Latency time.Duration
+	// BytesOut and BytesIn are the sizes of the request body and the response body.
+	BytesOut int64
+	BytesIn  int64
+}
+
+// Metrics receives a RequestMetrics for every API call a Kinesis client makes. It is
+// called synchronously on the caller's goroutine, so it should be fast.
+type Metrics interface {
+	ObserveRequest(m RequestMetrics)
+}
+
+// NoopMetrics discards all metrics. It is the default.
+type NoopMetrics struct{}
+
+// ObserveRequest does nothing.
+func (NoopMetrics) ObserveRequest(RequestMetrics) {}
+
+// ExpvarMetrics publishes request metrics with the standard library expvar package,
+// so they are served as JSON on /debug/vars. The published map has an entry per
+// operation and a "streams" entry per stream, each holding counters of requests,
+// errors, attempts, latency in nanoseconds, and bytes in and out, plus counts by
+// status code and error code.
+type ExpvarMetrics struct {
+	vars    *expvar.Map
+	streams *expvar.Map
+
+	// mu serialises the creation of nested maps
+	mu sync.Mutex
+}
+
+// NewExpvarMetrics publishes a new map of metrics under name. Like expvar.NewMap, it
+// panics if name is already in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	m := &ExpvarMetrics{vars: expvar.NewMap(name), streams: new(expvar.Map).Init()}
+	m.vars.Set("streams", m.streams)
+	return m
+}
+
+// ObserveRequest adds m to the published counters.
+func (em *ExpvarMetrics) ObserveRequest(m RequestMetrics) {
+	em.observe(em.childMap(em.vars, m.Operation), m)
+	if m.StreamName != "" {
+		em.observe(em.childMap(em.streams, m.StreamName), m)
+	}
+}
+
+func (em *ExpvarMetrics) observe(counters *expvar.Map, m RequestMetrics) {
+	counters.Add("requests", 1)
+	if m.Err != nil {
+		counters.Add("errors", 1)
+	}
+	counters.Add("attempts", int64(m.Attempts))
+	counters.Add("latency_ns", int64(m.Latency))
+	counters.Add("bytes_out", m.BytesOut)
+	counters.Add("bytes_in", m.BytesIn)
+	if m.StatusCode != 0 {
+		em.childMap(counters, "status_codes").Add(strconv.Itoa(m.StatusCode), 1)
+	}
+	if m.ErrorCode != "" {
+		em.childMap(counters, "error_codes").Add(m.ErrorCode, 1)
+	}
+}
+
+// childMap returns the map stored under key in parent, creating it if necessary.
+func (em *ExpvarMetrics) childMap(parent *expvar.Map, key string) *expvar.Map {
+	if child, ok := parent.Get(key).(*expvar.Map); ok {
+		return child
+	}
+	em.mu.Lock()
+	defer em.mu.Unlock()
+	if child, ok := parent.Get(key).(*expvar.Map); ok {
+		return child
+	}
+	child := new(expvar.Map).Init()
+	parent.Set(key, child)
+	return child
+}
@@ -0,0 +1,80 @@
+package kinesis
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type metricsRecorder struct {
+	observed []RequestMetrics
+}
+
+func (mr *metricsRecorder) ObserveRequest(m RequestMetrics) {
+	mr.observed = append(mr.observed, m)
+}
+
+func newMetricsServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".DeleteStream") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"Stream foo not found"}`))
+			return
+		}
+		w.Write([]byte(`{"FailedRecordCount":0,"Records":[{"SequenceNumber":"1","ShardId":"shardId-000000000000"}]}`))
+	}))
+}
+
+func TestMetrics(t *testing.T) {
+	server := newMetricsServer()
+	defer server.Close()
+
+	recorder := &metricsRecorder{}
+	k := NewWithEndpoint(NewAuth("BAD_ACCESS_KEY", "BAD_SECRET_KEY", ""), USEast1, server.URL)
+	k.SetMetrics(recorder)
+
+	args := NewArgs()
+	args.Add("StreamName", "foo")
+	args.AddRecord([]byte("data"), "key")
+	k.PutRecords(args)
+	k.DeleteStream("foo")
+
+	if len(recorder.observed) != 2 {
+		t.Fatalf("%v != 2", len(recorder.observed))
+	}
+
+	put := recorder.observed[0]
+	if put.Operation != "PutRecords" || put.StreamName != "foo" || put.StatusCode != 200 || put.Attempts != 1 || put.Err != nil {
+		t.Errorf("unexpected metrics %+v", put)
+	}
+	if put.BytesOut == 0 || put.BytesIn == 0 || put.Latency <= 0 {
+		t.Errorf("unexpected sizes or latency %+v", put)
+	}
+
+	del := recorder.observed[1]
+	if del.Operation != "DeleteStream" || del.StreamName != "foo" || del.StatusCode != 400 || del.ErrorCode != "ResourceNotFoundException" || del.Err == nil {
+		t.Errorf("unexpected metrics %+v", del)
+	}
+}
+
+func TestExpvarMetrics(t *testing.T) {
+	m := NewExpvarMetrics("kinesis_test_metrics")
+	m.ObserveRequest(RequestMetrics{Operation: "PutRecords", StreamName: "foo", StatusCode: 200, Attempts: 2, Latency: time.Millisecond, BytesOut: 10, BytesIn: 5})
+	m.ObserveRequest(RequestMetrics{Operation: "PutRecords", StreamName: "foo", StatusCode: 400, ErrorCode: "ProvisionedThroughputExceededException", Err: &Error{}, Attempts: 1})
+
+	put := expvar.Get("kinesis_test_metrics").(*expvar.Map).Get("PutRecords").(*expvar.Map)
+	if put.Get("requests").String() != "2" || put.Get("errors").String() != "1" || put.Get("attempts").String() != "3" {
+		t.Errorf("unexpected counters %v", put)
+	}
+	if put.Get("error_codes").(*expvar.Map).Get("ProvisionedThroughputExceededException").String() != "1" {
+		t.Errorf("unexpected error codes %v", put.Get("error_codes"))
+	}
+
+	stream := expvar.Get("kinesis_test_metrics").(*expvar.Map).Get("streams").(*expvar.Map).Get("foo").(*expvar.Map)
+	if stream.Get("bytes_out").String() != "10" {
+		t.Errorf("unexpected stream counters %v", stream)
+	}
+}
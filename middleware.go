@@ -0,0 +1,151 @@
+package kinesis
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// DefaultUserAgent is the User-Agent sent by a Client unless the request or a
+// UserAgentMiddleware sets another.
+const DefaultUserAgent = "Golang Kinesis"
+
+// Middleware hooks into the requests sent by a Client; see Client.Use. Any of the
+// functions may be nil. They are called once per attempt, so a request that is
+// retried passes through them again.
+type Middleware struct {
+	// Name identifies the middleware, e.g. in logs.
+	Name string
+
+	// BeforeSign may inspect and modify the request before it is signed, e.g. to add
+	// headers that must be covered by the signature. Returning an error aborts the
+	// request.
+	BeforeSign func(req *http.Request) error
+
+	// AfterSign may inspect the signed request just before it is sent. Changes to
+	// signed headers or the body will invalidate the signature. Returning an error
+	// aborts the request.
+	AfterSign func(req *http.Request) error
+
+	// AfterResponse may inspect and replace the outcome of an attempt, and ask for
+	// the request to be sent again.
+	AfterResponse func(attempt *Attempt)
+}
+
+// Attempt is the outcome of sending a request once.
+type Attempt struct {
+	Request *http.Request
+
+	// Response and Err are what the client returns for this attempt, unless it is
+	// retried. Middleware that replaces Response is responsible for closing the
+	// original body.
+	Response *http.Response
+	Err      error
+
+	// Number counts the attempts at this request, starting from 1.
+	Number int
+
+	// Retry asks the client to sign and send the request again. Requests whose body
+	// cannot be rewound with GetBody are not retried.
+	Retry bool
+
+	// fixedTime is true if the caller set the signing time with a Date header.
+	fixedTime bool
+}
+
+var defaultUserAgentMiddleware = Middleware{
+	Name: "DefaultUserAgent",
+	BeforeSign: func(req *http.Request) error {
+		if req.Header.Get("User-Agent") == "" {
+			req.Header.Set("User-Agent", DefaultUserAgent)
+		}
+		return nil
+	},
+}
+
+// UserAgentMiddleware returns middleware that sets the User-Agent of every request to userAgent.
+func UserAgentMiddleware(userAgent string) Middleware {
+	return Middleware{
+		Name: "UserAgent",
+		BeforeSign: func(req *http.Request) error {
+			req.Header.Set("User-Agent", userAgent)
+			return nil
+		},
+	}
+}
+
+// retryableErrorCodes are the error codes worth retrying after a delay.
+var retryableErrorCodes = map[string]bool{
+	"ProvisionedThroughputExceededException": true,
+	"ThrottlingException":                    true,
+	"LimitExceededException":                 true,
+	"ServiceUnavailable":                     true,
+	"InternalFailure":                        true,
+}
+
+// maxRetryDelay caps the delay RetryMiddleware doubles after each attempt, unless its
+// base delay is longer.
+const maxRetryDelay = 30 * time.Second
+
+// RetryMiddleware returns middleware that retries requests that fail with a network error, a
+// 5xx status or a throttling error code, up to maxAttempts attempts in all. The client
+// never makes more than 10 attempts at a request, so a larger maxAttempts has the same
+// effect as 10. The delay before each retry starts at baseDelay, doubles with every
+// attempt up to 30 seconds, and is jittered to between half and all of that. If the
+// request's context is done while waiting, the request fails with the context's error.
+// Requests with a body that can't be read again, because GetBody is nil, are not retried.
+func RetryMiddleware(maxAttempts int, baseDelay time.Duration) Middleware {
+	return Middleware{
+		Name: "Retry",
+		AfterResponse: func(a *Attempt) {
+			if a.Number >= maxAttempts || !canResend(a.Request) || !isRetryable(a) {
+				return
+			}
+			delay := retryDelay(baseDelay, a.Number)
+			delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+			ctx := a.Request.Context()
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				a.Retry = true
+			case <-ctx.Done():
+				if a.Response != nil {
+					a.Response.Body.Close()
+					a.Response = nil
+				}
+				a.Err = ctx.Err()
+			}
+		},
+	}
+}
+
+// retryDelay returns baseDelay doubled for each attempt after the first, capped at
+// maxRetryDelay unless baseDelay is longer.
+func retryDelay(baseDelay time.Duration, attempts int) time.Duration {
+	if baseDelay <= 0 {
+		return 0
+	}
+	delay := baseDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay && baseDelay < maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func isRetryable(a *Attempt) bool {
+	if a.Err != nil {
+		return true
+	}
+	if a.Response.StatusCode >= 500 {
+		return true
+	}
+	if a.Response.StatusCode != http.StatusBadRequest {
+		return false
+	}
+	return retryableErrorCodes[peekErrorCode(a.Response)]
+}
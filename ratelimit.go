@@ -0,0 +1,186 @@
+package kinesis
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// ShardLimits are the throughput limits of a single shard.
+type ShardLimits struct {
+	// WriteBytesPerSecond limits the data and partition keys written to a shard.
+	WriteBytesPerSecond float64
+	// WriteRecordsPerSecond limits the records written to a shard.
+	WriteRecordsPerSecond float64
+	// ReadsPerSecond limits the GetRecords calls made on a shard.
+	ReadsPerSecond float64
+}
+
+// DefaultShardLimits are the limits Kinesis enforces on each shard.
+var DefaultShardLimits = ShardLimits{
+	WriteBytesPerSecond:   1 << 20,
+	WriteRecordsPerSecond: 1000,
+	ReadsPerSecond:        5,
+}
+
+// RateLimiter keeps writes and reads within the limits of each shard with token buckets,
+// so that requests are delayed on the client rather than rejected with
+// ProvisionedThroughputExceededException. Each bucket holds up to one second of
+// capacity. Records are assigned to shards with the ShardMap set for their stream; the
+// records of a stream without one share a single shard's limits. A RateLimiter is safe
+// for concurrent use, and can be shared by several clients and producers writing to the
+// same streams.
+type RateLimiter struct {
+	limits ShardLimits
+
+	mu        sync.Mutex
+	shardMaps map[string]*ShardMap
+	buckets   map[shardKey]*shardBuckets
+
+	// now and sleep are replaced in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+type shardKey struct {
+	stream, shard string
+}
+
+type shardBuckets struct {
+	bytes, records, reads tokenBucket
+}
+
+// NewRateLimiter creates a RateLimiter that applies limits to every shard.
+func NewRateLimiter(limits ShardLimits) *RateLimiter {
+	return &RateLimiter{
+		limits:    limits,
+		shardMaps: make(map[string]*ShardMap),
+		buckets:   make(map[shardKey]*shardBuckets),
+		now:       time.Now,
+		sleep:     time.Sleep,
+	}
+}
+
+// SetShardMap sets the shards of stream, e.g. after DescribeStream or a reshard. Usage
+// is tracked per shard id, so shards that remain open keep their state.
+func (rl *RateLimiter) SetShardMap(stream string, m *ShardMap) {
+	rl.mu.Lock()
+	rl.shardMaps[stream] = m
+	rl.mu.Unlock()
+}
+
+// ShardFor returns the shard of stream that a record is written to, or "" if it is
+// not known.
+func (rl *RateLimiter) ShardFor(stream, partitionKey, explicitHashKey string) string {
+	rl.mu.Lock()
+	m := rl.shardMaps[stream]
+	rl.mu.Unlock()
+	if m == nil {
+		return ""
+	}
+	shard, _ := m.ShardForRecord(partitionKey, explicitHashKey)
+	return shard
+}
+
+// ReserveWrite takes capacity for writing records totalling bytes to a shard, and returns
+// how long to wait before sending them.
+func (rl *RateLimiter) ReserveWrite(stream, shard string, records, bytes int) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	b := rl.bucketsFor(stream, shard)
+	return maxDuration(
+		b.bytes.reserve(float64(bytes), rl.limits.WriteBytesPerSecond, now),
+		b.records.reserve(float64(records), rl.limits.WriteRecordsPerSecond, now),
+	)
+}
+
+// ReserveRecords takes capacity for writing records to stream, and returns how long to
+// wait before sending them.
+func (rl *RateLimiter) ReserveRecords(stream string, records []Record) time.Duration {
+	type usage struct{ records, bytes int }
+	shards := make(map[string]*usage)
+	for _, r := range records {
+		shard := rl.ShardFor(stream, r.PartitionKey, r.ExplicitHashKey)
+		u := shards[shard]
+		if u == nil {
+			u = &usage{}
+			shards[shard] = u
+		}
+		u.records++
+		u.bytes += len(r.Data) + len(r.PartitionKey)
+	}
+
+	var wait time.Duration
+	for shard, u := range shards {
+		wait = maxDuration(wait, rl.ReserveWrite(stream, shard, u.records, u.bytes))
+	}
+	return wait
+}
+
+// ReserveRead takes capacity for a GetRecords call on a shard, and returns how long to
+// wait before making it.
+func (rl *RateLimiter) ReserveRead(stream, shard string) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.bucketsFor(stream, shard).reads.reserve(1, rl.limits.ReadsPerSecond, rl.now())
+}
+
+// WaitRecords is like ReserveRecords, but sleeps until the records may be sent.
+func (rl *RateLimiter) WaitRecords(stream string, records []Record) {
+	rl.wait(rl.ReserveRecords(stream, records))
+}
+
+// WaitRead is like ReserveRead, but sleeps until the call may be made.
+func (rl *RateLimiter) WaitRead(stream, shard string) {
+	rl.wait(rl.ReserveRead(stream, shard))
+}
+
+func (rl *RateLimiter) wait(d time.Duration) {
+	if d > 0 {
+		rl.sleep(d)
+	}
+}
+
+func (rl *RateLimiter) bucketsFor(stream, shard string) *shardBuckets {
+	key := shardKey{stream, shard}
+	b := rl.buckets[key]
+	if b == nil {
+		b = &shardBuckets{}
+		rl.buckets[key] = b
+	}
+	return b
+}
+
+// tokenBucket holds up to one second of capacity. Reservations larger than the tokens
+// available leave it in debt, which is repaid before later reservations are granted.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// reserve takes n tokens from a bucket refilled at rate per second, and returns how long
+// to wait until the bucket would have held them. A rate of zero means no limit.
+func (tb *tokenBucket) reserve(n, rate float64, now time.Time) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	if tb.updated.IsZero() {
+		tb.tokens = rate
+	} else if elapsed := now.Sub(tb.updated); elapsed > 0 {
+		tb.tokens = math.Min(rate, tb.tokens+elapsed.Seconds()*rate)
+	}
+	tb.updated = now
+	tb.tokens -= n
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / rate * float64(time.Second))
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,107 @@
+package kinesis
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func testRateLimiter(limits ShardLimits) (*RateLimiter, *time.Time, *[]time.Duration) {
+	now := time.Unix(1440938160, 0)
+	var slept []time.Duration
+	rl := NewRateLimiter(limits)
+	rl.now = func() time.Time { return now }
+	rl.sleep = func(d time.Duration) {
+		slept = append(slept, d)
+		now = now.Add(d)
+	}
+	return rl, &now, &slept
+}
+
+func TestRateLimiterWrites(t *testing.T) {
+	rl, now, _ := testRateLimiter(ShardLimits{WriteBytesPerSecond: 1000, WriteRecordsPerSecond: 10})
+
+	for i, tt := range []struct {
+		advance time.Duration
+		records int
+		bytes   int
+		wait    time.Duration
+	}{
+		// a full bucket allows a second's worth at once
+		{0, 10, 100, 0},
+		// then records are limited to one per 100ms
+		{0, 1, 10, 100 * time.Millisecond},
+		{100 * time.Millisecond, 1, 10, 100 * time.Millisecond},
+		// bytes are limited independently, and a large write goes into debt
+		{time.Second, 1, 1500, 500 * time.Millisecond},
+		{500 * time.Millisecond, 1, 10, 10 * time.Millisecond},
+	} {
+		*now = now.Add(tt.advance)
+		wait := rl.ReserveWrite("foo", "shardId-000000000000", tt.records, tt.bytes)
+		if wait != tt.wait {
+			t.Errorf("%d: %v != %v", i, wait, tt.wait)
+		}
+	}
+
+	// other shards are unaffected
+	if wait := rl.ReserveWrite("foo", "shardId-000000000001", 10, 1000); wait != 0 {
+		t.Errorf("%v != 0", wait)
+	}
+}
+
+func TestRateLimiterRecordsByShard(t *testing.T) {
+	rl, _, slept := testRateLimiter(ShardLimits{WriteBytesPerSecond: 1 << 20, WriteRecordsPerSecond: 2})
+	m, err := NewShardMap(testShards())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.SetShardMap("foo", m)
+
+	records := []Record{{PartitionKey: "a"}, {PartitionKey: "a"}, {PartitionKey: "b"}, {PartitionKey: "b"}}
+	rl.WaitRecords("foo", records)
+	if len(*slept) != 0 {
+		t.Errorf("records spread over two shards should not wait: %v", *slept)
+	}
+
+	rl.WaitRecords("foo", records[:1])
+	if len(*slept) != 1 || (*slept)[0] != 500*time.Millisecond {
+		t.Errorf("unexpected waits %v", *slept)
+	}
+
+	// without a shard map the whole stream shares one shard's limits
+	if wait := rl.ReserveRecords("bar", records); wait != time.Second {
+		t.Errorf("%v != 1s", wait)
+	}
+}
+
+func TestRateLimiterReads(t *testing.T) {
+	rl, _, _ := testRateLimiter(DefaultShardLimits)
+	for i := 0; i < 5; i++ {
+		if wait := rl.ReserveRead("foo", "shardId-000000000000"); wait != 0 {
+			t.Errorf("%d: %v != 0", i, wait)
+		}
+	}
+	if wait := rl.ReserveRead("foo", "shardId-000000000000"); wait != 200*time.Millisecond {
+		t.Errorf("%v != 200ms", wait)
+	}
+}
+
+func TestKinesisRateLimiter(t *testing.T) {
+	server := newMetricsServer()
+	defer server.Close()
+
+	rl, _, slept := testRateLimiter(ShardLimits{WriteBytesPerSecond: 100})
+	k := NewWithEndpoint(NewAuth("BAD_ACCESS_KEY", "BAD_SECRET_KEY", ""), USEast1, server.URL)
+	k.SetRateLimiter(rl)
+
+	args := NewArgs()
+	args.Add("StreamName", "foo")
+	args.AddRecord(bytes.Repeat([]byte("x"), 149), "a")
+	k.PutRecords(args)
+	k.PutRecords(args)
+
+	// 150 bytes each, against a bucket holding 100
+	if len(*slept) != 2 || (*slept)[0] != 500*time.Millisecond || (*slept)[1] != 1500*time.Millisecond {
+		t.Errorf("unexpected waits %v", *slept)
+	}
+}
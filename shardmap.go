@@ -0,0 +1,83 @@
+package kinesis
+
+import (
+	"crypto/md5"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// ShardMap finds the shard of a stream that a record is written to, from the hash key
+// ranges of its open shards.
+type ShardMap struct {
+	shards []shardRange
+}
+
+type shardRange struct {
+	id         string
+	start, end *big.Int
+}
+
+// NewShardMap builds a ShardMap from the shards returned by DescribeStream. Closed
+// shards, which have an ending sequence number, are ignored.
+func NewShardMap(shards []DescribeStreamShards) (*ShardMap, error) {
+	m := &ShardMap{}
+	for _, shard := range shards {
+		if shard.SequenceNumberRange.EndingSequenceNumber != "" {
+			continue
+		}
+		start, ok := new(big.Int).SetString(shard.HashKeyRange.StartingHashKey, 10)
+		if !ok {
+			return nil, fmt.Errorf("shard %s has invalid StartingHashKey %q", shard.ShardId, shard.HashKeyRange.StartingHashKey)
+		}
+		end, ok := new(big.Int).SetString(shard.HashKeyRange.EndingHashKey, 10)
+		if !ok {
+			return nil, fmt.Errorf("shard %s has invalid EndingHashKey %q", shard.ShardId, shard.HashKeyRange.EndingHashKey)
+		}
+		m.shards = append(m.shards, shardRange{shard.ShardId, start, end})
+	}
+	sort.Slice(m.shards, func(i, j int) bool {
+		return m.shards[i].start.Cmp(m.shards[j].start) < 0
+	})
+	return m, nil
+}
+
+// Len returns the number of open shards in the map.
+func (m *ShardMap) Len() int {
+	return len(m.shards)
+}
+
+// ShardForHashKey returns the id of the shard whose hash key range contains hashKey.
+func (m *ShardMap) ShardForHashKey(hashKey *big.Int) (string, bool) {
+	i := sort.Search(len(m.shards), func(i int) bool {
+		return m.shards[i].end.Cmp(hashKey) >= 0
+	})
+	if i == len(m.shards) || m.shards[i].start.Cmp(hashKey) > 0 {
+		return "", false
+	}
+	return m.shards[i].id, true
+}
+
+// ShardForRecord returns the id of the shard a record with partitionKey, and
+// explicitHashKey if it is not empty, is written to.
+func (m *ShardMap) ShardForRecord(partitionKey, explicitHashKey string) (string, bool) {
+	hashKey, err := RecordHashKey(partitionKey, explicitHashKey)
+	if err != nil {
+		return "", false
+	}
+	return m.ShardForHashKey(hashKey)
+}
+
+// RecordHashKey returns the hash key Kinesis uses to place a record: explicitHashKey if it
+// is not empty, and otherwise the MD5 of partitionKey as a 128-bit unsigned integer.
+func RecordHashKey(partitionKey, explicitHashKey string) (*big.Int, error) {
+	if explicitHashKey != "" {
+		hashKey, ok := new(big.Int).SetString(explicitHashKey, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid ExplicitHashKey %q", explicitHashKey)
+		}
+		return hashKey, nil
+	}
+	sum := md5.Sum([]byte(partitionKey))
+	return new(big.Int).SetBytes(sum[:]), nil
+}
@@ -0,0 +1,64 @@
+package kinesis
+
+import (
+	"math/big"
+	"testing"
+)
+
+func testShards() []DescribeStreamShards {
+	shards := make([]DescribeStreamShards, 3)
+	shards[0].ShardId = "shardId-000000000000"
+	shards[0].HashKeyRange.StartingHashKey = "0"
+	shards[0].HashKeyRange.EndingHashKey = "340282366920938463463374607431768211455"
+	shards[0].SequenceNumberRange.EndingSequenceNumber = "49"
+	shards[1].ShardId = "shardId-000000000002"
+	shards[1].HashKeyRange.StartingHashKey = "170141183460469231731687303715884105728"
+	shards[1].HashKeyRange.EndingHashKey = "340282366920938463463374607431768211455"
+	shards[2].ShardId = "shardId-000000000001"
+	shards[2].HashKeyRange.StartingHashKey = "0"
+	shards[2].HashKeyRange.EndingHashKey = "170141183460469231731687303715884105727"
+	return shards
+}
+
+func TestShardMap(t *testing.T) {
+	m, err := NewShardMap(testShards())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 2 {
+		t.Errorf("%v != 2", m.Len())
+	}
+
+	for _, tt := range []struct {
+		partitionKey    string
+		explicitHashKey string
+		shard           string
+	}{
+		// md5("a") = 0cc175b9...
+		{"a", "", "shardId-000000000001"},
+		// md5("b") = 92eb5ffe...
+		{"b", "", "shardId-000000000002"},
+		{"a", "170141183460469231731687303715884105727", "shardId-000000000001"},
+		{"a", "170141183460469231731687303715884105728", "shardId-000000000002"},
+		{"a", "not a number", ""},
+	} {
+		shard, _ := m.ShardForRecord(tt.partitionKey, tt.explicitHashKey)
+		if shard != tt.shard {
+			t.Errorf("%q/%q: %v != %v", tt.partitionKey, tt.explicitHashKey, shard, tt.shard)
+		}
+	}
+
+	// past the end of the hash key range
+	tooBig := new(big.Int).Lsh(big.NewInt(1), 128)
+	if shard, ok := m.ShardForHashKey(tooBig); ok {
+		t.Errorf("unexpected shard %v", shard)
+	}
+}
+
+func TestShardMapInvalidHashKey(t *testing.T) {
+	shards := testShards()
+	shards[1].HashKeyRange.EndingHashKey = "x"
+	if _, err := NewShardMap(shards); err == nil {
+		t.Errorf("expected an error")
+	}
+}
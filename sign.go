@@ -10,8 +10,8 @@ import (
 	"net/http"
 	"net/url"
 	"path"
-	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -20,10 +20,12 @@ const (
 	iSO8601BasicFormat      = "20060102T150405Z"
 	iSO8601BasicFormatShort = "20060102"
 	AWS4_URL                = "aws4_request"
+
+	// maxPresignExpires is the longest validity SigV4 allows for a presigned URL.
+	maxPresignExpires = 7 * 24 * time.Hour
 )
 
 var lf = []byte{'\n'}
-var awsKinesisRegexp = regexp.MustCompile(`kinesis.(.*).amazonaws.com`)
 
 // Service represents an AWS-compatible service.
 type Service struct {
@@ -34,28 +36,45 @@ type Service struct {
 	Region string
 }
 
-// Sign signs a request with a Service derived from r.Host
+// Sign signs a request with a Service derived from r.Host using ParseEndpoint
 func Sign(authKeys Auth, r *http.Request) error {
+	return serviceForHost(r.Host).Sign(authKeys, r)
+}
+
+// serviceForHost returns the Service for an AWS hostname, or an empty Service
+// if the hostname isn't recognised.
+func serviceForHost(host string) *Service {
 	sv := new(Service)
-	if awsKinesisRegexp.MatchString(r.Host) {
-		parts := strings.Split(r.Host, ".")
-		sv.Name = parts[0]
-		sv.Region = parts[1]
-	}
-	return sv.Sign(authKeys, r)
+	sv.Name, sv.Region, _ = ParseEndpoint(host)
+	return sv
 }
 
 // Sign signs an HTTP request with the given AWS keys for use on service s.
 func (s *Service) Sign(authKeys Auth, r *http.Request) error {
-	date := r.Header.Get("Date")
-	t := time.Now().UTC()
-	if date != "" {
-		var err error
-		t, err = time.Parse(http.TimeFormat, date)
-		if err != nil {
-			return err
-		}
+	t, err := signingTime(r)
+	if err != nil {
+		return err
 	}
+	return s.signAt(authKeys, r, t, "")
+}
+
+// SignWithPayloadHash is like Sign, but uses payloadHash, the hex encoded SHA-256 of
+// the request body, instead of reading the body to hash it. This avoids buffering
+// bodies that can't be rewound with r.GetBody.
+func (s *Service) SignWithPayloadHash(authKeys Auth, r *http.Request, payloadHash string) error {
+	t, err := signingTime(r)
+	if err != nil {
+		return err
+	}
+	return s.signAt(authKeys, r, t, payloadHash)
+}
+
+// signAt signs r as of time t, replacing any signature r already has. If
+// payloadHash is empty the body is hashed.
+func (s *Service) signAt(authKeys Auth, r *http.Request, t time.Time, payloadHash string) error {
+	t = t.UTC()
+	r.Header.Del("Authorization")
+	r.Header.Del(AWSSecurityTokenHeader)
 	r.Header.Set("Date", t.Format(iSO8601BasicFormat))
 
 	sk, err := authKeys.KeyForSigning(t)
@@ -63,13 +82,8 @@ func (s *Service) Sign(authKeys Auth, r *http.Request) error {
 		return err
 	}
 
-	k := ghmac([]byte("AWS4"+sk.SecretAccessKey), []byte(t.Format(iSO8601BasicFormatShort)))
-	k = ghmac(k, []byte(s.Region))
-	k = ghmac(k, []byte(s.Name))
-	k = ghmac(k, []byte(AWS4_URL))
-
-	h := hmac.New(sha256.New, k)
-	s.writeStringToSign(h, t, r)
+	h := hmac.New(sha256.New, s.signingKey(sk, t))
+	s.writeStringToSign(h, t, r, payloadHash)
 
 	auth := bytes.NewBufferString("AWS4-HMAC-SHA256 ")
 	auth.Write([]byte("Credential=" + sk.AccessKeyId + "/" + s.creds(t)))
@@ -88,15 +102,107 @@ func (s *Service) Sign(authKeys Auth, r *http.Request) error {
 	return nil
 }
 
+// Presign returns a presigned URL for r with a Service derived from r.Host using ParseEndpoint
+func Presign(authKeys Auth, r *http.Request, expires time.Duration) (*url.URL, error) {
+	return serviceForHost(r.Host).Presign(authKeys, r, expires)
+}
+
+// Presign returns a copy of r's URL carrying a query-string signature for use on
+// service s, which is valid for expires (at most 7 days). Whoever makes the request
+// must send the same method, body and headers as r, but needs no credentials. The
+// signing time is taken from the Date header like Sign, or else the local clock,
+// and the Date header itself is not signed. Client.Presign corrects the local clock
+// for skew. r's URL and headers are not modified, but if r has a body that can't be
+// rewound with GetBody, it is read to hash it and replaced with an unread copy, as
+// Sign does.
+func (s *Service) Presign(authKeys Auth, r *http.Request, expires time.Duration) (*url.URL, error) {
+	t, err := signingTime(r)
+	if err != nil {
+		return nil, err
+	}
+	return s.presignAt(authKeys, r, t, expires)
+}
+
+// presignAt is like Presign, but signs as of time t.
+func (s *Service) presignAt(authKeys Auth, r *http.Request, t time.Time, expires time.Duration) (*url.URL, error) {
+	if expires < time.Second || expires > maxPresignExpires {
+		return nil, fmt.Errorf("presigned URL expiry must be between 1s and %v, got %v", maxPresignExpires, expires)
+	}
+	t = t.UTC()
+
+	sk, err := authKeys.KeyForSigning(t)
+	if err != nil {
+		return nil, err
+	}
+
+	// sign a shallow copy so that neither r's headers nor its URL are touched
+	pr := new(http.Request)
+	*pr = *r
+	pr.Header = make(http.Header, len(r.Header)+1)
+	for k, v := range r.Header {
+		if k != "Date" {
+			pr.Header[k] = v
+		}
+	}
+	pr.Header.Set("host", r.Host)
+	u := *r.URL
+	pr.URL = &u
+
+	signedHeaders := new(bytes.Buffer)
+	s.writeHeaderList(signedHeaders, pr)
+
+	q := u.Query()
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", sk.AccessKeyId+"/"+s.creds(t))
+	q.Set("X-Amz-Date", t.Format(iSO8601BasicFormat))
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	q.Set("X-Amz-SignedHeaders", signedHeaders.String())
+	if sk.SessionToken != "" {
+		q.Set(AWSSecurityTokenHeader, sk.SessionToken)
+	}
+	u.RawQuery = encodeQuery(q)
+
+	h := hmac.New(sha256.New, s.signingKey(sk, t))
+	s.writeStringToSign(h, t, pr, "")
+	// writeBody replaces a body it can't rewind with a copy, which r must also have
+	r.Body = pr.Body
+
+	q.Set("X-Amz-Signature", fmt.Sprintf("%x", h.Sum(nil)))
+	u.RawQuery = encodeQuery(q)
+
+	return &u, nil
+}
+
+// signingTime returns the time from r's Date header, or now if there is none.
+func signingTime(r *http.Request) (time.Time, error) {
+	date := r.Header.Get("Date")
+	if date == "" {
+		return time.Now().UTC(), nil
+	}
+	return time.Parse(http.TimeFormat, date)
+}
+
+func (s *Service) signingKey(sk *SigningKey, t time.Time) []byte {
+	k := ghmac([]byte("AWS4"+sk.SecretAccessKey), []byte(t.Format(iSO8601BasicFormatShort)))
+	k = ghmac(k, []byte(s.Region))
+	k = ghmac(k, []byte(s.Name))
+	return ghmac(k, []byte(AWS4_URL))
+}
+
+// encodeQuery encodes v sorted by key, escaping spaces as %20 as SigV4 requires.
+func encodeQuery(v url.Values) string {
+	return strings.Replace(v.Encode(), "+", "%20", -1)
+}
+
 func (s *Service) writeQuery(w io.Writer, r *http.Request) {
 	var a []string
 	for k, vs := range r.URL.Query() {
-		k = url.QueryEscape(k)
+		k = queryEscape(k)
 		for _, v := range vs {
 			if v == "" {
 				a = append(a, k)
 			} else {
-				v = url.QueryEscape(v)
+				v = queryEscape(v)
 				a = append(a, k+"="+v)
 			}
 		}
@@ -110,6 +216,12 @@ func (s *Service) writeQuery(w io.Writer, r *http.Request) {
 	}
 }
 
+// queryEscape escapes s for the canonical query string, which unlike
+// url.QueryEscape encodes spaces as %20.
+func queryEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
 func (s *Service) writeHeader(w io.Writer, r *http.Request) {
 	i, a := 0, make([]string, len(r.Header))
 	for k, v := range r.Header {
@@ -141,15 +253,29 @@ func (s *Service) writeHeaderList(w io.Writer, r *http.Request) {
 	}
 }
 
+// writeBody writes the hex encoded SHA-256 of the body. If the body can be
+// rewound with r.GetBody it is hashed from a fresh copy; otherwise it is read
+// into memory and r.Body is replaced with a reader over that copy.
 func (s *Service) writeBody(w io.Writer, r *http.Request) {
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		panic(err)
-	}
-	r.Body = ioutil.NopCloser(bytes.NewBuffer(b))
-
 	h := sha256.New()
-	h.Write(b)
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			panic(err)
+		}
+		_, err = io.Copy(h, body)
+		body.Close()
+		if err != nil {
+			panic(err)
+		}
+	} else if r.Body != nil {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewBuffer(b))
+		h.Write(b)
+	}
 	fmt.Fprintf(w, "%x", h.Sum(nil))
 }
 
@@ -166,7 +292,7 @@ func (s *Service) writeURI(w io.Writer, r *http.Request) {
 	w.Write([]byte(ruri))
 }
 
-func (s *Service) writeRequest(w io.Writer, r *http.Request) {
+func (s *Service) writeRequest(w io.Writer, r *http.Request, payloadHash string) {
 	r.Header.Set("host", r.Host)
 
 	w.Write([]byte(r.Method))
@@ -180,10 +306,14 @@ func (s *Service) writeRequest(w io.Writer, r *http.Request) {
 	w.Write(lf)
 	s.writeHeaderList(w, r)
 	w.Write(lf)
-	s.writeBody(w, r)
+	if payloadHash != "" {
+		io.WriteString(w, payloadHash)
+	} else {
+		s.writeBody(w, r)
+	}
 }
 
-func (s *Service) writeStringToSign(w io.Writer, t time.Time, r *http.Request) {
+func (s *Service) writeStringToSign(w io.Writer, t time.Time, r *http.Request, payloadHash string) {
 	w.Write([]byte("AWS4-HMAC-SHA256"))
 	w.Write(lf)
 	w.Write([]byte(t.Format(iSO8601BasicFormat)))
@@ -193,7 +323,7 @@ func (s *Service) writeStringToSign(w io.Writer, t time.Time, r *http.Request) {
 	w.Write(lf)
 
 	h := sha256.New()
-	s.writeRequest(h, r)
+	s.writeRequest(h, r, payloadHash)
 	fmt.Fprintf(w, "%x", h.Sum(nil))
 }
 
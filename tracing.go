@@ -0,0 +1,93 @@
+package kinesis
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// Attributes set on the spans created by a Kinesis client.
+const (
+	TraceAttrService    = "aws.service"
+	TraceAttrOperation  = "aws.operation"
+	TraceAttrStreamName = "aws.kinesis.stream_name"
+	TraceAttrShardId    = "aws.kinesis.shard_id"
+	TraceAttrRequestId  = "aws.request_id"
+	TraceAttrAttempt    = "aws.attempt"
+	TraceAttrStatusCode = "http.status_code"
+)
+
+// Tracer starts spans around API calls, so that they can be bridged to a tracing
+// library. A Kinesis client starts a span named after the operation (e.g.
+// Kinesis.PutRecords) around each call, and a child span named "attempt" around
+// each time the request is sent.
+type Tracer interface {
+	// StartSpan starts a span as a child of any span in ctx and returns a context
+	// holding the new span.
+	StartSpan(ctx context.Context, name string, attributes map[string]string) (context.Context, Span)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	SetAttribute(key, value string)
+	RecordError(err error)
+	End()
+}
+
+// NoopTracer creates spans that do nothing. It is the default.
+type NoopTracer struct{}
+
+// StartSpan returns ctx and a span that does nothing.
+func (NoopTracer) StartSpan(ctx context.Context, name string, attributes map[string]string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key, value string) {}
+func (noopSpan) RecordError(err error)          {}
+func (noopSpan) End()                           {}
+
+// tracingMiddleware wraps each attempt at a request made by a Kinesis client in a
+// span, as a child of the span of the call.
+var tracingMiddleware = Middleware{
+	Name: "Tracing",
+	AfterSign: func(req *http.Request) error {
+		if info := getRequestInfo(req.Context()); info != nil {
+			info.attemptSpan = startAttemptSpan(info)
+		}
+		return nil
+	},
+	AfterResponse: func(a *Attempt) {
+		if info := getRequestInfo(a.Request.Context()); info != nil && info.attemptSpan != nil {
+			endAttemptSpan(info.attemptSpan, a.Response, a.Err)
+			info.attemptSpan = nil
+		}
+	},
+}
+
+// startAttemptSpan starts the span for one attempt at the request described by info.
+func startAttemptSpan(info *requestInfo) Span {
+	if info == nil || info.tracer == nil {
+		return noopSpan{}
+	}
+	_, span := info.tracer.StartSpan(info.ctx, "attempt", map[string]string{
+		TraceAttrOperation: info.Operation,
+		TraceAttrAttempt:   strconv.Itoa(info.Attempts),
+	})
+	return span
+}
+
+// endAttemptSpan records the outcome of an attempt and ends its span.
+func endAttemptSpan(span Span, resp *http.Response, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	if resp != nil {
+		span.SetAttribute(TraceAttrStatusCode, strconv.Itoa(resp.StatusCode))
+		if id := resp.Header.Get(requestIdHeader); id != "" {
+			span.SetAttribute(TraceAttrRequestId, id)
+		}
+	}
+	span.End()
+}
@@ -0,0 +1,122 @@
+package kinesis
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type recordedSpan struct {
+	name       string
+	parent     *recordedSpan
+	attributes map[string]string
+	err        error
+	ended      bool
+}
+
+func (s *recordedSpan) SetAttribute(key, value string) { s.attributes[key] = value }
+func (s *recordedSpan) RecordError(err error)          { s.err = err }
+func (s *recordedSpan) End()                           { s.ended = true }
+
+type spanKey struct{}
+
+type spanRecorder struct {
+	spans []*recordedSpan
+}
+
+func (sr *spanRecorder) StartSpan(ctx context.Context, name string, attributes map[string]string) (context.Context, Span) {
+	span := &recordedSpan{name: name, attributes: attributes}
+	span.parent, _ = ctx.Value(spanKey{}).(*recordedSpan)
+	sr.spans = append(sr.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func TestTracer(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		w.Header().Set("x-amzn-RequestId", "request-"+strconv.Itoa(int(n)))
+		if n == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"__type":"InternalFailure","message":"try again"}`))
+			return
+		}
+		w.Write([]byte(`{"SequenceNumber":"1","ShardId":"shardId-000000000001"}`))
+	}))
+	defer server.Close()
+
+	recorder := &spanRecorder{}
+	k := NewWithEndpoint(NewAuth("BAD_ACCESS_KEY", "BAD_SECRET_KEY", ""), USEast1, server.URL)
+	k.client.Use(RetryMiddleware(3, time.Millisecond))
+	k.SetTracer(recorder)
+
+	args := NewArgs()
+	args.Add("StreamName", "foo")
+	args.Add("PartitionKey", "key")
+	args.AddData([]byte("data"))
+	_, err := k.PutRecord(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.spans) != 3 {
+		t.Fatalf("%v != 3", len(recorder.spans))
+	}
+	call, first, second := recorder.spans[0], recorder.spans[1], recorder.spans[2]
+
+	if call.name != "Kinesis.PutRecord" || call.parent != nil || !call.ended || call.err != nil {
+		t.Errorf("unexpected call span %+v", call)
+	}
+	if call.attributes[TraceAttrStreamName] != "foo" || call.attributes[TraceAttrShardId] != "shardId-000000000001" || call.attributes[TraceAttrService] != "kinesis" {
+		t.Errorf("unexpected call span attributes %v", call.attributes)
+	}
+
+	for i, tt := range []struct {
+		span       *recordedSpan
+		attempt    string
+		statusCode string
+		requestId  string
+	}{
+		{first, "1", "500", "request-1"},
+		{second, "2", "200", "request-2"},
+	} {
+		if tt.span.parent != call || !tt.span.ended {
+			t.Errorf("%d: attempt span not ended or not a child of the call span", i)
+		}
+		if tt.span.attributes[TraceAttrAttempt] != tt.attempt || tt.span.attributes[TraceAttrStatusCode] != tt.statusCode || tt.span.attributes[TraceAttrRequestId] != tt.requestId {
+			t.Errorf("%d: unexpected attempt span attributes %v", i, tt.span.attributes)
+		}
+	}
+}
+
+func TestTracerRecordsError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-amzn-RequestId", "abc")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"Stream foo not found"}`))
+	}))
+	defer server.Close()
+
+	recorder := &spanRecorder{}
+	k := NewWithEndpoint(NewAuth("BAD_ACCESS_KEY", "BAD_SECRET_KEY", ""), USEast1, server.URL)
+	k.SetTracer(recorder)
+
+	args := NewArgs()
+	args.Add("StreamName", "foo")
+	args.Add("ShardId", "shardId-000000000002")
+	args.Add("ShardIteratorType", "LATEST")
+	_, err := k.GetShardIterator(args)
+	e, ok := err.(*Error)
+	if !ok || e.RequestId != "abc" {
+		t.Fatalf("unexpected error %#v", err)
+	}
+
+	call := recorder.spans[0]
+	if call.err != err || call.attributes[TraceAttrShardId] != "shardId-000000000002" {
+		t.Errorf("unexpected call span %+v", call)
+	}
+}
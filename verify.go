@@ -0,0 +1,263 @@
+package kinesis
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxSignatureAge is how far the signing time of a request may be from the
+// verifier's clock, in either direction, before it is rejected as expired. It matches
+// the limit AWS applies.
+const DefaultMaxSignatureAge = 15 * time.Minute
+
+// VerifyReason says why a request failed verification.
+type VerifyReason int
+
+const (
+	// SignatureMissing means the request has no (or a malformed) signature.
+	SignatureMissing VerifyReason = iota
+	// SignatureUnknownKey means the credential lookup did not recognise the access key.
+	SignatureUnknownKey
+	// SignatureMismatch means the signature does not match the request.
+	SignatureMismatch
+	// SignatureExpired means the signing time is too far from now, or a presigned URL has expired.
+	SignatureExpired
+	// SignatureWrongScope means the credential scope names the wrong date, region or service.
+	SignatureWrongScope
+)
+
+// VerifyError is returned by Verifier.Verify when a request is rejected.
+type VerifyError struct {
+	Reason  VerifyReason
+	Message string
+}
+
+// Error returns error message from error object
+func (err *VerifyError) Error() string {
+	return err.Message
+}
+
+// AWSError returns the error AWS would respond with, so that a stand-in server can
+// send it back to the client.
+func (err *VerifyError) AWSError() *Error {
+	switch err.Reason {
+	case SignatureMissing:
+		return &Error{StatusCode: http.StatusBadRequest, Code: "MissingAuthenticationTokenException", Message: err.Message}
+	case SignatureUnknownKey:
+		return &Error{StatusCode: http.StatusBadRequest, Code: "UnrecognizedClientException", Message: err.Message}
+	}
+	return &Error{StatusCode: http.StatusBadRequest, Code: "InvalidSignatureException", Message: err.Message}
+}
+
+// Verifier checks the SigV4 signatures of incoming requests, for use by local
+// stand-ins for AWS services. It understands both the Authorization header written
+// by Service.Sign and the query string written by Service.Presign.
+type Verifier struct {
+	// Lookup returns the credentials for an access key id, or an error if the key
+	// is unknown.
+	Lookup func(accessKeyId string) (*SigningKey, error)
+
+	// Service and Region are the expected credential scope. If empty, any service
+	// or region is accepted.
+	Service string
+	Region  string
+
+	// MaxAge is how far the signing time may be from now. If zero,
+	// DefaultMaxSignatureAge is used.
+	MaxAge time.Duration
+
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// signatureParts holds the values parsed out of an Authorization header or a
+// presigned query string.
+type signatureParts struct {
+	accessKeyId   string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	t             time.Time
+	expires       time.Duration
+	presigned     bool
+}
+
+// Verify recomputes the signature of r and returns a *VerifyError if it is missing,
+// does not match, has expired or is scoped wrongly, or the error from Lookup. The body
+// of r is read and replaced with an equivalent reader.
+func (v *Verifier) Verify(r *http.Request) error {
+	var parts *signatureParts
+	var err error
+	if r.URL.Query().Get("X-Amz-Signature") != "" {
+		parts, err = parsePresignedQuery(r.URL.Query())
+	} else {
+		parts, err = parseAuthorizationHeader(r)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = v.checkTime(parts)
+	if err != nil {
+		return err
+	}
+
+	if parts.date != parts.t.Format(iSO8601BasicFormatShort) {
+		return &VerifyError{SignatureWrongScope, fmt.Sprintf("Credential should be scoped to a valid date, not %s", parts.date)}
+	}
+	if v.Region != "" && parts.region != v.Region {
+		return &VerifyError{SignatureWrongScope, fmt.Sprintf("Credential should be scoped to a valid region, not '%s'", parts.region)}
+	}
+	if v.Service != "" && parts.service != v.Service {
+		return &VerifyError{SignatureWrongScope, fmt.Sprintf("Credential should be scoped to correct service: '%s'", v.Service)}
+	}
+
+	sk, err := v.Lookup(parts.accessKeyId)
+	if err != nil {
+		return err
+	}
+	if sk == nil {
+		return &VerifyError{SignatureUnknownKey, "The security token included in the request is invalid."}
+	}
+
+	// Rebuild the request as it was when it was signed: only the signed headers,
+	// and for presigned requests the query string without the signature.
+	sr := new(http.Request)
+	*sr = *r
+	sr.Header = make(http.Header, len(parts.signedHeaders))
+	for _, name := range parts.signedHeaders {
+		if name == "host" {
+			continue
+		}
+		if values, ok := r.Header[http.CanonicalHeaderKey(name)]; ok {
+			sr.Header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+	}
+	u := *r.URL
+	sr.URL = &u
+	if parts.presigned {
+		q := u.Query()
+		q.Del("X-Amz-Signature")
+		u.RawQuery = encodeQuery(q)
+	}
+
+	sv := &Service{Name: parts.service, Region: parts.region}
+	h := hmac.New(sha256.New, sv.signingKey(sk, parts.t))
+	sv.writeStringToSign(h, parts.t, sr, "")
+	r.Body = sr.Body
+
+	if !hmac.Equal([]byte(fmt.Sprintf("%x", h.Sum(nil))), []byte(parts.signature)) {
+		return &VerifyError{SignatureMismatch, "The request signature we calculated does not match the signature you provided. Check your AWS Secret Access Key and signing method."}
+	}
+	return nil
+}
+
+func (v *Verifier) checkTime(parts *signatureParts) error {
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+	maxAge := v.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultMaxSignatureAge
+	}
+
+	signed := parts.t.Format(iSO8601BasicFormat)
+	if parts.presigned {
+		if now.After(parts.t.Add(parts.expires)) {
+			return &VerifyError{SignatureExpired, fmt.Sprintf("Signature expired: %s is now earlier than %s (%s + %v)", parts.t.Add(parts.expires).Format(iSO8601BasicFormat), now.UTC().Format(iSO8601BasicFormat), signed, parts.expires)}
+		}
+	} else if parts.t.Before(now.Add(-maxAge)) {
+		return &VerifyError{SignatureExpired, fmt.Sprintf("Signature expired: %s is now earlier than %s (%s - %v)", signed, now.Add(-maxAge).UTC().Format(iSO8601BasicFormat), now.UTC().Format(iSO8601BasicFormat), maxAge)}
+	}
+	if parts.t.After(now.Add(maxAge)) {
+		return &VerifyError{SignatureExpired, fmt.Sprintf("Signature not yet current: %s is still later than %s (%s + %v)", signed, now.Add(maxAge).UTC().Format(iSO8601BasicFormat), now.UTC().Format(iSO8601BasicFormat), maxAge)}
+	}
+	return nil
+}
+
+func parseAuthorizationHeader(r *http.Request) (*signatureParts, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, &VerifyError{SignatureMissing, "Missing Authentication Token"}
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		return nil, &VerifyError{SignatureMissing, "Unsupported signature algorithm"}
+	}
+
+	parts := new(signatureParts)
+	var credential, signedHeaders string
+	for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Credential":
+			credential = kv[1]
+		case "SignedHeaders":
+			signedHeaders = kv[1]
+		case "Signature":
+			parts.signature = kv[1]
+		}
+	}
+	if credential == "" || signedHeaders == "" || parts.signature == "" {
+		return nil, &VerifyError{SignatureMissing, "Authorization header requires 'Credential', 'SignedHeaders' and 'Signature' parameters"}
+	}
+
+	// Service.Sign writes the signing time to the Date header; other signers use X-Amz-Date
+	date := r.Header.Get("X-Amz-Date")
+	if date == "" {
+		date = r.Header.Get("Date")
+	}
+
+	err := parts.parse(credential, signedHeaders, date)
+	if err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+func parsePresignedQuery(q url.Values) (*signatureParts, error) {
+	if q.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" {
+		return nil, &VerifyError{SignatureMissing, "Unsupported signature algorithm"}
+	}
+
+	parts := &signatureParts{signature: q.Get("X-Amz-Signature"), presigned: true}
+	err := parts.parse(q.Get("X-Amz-Credential"), q.Get("X-Amz-SignedHeaders"), q.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, err
+	}
+
+	expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || expires < 1 || time.Duration(expires)*time.Second > maxPresignExpires {
+		return nil, &VerifyError{SignatureMissing, "X-Amz-Expires must be a number of seconds between 1 and 604800"}
+	}
+	parts.expires = time.Duration(expires) * time.Second
+	return parts, nil
+}
+
+// parse fills in the credential scope, signed headers and signing time.
+func (parts *signatureParts) parse(credential, signedHeaders, date string) error {
+	scope := strings.Split(credential, "/")
+	if len(scope) != 5 || scope[4] != AWS4_URL {
+		return &VerifyError{SignatureMissing, fmt.Sprintf("Credential should have the form AccessKeyId/date/region/service/%s, not %s", AWS4_URL, credential)}
+	}
+	parts.accessKeyId, parts.date, parts.region, parts.service = scope[0], scope[1], scope[2], scope[3]
+	parts.signedHeaders = strings.Split(signedHeaders, ";")
+
+	t, err := time.Parse(iSO8601BasicFormat, date)
+	if err != nil {
+		return &VerifyError{SignatureMissing, fmt.Sprintf("Date must be in ISO8601 basic format, not '%s'", date)}
+	}
+	parts.t = t
+	return nil
+}
@@ -0,0 +1,140 @@
+package kinesis
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testVerifier(now time.Time) *Verifier {
+	return &Verifier{
+		Lookup: func(accessKeyId string) (*SigningKey, error) {
+			if accessKeyId == "ASWKEY" {
+				return &SigningKey{AccessKeyId: "ASWKEY", SecretAccessKey: "AWSSECRET"}, nil
+			}
+			return nil, nil
+		},
+		Service: "kinesis",
+		Region:  USEast1,
+		Now:     func() time.Time { return now },
+	}
+}
+
+func newSignedRequest(t *testing.T, key, secret, date string) *http.Request {
+	request, err := http.NewRequest("POST", "https://kinesis.us-east-1.amazonaws.com", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("NewRequest Error %v", err)
+	}
+	request.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	request.Header.Set("X-Amz-Target", "Kinesis_20131202.ListStreams")
+	request.Header.Set("Date", date)
+	err = Sign(NewAuth(key, secret, "TOKEN"), request)
+	if err != nil {
+		t.Fatalf("Error on sign (%v)", err)
+	}
+	return request
+}
+
+var testVerifyNow = time.Date(2013, 11, 28, 15, 10, 0, 0, time.UTC)
+
+func TestVerify(t *testing.T) {
+	request := newSignedRequest(t, "ASWKEY", "AWSSECRET", "Thu, 28 Nov 2013 15:04:05 GMT")
+	err := testVerifier(testVerifyNow).Verify(request)
+	if err != nil {
+		t.Errorf("%v != nil", err)
+	}
+}
+
+func TestVerifyFailures(t *testing.T) {
+	verify := func(request *http.Request, v *Verifier) VerifyReason {
+		err := v.Verify(request)
+		verr, ok := err.(*VerifyError)
+		if !ok {
+			t.Fatalf("%v is not a *VerifyError", err)
+		}
+		return verr.Reason
+	}
+
+	request := newSignedRequest(t, "ASWKEY", "WRONGSECRET", "Thu, 28 Nov 2013 15:04:05 GMT")
+	if reason := verify(request, testVerifier(testVerifyNow)); reason != SignatureMismatch {
+		t.Errorf("%v != SignatureMismatch", reason)
+	}
+
+	request = newSignedRequest(t, "ASWKEY", "AWSSECRET", "Thu, 28 Nov 2013 15:04:05 GMT")
+	request.Header.Set("X-Amz-Target", "Kinesis_20131202.DeleteStream")
+	if reason := verify(request, testVerifier(testVerifyNow)); reason != SignatureMismatch {
+		t.Errorf("%v != SignatureMismatch for a tampered header", reason)
+	}
+
+	request = newSignedRequest(t, "ASWKEY", "AWSSECRET", "Thu, 28 Nov 2013 14:04:05 GMT")
+	if reason := verify(request, testVerifier(testVerifyNow)); reason != SignatureExpired {
+		t.Errorf("%v != SignatureExpired", reason)
+	}
+
+	request = newSignedRequest(t, "ASWKEY", "AWSSECRET", "Thu, 28 Nov 2013 15:04:05 GMT")
+	v := testVerifier(testVerifyNow)
+	v.Region = EUWest1
+	if reason := verify(request, v); reason != SignatureWrongScope {
+		t.Errorf("%v != SignatureWrongScope", reason)
+	}
+
+	request = newSignedRequest(t, "UNKNOWN", "AWSSECRET", "Thu, 28 Nov 2013 15:04:05 GMT")
+	if reason := verify(request, testVerifier(testVerifyNow)); reason != SignatureUnknownKey {
+		t.Errorf("%v != SignatureUnknownKey", reason)
+	}
+
+	request, _ = http.NewRequest("POST", "https://kinesis.us-east-1.amazonaws.com", nil)
+	if reason := verify(request, testVerifier(testVerifyNow)); reason != SignatureMissing {
+		t.Errorf("%v != SignatureMissing", reason)
+	}
+}
+
+func TestVerifyPresigned(t *testing.T) {
+	request, _ := http.NewRequest("GET", "https://kinesis.us-east-1.amazonaws.com/?Action=ListStreams", nil)
+	request.Header.Set("Date", "Thu, 28 Nov 2013 15:04:05 GMT")
+	u, err := Presign(NewAuth("ASWKEY", "AWSSECRET", ""), request, time.Minute)
+	if err != nil {
+		t.Fatalf("Error on presign (%v)", err)
+	}
+
+	presigned, _ := http.NewRequest("GET", u.String(), nil)
+	err = testVerifier(time.Date(2013, 11, 28, 15, 4, 30, 0, time.UTC)).Verify(presigned)
+	if err != nil {
+		t.Errorf("%v != nil", err)
+	}
+
+	err = testVerifier(time.Date(2013, 11, 28, 15, 6, 0, 0, time.UTC)).Verify(presigned)
+	if verr, ok := err.(*VerifyError); !ok || verr.Reason != SignatureExpired {
+		t.Errorf("%v is not SignatureExpired", err)
+	}
+}
+
+// A local stand-in can use a Verifier to reject badly signed requests from the client.
+func TestVerifyAgainstClient(t *testing.T) {
+	v := testVerifier(time.Now())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := v.Verify(r); err != nil {
+			awsErr := err.(*VerifyError).AWSError()
+			w.WriteHeader(awsErr.StatusCode)
+			w.Write([]byte(`{"__type":"` + awsErr.Code + `","message":"` + awsErr.Message + `"}`))
+			return
+		}
+		w.Write([]byte(`{"HasMoreStreams":false,"StreamNames":["foo"]}`))
+	}))
+	defer server.Close()
+
+	resp, err := NewWithEndpoint(NewAuth("ASWKEY", "AWSSECRET", ""), USEast1, server.URL).ListStreams(NewArgs())
+	if err != nil {
+		t.Fatalf("%v != nil", err)
+	}
+	if len(resp.StreamNames) != 1 {
+		t.Errorf("%v != 1", len(resp.StreamNames))
+	}
+
+	_, err = NewWithEndpoint(NewAuth("ASWKEY", "WRONGSECRET", ""), USEast1, server.URL).ListStreams(NewArgs())
+	if kerr, ok := err.(*Error); !ok || kerr.Code != "InvalidSignatureException" {
+		t.Errorf("%v is not an InvalidSignatureException", err)
+	}
+}